@@ -1,48 +1,135 @@
-CREATE DATABASE chat DEFAULT charset utf8;
+CREATE DATABASE IF NOT EXISTS chat DEFAULT charset utf8mb4;
 USE chat;
 
+-- Схема соответствует последней миграции из src/migrations.go, применённые версии отмечены в schema_migrations.
+-- Изменения схемы вносятся новой миграцией и переносятся в этот файл
+
+-- Применённые миграции. Версии отмечаются до создания таблиц и только в новой БД:
+-- в существующей БД таблицы не пересоздаются, и недостающие версии применяют миграции
+CREATE TABLE IF NOT EXISTS schema_migrations
+(
+    version     BIGINT NOT NULL PRIMARY KEY,
+    description VARCHAR(255),
+    applied_at  VARCHAR(32)
+);
+
+INSERT IGNORE INTO schema_migrations (version, description, applied_at)
+SELECT version, description, NOW()
+FROM (SELECT 1 AS version, 'начальная схема' AS description
+      UNION ALL SELECT 2, 'увеличение длины текста сообщения до 1024 символов'
+      UNION ALL SELECT 3, 'хеш пароля пользователя'
+      UNION ALL SELECT 4, 'индекс сообщений по чату и времени создания'
+      UNION ALL SELECT 5, 'курсор прочтения участника чата'
+      UNION ALL SELECT 6, 'изменение и удаление сообщений, история версий'
+      UNION ALL SELECT 7, 'системные сообщения об изменении состава чата'
+      UNION ALL SELECT 8, 'роли участников чата'
+      UNION ALL SELECT 9, 'ветки ответов на сообщения'
+      UNION ALL SELECT 10, 'реакции на сообщения'
+      UNION ALL SELECT 11, 'кодировка utf8mb4 для текстов'
+      UNION ALL SELECT 12, 'вложения сообщений'
+      UNION ALL SELECT 13, 'полнотекстовый поиск сообщений') AS versions
+WHERE NOT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = 'E1_Users');
+
 -- Пользователь приложения
-CREATE TABLE E1_Users
+CREATE TABLE IF NOT EXISTS E1_Users
 (
-    id         INTEGER AUTO_INCREMENT, -- уникальный идентификатор пользователя
-    username   VARCHAR(32),            -- уникальное имя пользователя
-    created_at DATETIME,                   -- время создания пользователя
+    id            INTEGER AUTO_INCREMENT, -- уникальный идентификатор пользователя
+    username      VARCHAR(32),            -- уникальное имя пользователя
+    created_at    DATETIME,               -- время создания пользователя
+    password_hash VARCHAR(255),           -- bcrypt-хеш пароля
 
     PRIMARY KEY (id),
     UNIQUE (username)
 );
 
-CREATE TABLE E2_Chat
+CREATE TABLE IF NOT EXISTS E2_Chat
 (
     id         INTEGER AUTO_INCREMENT, -- уникальный идентификатор чата
     name       VARCHAR(32),            -- уникальное имя чата
-    created_at DATETIME,                   -- время создания
+    created_at DATETIME,               -- время создания
 
     PRIMARY KEY (id),
     UNIQUE (name)
 );
 
 -- список пользователей в чате, отношение многие-ко-многим
-CREATE TABLE E3_Chatroom
+CREATE TABLE IF NOT EXISTS E3_Chatroom
 (
-	id_user  INTEGER NOT NULL,
-	id_chat  INTEGER NOT NULL,
+    id_user      INTEGER NOT NULL,                      -- участник
+    id_chat      INTEGER NOT NULL,                      -- чат
+    last_read_id INTEGER NOT NULL DEFAULT 0,            -- курсор прочтения, id последнего прочитанного сообщения
+    role         VARCHAR(16) NOT NULL DEFAULT 'member', -- роль участника: owner, admin, member, readonly
 
-	PRIMARY KEY (id_user,id_chat),
-	FOREIGN KEY (id_user) REFERENCES E1_Users(id),
-	FOREIGN KEY (id_chat) REFERENCES E2_Chat(id)
+    PRIMARY KEY (id_user, id_chat),
+    FOREIGN KEY (id_user) REFERENCES E1_Users (id),
+    FOREIGN KEY (id_chat) REFERENCES E2_Chat (id)
 );
 
 -- Сообщение в чате. Имеет следующие свойства:
-CREATE TABLE E4_Messages
+CREATE TABLE IF NOT EXISTS E4_Messages
 (
-    id         INTEGER AUTO_INCREMENT, -- уникальный идентификатор сообщения
-    id_chat    INTEGER NOT NULL,       -- ссылка на идентификатор чата, в который было отправлено сообщение
-    id_user    INTEGER NOT NULL,       -- ссылка на идентификатор отправителя сообщения, отношение многие-к-одному
-    text       VARCHAR(32),            -- текст отправленного сообщения
-    created_at DATETIME,               -- время создания
+    id             INTEGER AUTO_INCREMENT,     -- уникальный идентификатор сообщения
+    id_chat        INTEGER NOT NULL,           -- ссылка на идентификатор чата, в который было отправлено сообщение
+    id_user        INTEGER NOT NULL,           -- ссылка на идентификатор отправителя сообщения, отношение многие-к-одному
+    text           VARCHAR(1024),              -- текст отправленного сообщения
+    created_at     DATETIME,                   -- время создания
+    edited_at      DATETIME NULL,              -- время последнего изменения текста
+    deleted_at     DATETIME NULL,              -- время удаления
+    kind           VARCHAR(16) NULL,           -- тип системного сообщения
+    id_target      INTEGER NULL,               -- пользователь, которого касается системное сообщение
+    id_reply_to    INTEGER NULL,               -- сообщение, на которое дан ответ
+    id_thread_root INTEGER NULL,               -- первое сообщение ветки ответов
+    reply_count    INTEGER NOT NULL DEFAULT 0, -- количество ответов в ветке
+
+    PRIMARY KEY (id),
+    INDEX idx_messages_chat_created (id_chat, created_at, id),
+    INDEX idx_messages_thread_created (id_thread_root, created_at, id),
+    FULLTEXT INDEX idx_messages_text (text),
+    FOREIGN KEY (id_user) REFERENCES E1_Users (id),
+    FOREIGN KEY (id_chat) REFERENCES E2_Chat (id)
+);
+
+-- Предыдущие версии текста измененных и удаленных сообщений
+CREATE TABLE IF NOT EXISTS E5_MessageRevisions
+(
+    id         INTEGER AUTO_INCREMENT, -- уникальный идентификатор версии
+    id_message INTEGER NOT NULL,       -- сообщение
+    text       VARCHAR(1024),          -- текст до изменения
+    created_at DATETIME,               -- время изменения
+
+    PRIMARY KEY (id),
+    INDEX (id_message),
+    FOREIGN KEY (id_message) REFERENCES E4_Messages (id)
+);
+
+-- Реакции участников на сообщения
+CREATE TABLE IF NOT EXISTS E6_Reactions
+(
+    id         INTEGER AUTO_INCREMENT,                                         -- уникальный идентификатор реакции, задает порядок реакций
+    id_message INTEGER NOT NULL,                                               -- сообщение
+    id_user    INTEGER NOT NULL,                                               -- участник, оставивший реакцию
+    reaction   VARCHAR(32) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL, -- эмодзи или его короткое имя
+    created_at DATETIME,                                                       -- время добавления
+
+    PRIMARY KEY (id),
+    UNIQUE (id_message, id_user, reaction),
+    FOREIGN KEY (id_message) REFERENCES E4_Messages (id),
+    FOREIGN KEY (id_user) REFERENCES E1_Users (id)
+);
+
+-- Вложения сообщений, содержимое хранится в хранилище вложений по ключу storage_key
+CREATE TABLE IF NOT EXISTS E7_Attachments
+(
+    id          INTEGER AUTO_INCREMENT, -- уникальный идентификатор вложения
+    id_message  INTEGER NOT NULL,       -- сообщение
+    name        VARCHAR(255) NOT NULL,  -- имя файла
+    mime_type   VARCHAR(127) NOT NULL,  -- тип содержимого
+    size        BIGINT NOT NULL,        -- размер в байтах
+    checksum    CHAR(64) NOT NULL,      -- SHA-256 содержимого
+    storage_key VARCHAR(64) NOT NULL,   -- ключ содержимого в хранилище вложений
+    created_at  DATETIME,               -- время загрузки
 
     PRIMARY KEY (id),
-    FOREIGN KEY (id_user) REFERENCES E1_Users(id),
-	FOREIGN KEY (id_chat) REFERENCES E2_Chat(id)
+    INDEX (id_message),
+    FOREIGN KEY (id_message) REFERENCES E4_Messages (id)
 );
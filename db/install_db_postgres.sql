@@ -0,0 +1,138 @@
+-- Схема БД для PostgreSQL, аналог install_db.sql.
+-- База данных chat создается заранее (например, переменной POSTGRES_DB контейнера postgres)
+-- Схема соответствует последней миграции из src/migrations.go, применённые версии отмечены в schema_migrations.
+-- Изменения схемы вносятся новой миграцией и переносятся в этот файл
+
+-- Применённые миграции. Версии отмечаются до создания таблиц и только в новой БД:
+-- в существующей БД таблицы не пересоздаются, и недостающие версии применяют миграции
+CREATE TABLE IF NOT EXISTS schema_migrations
+(
+    version     BIGINT NOT NULL PRIMARY KEY,
+    description VARCHAR(255),
+    applied_at  VARCHAR(32)
+);
+
+INSERT INTO schema_migrations (version, description, applied_at)
+SELECT version, description, to_char(LOCALTIMESTAMP(0), 'YYYY-MM-DD HH24:MI:SS')
+FROM (VALUES (1, 'начальная схема'),
+             (2, 'увеличение длины текста сообщения до 1024 символов'),
+             (3, 'хеш пароля пользователя'),
+             (4, 'индекс сообщений по чату и времени создания'),
+             (5, 'курсор прочтения участника чата'),
+             (6, 'изменение и удаление сообщений, история версий'),
+             (7, 'системные сообщения об изменении состава чата'),
+             (8, 'роли участников чата'),
+             (9, 'ветки ответов на сообщения'),
+             (10, 'реакции на сообщения'),
+             (11, 'кодировка utf8mb4 для текстов'),
+             (12, 'вложения сообщений'),
+             (13, 'полнотекстовый поиск сообщений')) AS versions (version, description)
+WHERE to_regclass('e1_users') IS NULL
+ON CONFLICT (version) DO NOTHING;
+
+-- Пользователь приложения
+CREATE TABLE IF NOT EXISTS E1_Users
+(
+    id            SERIAL,       -- уникальный идентификатор пользователя
+    username      VARCHAR(32),  -- уникальное имя пользователя
+    created_at    TIMESTAMP,    -- время создания пользователя
+    password_hash VARCHAR(255), -- bcrypt-хеш пароля
+
+    PRIMARY KEY (id),
+    UNIQUE (username)
+);
+
+CREATE TABLE IF NOT EXISTS E2_Chat
+(
+    id         SERIAL,      -- уникальный идентификатор чата
+    name       VARCHAR(32), -- уникальное имя чата
+    created_at TIMESTAMP,   -- время создания
+
+    PRIMARY KEY (id),
+    UNIQUE (name)
+);
+
+-- список пользователей в чате, отношение многие-ко-многим
+CREATE TABLE IF NOT EXISTS E3_Chatroom
+(
+    id_user      INTEGER NOT NULL,                      -- участник
+    id_chat      INTEGER NOT NULL,                      -- чат
+    last_read_id INTEGER NOT NULL DEFAULT 0,            -- курсор прочтения, id последнего прочитанного сообщения
+    role         VARCHAR(16) NOT NULL DEFAULT 'member', -- роль участника: owner, admin, member, readonly
+
+    PRIMARY KEY (id_user, id_chat),
+    FOREIGN KEY (id_user) REFERENCES E1_Users (id),
+    FOREIGN KEY (id_chat) REFERENCES E2_Chat (id)
+);
+
+-- Сообщение в чате. Имеет следующие свойства:
+CREATE TABLE IF NOT EXISTS E4_Messages
+(
+    id             SERIAL,                     -- уникальный идентификатор сообщения
+    id_chat        INTEGER NOT NULL,           -- ссылка на идентификатор чата, в который было отправлено сообщение
+    id_user        INTEGER NOT NULL,           -- ссылка на идентификатор отправителя сообщения, отношение многие-к-одному
+    text           VARCHAR(1024),              -- текст отправленного сообщения
+    created_at     TIMESTAMP,                  -- время создания
+    edited_at      TIMESTAMP NULL,             -- время последнего изменения текста
+    deleted_at     TIMESTAMP NULL,             -- время удаления
+    kind           VARCHAR(16) NULL,           -- тип системного сообщения
+    id_target      INTEGER NULL,               -- пользователь, которого касается системное сообщение
+    id_reply_to    INTEGER NULL,               -- сообщение, на которое дан ответ
+    id_thread_root INTEGER NULL,               -- первое сообщение ветки ответов
+    reply_count    INTEGER NOT NULL DEFAULT 0, -- количество ответов в ветке
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (id_user) REFERENCES E1_Users (id),
+    FOREIGN KEY (id_chat) REFERENCES E2_Chat (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_messages_chat_created ON E4_Messages (id_chat, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_messages_thread_created ON E4_Messages (id_thread_root, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_messages_text ON E4_Messages USING GIN (to_tsvector('simple', text));
+
+-- Предыдущие версии текста измененных и удаленных сообщений
+CREATE TABLE IF NOT EXISTS E5_MessageRevisions
+(
+    id         SERIAL,           -- уникальный идентификатор версии
+    id_message INTEGER NOT NULL, -- сообщение
+    text       VARCHAR(1024),    -- текст до изменения
+    created_at TIMESTAMP,        -- время изменения
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (id_message) REFERENCES E4_Messages (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_revisions_message ON E5_MessageRevisions (id_message);
+
+-- Реакции участников на сообщения
+CREATE TABLE IF NOT EXISTS E6_Reactions
+(
+    id         SERIAL,               -- уникальный идентификатор реакции, задает порядок реакций
+    id_message INTEGER NOT NULL,     -- сообщение
+    id_user    INTEGER NOT NULL,     -- участник, оставивший реакцию
+    reaction   VARCHAR(32) NOT NULL, -- эмодзи или его короткое имя
+    created_at TIMESTAMP,            -- время добавления
+
+    PRIMARY KEY (id),
+    UNIQUE (id_message, id_user, reaction),
+    FOREIGN KEY (id_message) REFERENCES E4_Messages (id),
+    FOREIGN KEY (id_user) REFERENCES E1_Users (id)
+);
+
+-- Вложения сообщений, содержимое хранится в хранилище вложений по ключу storage_key
+CREATE TABLE IF NOT EXISTS E7_Attachments
+(
+    id          SERIAL,                -- уникальный идентификатор вложения
+    id_message  INTEGER NOT NULL,      -- сообщение
+    name        VARCHAR(255) NOT NULL, -- имя файла
+    mime_type   VARCHAR(127) NOT NULL, -- тип содержимого
+    size        BIGINT NOT NULL,       -- размер в байтах
+    checksum    CHAR(64) NOT NULL,     -- SHA-256 содержимого
+    storage_key VARCHAR(64) NOT NULL,  -- ключ содержимого в хранилище вложений
+    created_at  TIMESTAMP,             -- время загрузки
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (id_message) REFERENCES E4_Messages (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_message ON E7_Attachments (id_message);
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Максимальная длина имени вложения в символах, совпадает с размером столбца name
+const maxAttachmentNameLength = 255
+
+// Объем multipart формы, который держится в памяти, остальное содержимое пишется во временные файлы
+const multipartMemory = 1 << 20
+
+// Типы, которые браузер может показать на странице. Остальные вложения отдаются только для сохранения,
+// чтобы загруженный HTML или SVG не выполнялся от имени сервиса
+var inlineMIMETypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Случайный ключ содержимого вложения в хранилище
+func newBlobKey() (string, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(key), nil
+}
+
+// Имя вложения без пути, обрезанное до maxAttachmentNameLength символов
+func attachmentName(filename string) string {
+	name := filepath.Base(strings.ReplaceAll(filename, `\`, "/"))
+	if name == "." || name == "/" || !utf8.ValidString(name) {
+		name = "file"
+	}
+
+	if utf8.RuneCountInString(name) > maxAttachmentNameLength {
+		name = string([]rune(name)[:maxAttachmentNameLength])
+	}
+
+	return name
+}
+
+// Тип содержимого определяется по первым байтам. Заявленный клиентом тип используется,
+// только если по содержимому тип определить не удалось
+func detectMIMEType(head []byte, declared string) string {
+	detected := http.DetectContentType(head)
+	if detected != "application/octet-stream" {
+		return detected
+	}
+
+	if mediaType, _, err := mime.ParseMediaType(declared); err == nil {
+		return mediaType
+	}
+
+	return detected
+}
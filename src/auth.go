@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Ошибка проверки токена доступа
+var ErrInvalidToken = errors.New("недействительный токен")
+
+// Заголовок токенов, сервис выпускает только JWT с подписью HMAC-SHA256
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Содержимое токена доступа
+type tokenClaims struct {
+	Subject   string `json:"sub"` // идентификатор пользователя
+	IssuedAt  int64  `json:"iat"` // время выпуска, unix
+	ExpiresAt int64  `json:"exp"` // время истечения, unix
+}
+
+// Объект, выпускающий и проверяющий подписанные токены доступа
+type TokenIssuer struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// Создание выпускающего токены. Если секрет не задан, генерируется случайный,
+// и выпущенные токены перестают действовать после перезапуска
+func NewTokenIssuer(secret string, ttl time.Duration) (*TokenIssuer, error) {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		log.Warn().Msg("AUTH_SECRET не задан, токены будут недействительны после перезапуска")
+	}
+
+	return &TokenIssuer{secret: key, ttl: ttl}, nil
+}
+
+// Выпуск токена для пользователя
+func (t *TokenIssuer) Issue(userID uint64) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(t.ttl)
+
+	payload, err := json.Marshal(tokenClaims{
+		Subject:   strconv.FormatUint(userID, 10),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	unsigned := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + t.sign(unsigned), expiresAt, nil
+}
+
+// Проверка токена, возвращает идентификатор пользователя
+func (t *TokenIssuer) Parse(token string) (uint64, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return 0, ErrInvalidToken
+	}
+
+	if !hmac.Equal([]byte(parts[2]), []byte(t.sign(parts[0]+"."+parts[1]))) {
+		return 0, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+
+	claims := tokenClaims{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return 0, ErrInvalidToken
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return 0, ErrInvalidToken
+	}
+
+	userID, err := strconv.ParseUint(claims.Subject, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+
+	return userID, nil
+}
+
+func (t *TokenIssuer) sign(unsigned string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Хеш пароля для хранения
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// Хеш, с которым сравнивается пароль, если у пользователя нет хеша. Стоимость совпадает с bcrypt.DefaultCost,
+// поэтому проверка занимает столько же времени, и по времени ответа нельзя узнать, есть ли пользователь
+const dummyPasswordHash = "$2a$10$eA5G.2BAjaoCHjSyHtm9IuJaZMV96qoxBKIvM9VGCcfdFVDUZweD2"
+
+// Проверка пароля по хешу. Пустой хеш передается для отсутствующего пользователя
+// и пользователя без пароля, войти они не могут
+func checkPassword(hash string, password string) bool {
+	if hash == "" {
+		bcrypt.CompareHashAndPassword([]byte(dummyPasswordHash), []byte(password))
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+type callerKey struct{}
+
+// Идентификатор пользователя, от лица которого выполняется запрос
+func callerID(ctx context.Context) uint64 {
+	userID, _ := ctx.Value(callerKey{}).(uint64)
+	return userID
+}
+
+// Токен доступа из заголовка Authorization: Bearer <token>.
+// Браузеры не позволяют задать заголовки WebSocket подключения, поэтому токен
+// также принимается в параметре запроса access_token
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+
+	return r.URL.Query().Get("access_token")
+}
+
+// Миделвара аутентификации. Определяет пользователя по токену доступа
+// и передает его идентификатор обработчикам через контекст запроса
+func (s *Service) AuthMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := s.tokens.Parse(bearerToken(r))
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, Unauthorized, "Требуется действительный токен доступа")
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, userID)))
+	})
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Проверка пароля без хеша должна занимать столько же, сколько проверка настоящего хеша
+func TestDummyPasswordHash(t *testing.T) {
+	cost, err := bcrypt.Cost([]byte(dummyPasswordHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != bcrypt.DefaultCost {
+		t.Fatalf("стоимость заменяющего хеша %d, ожидалась %d", cost, bcrypt.DefaultCost)
+	}
+	if checkPassword("", "dummy-password") {
+		t.Fatal("пароль принят без хеша")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+// BlobStore - Хранилище содержимого вложений по ключу, который назначает сервис.
+// Метаданные вложений хранятся коннектором, хранилище знает только содержимое
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader) (int64, error) // запись содержимого, возвращает размер
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, error) // чтение с произвольной позиции для запросов диапазонов; ErrNotExist
+	Delete(ctx context.Context, key string) error                    // удаление, отсутствующее содержимое не считается ошибкой
+}
+
+// Создание хранилища вложений по типу
+func NewBlobStore(storeType string) (BlobStore, error) {
+	switch strings.ToLower(storeType) {
+	case "local":
+		config, err := initConfigLocalBlobStore()
+		if err != nil {
+			return nil, err
+		}
+
+		return NewLocalBlobStore(config.Path)
+	default:
+		return nil, fmt.Errorf("неизвестное хранилище вложений %s", storeType)
+	}
+}
+
+type ConfigLocalBlobStore struct {
+	Path string `default:"attachments"` // каталог с содержимым вложений
+}
+
+func initConfigLocalBlobStore() (*ConfigLocalBlobStore, error) {
+	config := &ConfigLocalBlobStore{}
+	err := envconfig.Process("Blob", config)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Хранилище вложений в локальном каталоге. Содержимое раскладывается по подкаталогам
+// по первым символам ключа, чтобы не держать все файлы в одном каталоге
+type LocalBlobStore struct {
+	root string
+}
+
+// Создание хранилища, каталог создается при отсутствии
+func NewLocalBlobStore(root string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, err
+	}
+
+	return &LocalBlobStore{root: root}, nil
+}
+
+// Путь к содержимому. Ключ не может выходить за пределы каталога хранилища
+func (ls *LocalBlobStore) path(key string) (string, error) {
+	if len(key) < 3 || strings.ContainsAny(key, `/\.`) {
+		return "", fmt.Errorf("недопустимый ключ вложения %q", key)
+	}
+
+	return filepath.Join(ls.root, key[:2], key), nil
+}
+
+// Содержимое пишется во временный файл и переименовывается после записи,
+// поэтому читатели не видят частично записанных вложений
+func (ls *LocalBlobStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	path, err := ls.path(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return 0, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), key+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, r)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+func (ls *LocalBlobStore) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	path, err := ls.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("содержимое вложения %s %w", key, ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (ls *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/rs/zerolog/log"
+)
+
+// Cache - Кэш значений по строковому ключу с ограниченным временем жизни
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error) // значение и признак его наличия
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// Создание кэша по типу. По умолчанию используется Redis, если задан его адрес, иначе кэширование отключено:
+// кэш в памяти процесса не видит изменений, сделанных другими копиями сервиса, и включается только явно.
+// Тип off отключает кэширование, тогда возвращается nil
+func NewCache(storeType string, size int) (Cache, error) {
+	if storeType == "" {
+		storeType = "off"
+		if config, err := initConfigRedis(); err == nil && config.Addr != "" {
+			storeType = "redis"
+		}
+	}
+
+	switch strings.ToLower(storeType) {
+	case "off":
+		return nil, nil
+	case "lru":
+		return NewLRUCache(size), nil
+	case "redis":
+		client, err := newRedisClient()
+		if err != nil {
+			return nil, err
+		}
+
+		return NewRedisCache(client), nil
+	default:
+		return nil, fmt.Errorf("неизвестный кэш %s", storeType)
+	}
+}
+
+// Кэш в памяти процесса на size значений, при переполнении вытесняются давно не использованные.
+// У каждой копии сервиса свой кэш, поэтому изменения, сделанные другими копиями, видны только после истечения времени жизни
+type LRUCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // от недавно использованных значений к давно использованным
+}
+
+type lruEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func NewLRUCache(size int) *LRUCache {
+	return &LRUCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (lc *LRUCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	element, ok := lc.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := element.Value.(*lruEntry)
+	if time.Now().After(entry.expiresAt) {
+		lc.order.Remove(element)
+		delete(lc.entries, key)
+		return nil, false, nil
+	}
+	lc.order.MoveToFront(element)
+
+	return entry.value, true, nil
+}
+
+func (lc *LRUCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if element, ok := lc.entries[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.value = value
+		entry.expiresAt = time.Now().Add(ttl)
+		lc.order.MoveToFront(element)
+		return nil
+	}
+
+	lc.entries[key] = lc.order.PushFront(&lruEntry{key: key, value: value, expiresAt: time.Now().Add(ttl)})
+	for lc.order.Len() > lc.size {
+		oldest := lc.order.Back()
+		lc.order.Remove(oldest)
+		delete(lc.entries, oldest.Value.(*lruEntry).key)
+	}
+
+	return nil
+}
+
+func (lc *LRUCache) Delete(ctx context.Context, keys ...string) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	for _, key := range keys {
+		if element, ok := lc.entries[key]; ok {
+			lc.order.Remove(element)
+			delete(lc.entries, key)
+		}
+	}
+
+	return nil
+}
+
+// Префикс ключей кэша в Redis
+const cacheKeyPrefix = "cache:"
+
+// Кэш в Redis, общий для всех копий сервиса
+type RedisCache struct {
+	client *redis.Client
+}
+
+func NewRedisCache(client *redis.Client) *RedisCache {
+	return &RedisCache{client: client}
+}
+
+func (rc *RedisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := rc.client.WithContext(ctx).Get(cacheKeyPrefix + key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return value, true, nil
+}
+
+func (rc *RedisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return rc.client.WithContext(ctx).Set(cacheKeyPrefix+key, value, ttl).Err()
+}
+
+func (rc *RedisCache) Delete(ctx context.Context, keys ...string) error {
+	prefixed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		prefixed = append(prefixed, cacheKeyPrefix+key)
+	}
+
+	return rc.client.WithContext(ctx).Del(prefixed...).Err()
+}
+
+// Поколения кэша чата. Ключи участников и страниц сообщений чата содержат текущее поколение,
+// поэтому для сброса всех ключей чата достаточно записать новое поколение, а старые ключи истекают сами
+const (
+	membersGeneration  = "members"
+	messagesGeneration = "messages"
+)
+
+// Время жизни поколения чата. Истекшее поколение заменяется новым, что равносильно сбросу
+const generationTTL = 24 * time.Hour
+
+// Страница сообщений в кэше
+type cachedPage struct {
+	Messages []Message `json:"messages"`
+	HasMore  bool      `json:"has_more"`
+}
+
+// CachingConnector - Коннектор, кэширующий проверки существования пользователей и чатов, участие и роли
+// в чатах и первые страницы истории чата. Изменения, сделанные через коннектор, сбрасывают
+// затронутые значения. Ошибки кэша не прерывают запрос: значение берется из следующего коннектора.
+// Кэш в памяти процесса не сбрасывается изменениями других копий сервиса, поэтому в нем не хранятся
+// участие и роли, которые определяют права доступа, и отсутствие пользователей и чатов
+type CachingConnector struct {
+	next    Connector
+	cache   Cache
+	local   bool // кэш в памяти процесса, а не общий для копий сервиса
+	ttl     time.Duration
+	metrics *Metrics
+}
+
+func NewCachingConnector(next Connector, cache Cache, ttl time.Duration, metrics *Metrics) *CachingConnector {
+	_, local := cache.(*LRUCache)
+
+	return &CachingConnector{next: next, cache: cache, local: local, ttl: ttl, metrics: metrics}
+}
+
+// Значение из кэша, промах и ошибка кэша не различаются
+func (cc *CachingConnector) get(ctx context.Context, method string, key string) ([]byte, bool) {
+	value, ok, err := cc.cache.Get(ctx, key)
+	if err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("Не удалось прочитать кэш")
+	}
+	cc.metrics.observeCache(method, ok)
+
+	return value, ok
+}
+
+func (cc *CachingConnector) set(ctx context.Context, key string, value []byte) {
+	if err := cc.cache.Set(ctx, key, value, cc.ttl); err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("Не удалось записать кэш")
+	}
+}
+
+// Сброс ключей после изменения. Если сбросить не удалось, устаревшие значения живут до истечения ttl
+func (cc *CachingConnector) invalidate(ctx context.Context, keys ...string) {
+	if err := cc.cache.Delete(ctx, keys...); err != nil {
+		log.Warn().Err(err).Strs("keys", keys).Msg("Не удалось сбросить кэш")
+	}
+}
+
+// Текущее поколение кэша чата, при отсутствии создается новое
+func (cc *CachingConnector) generation(ctx context.Context, kind string, chatID uint64) (string, bool) {
+	key := fmt.Sprintf("gen:%s:%d", kind, chatID)
+	value, ok, err := cc.cache.Get(ctx, key)
+	if err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("Не удалось прочитать кэш")
+		return "", false
+	}
+	if ok {
+		return string(value), true
+	}
+
+	return cc.nextGeneration(ctx, kind, chatID)
+}
+
+// Новое поколение кэша чата: значения, записанные в прежнем поколении, больше не читаются
+func (cc *CachingConnector) nextGeneration(ctx context.Context, kind string, chatID uint64) (string, bool) {
+	key := fmt.Sprintf("gen:%s:%d", kind, chatID)
+	generation := strconv.FormatInt(time.Now().UnixNano(), 36)
+	if err := cc.cache.Set(ctx, key, []byte(generation), generationTTL); err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("Не удалось сбросить кэш")
+		return "", false
+	}
+
+	return generation, true
+}
+
+// Закэшированный признак или результат следующего коннектора. Отрицательный результат в кэше в памяти процесса
+// не сохраняется: пользователь или чат, созданный другой копией сервиса, нашелся бы только через ttl
+func (cc *CachingConnector) cachedBool(ctx context.Context, method string, key string, load func() (bool, error)) (bool, error) {
+	if value, ok := cc.get(ctx, method, key); ok {
+		return string(value) == "1", nil
+	}
+
+	result, err := load()
+	if err != nil {
+		return false, err
+	}
+
+	if !result && cc.local {
+		return false, nil
+	}
+	value := "0"
+	if result {
+		value = "1"
+	}
+	cc.set(ctx, key, []byte(value))
+
+	return result, nil
+}
+
+func (cc *CachingConnector) ping(ctx context.Context) error {
+	return cc.next.ping(ctx)
+}
+
+func (cc *CachingConnector) createUser(ctx context.Context, username string, passwordHash string) (User, error) {
+	user, err := cc.next.createUser(ctx, username, passwordHash)
+	if err != nil {
+		return User{}, err
+	}
+	// Проверка, выполненная до создания пользователя, могла закэшировать его отсутствие
+	cc.invalidate(ctx, fmt.Sprintf("user:%d", user.ID))
+
+	return user, nil
+}
+
+func (cc *CachingConnector) getCredentials(ctx context.Context, username string) (User, string, error) {
+	return cc.next.getCredentials(ctx, username)
+}
+
+func (cc *CachingConnector) checkUsername(ctx context.Context, username string) (bool, error) {
+	return cc.next.checkUsername(ctx, username)
+}
+
+func (cc *CachingConnector) checkUserID(ctx context.Context, user uint64) (bool, error) {
+	return cc.cachedBool(ctx, "checkUserID", fmt.Sprintf("user:%d", user), func() (bool, error) {
+		return cc.next.checkUserID(ctx, user)
+	})
+}
+
+func (cc *CachingConnector) createChart(ctx context.Context, name string, ownerID uint64, users []uint64) (Chat, error) {
+	chat, err := cc.next.createChart(ctx, name, ownerID, users)
+	if err != nil {
+		return Chat{}, err
+	}
+	cc.invalidate(ctx, fmt.Sprintf("chat:%d", chat.ID))
+	cc.nextGeneration(ctx, membersGeneration, chat.ID)
+	cc.nextGeneration(ctx, messagesGeneration, chat.ID)
+
+	return chat, nil
+}
+
+func (cc *CachingConnector) checkChartName(ctx context.Context, name string) (bool, error) {
+	return cc.next.checkChartName(ctx, name)
+}
+
+func (cc *CachingConnector) checkChartID(ctx context.Context, chat uint64) (bool, error) {
+	return cc.cachedBool(ctx, "checkChartID", fmt.Sprintf("chat:%d", chat), func() (bool, error) {
+		return cc.next.checkChartID(ctx, chat)
+	})
+}
+
+func (cc *CachingConnector) isMember(ctx context.Context, chat uint64, user uint64) (bool, error) {
+	if cc.local {
+		return cc.next.isMember(ctx, chat, user)
+	}
+	generation, ok := cc.generation(ctx, membersGeneration, chat)
+	if !ok {
+		return cc.next.isMember(ctx, chat, user)
+	}
+
+	return cc.cachedBool(ctx, "isMember", fmt.Sprintf("member:%d:%s:%d", chat, generation, user), func() (bool, error) {
+		return cc.next.isMember(ctx, chat, user)
+	})
+}
+
+func (cc *CachingConnector) getRole(ctx context.Context, chat uint64, user uint64) (string, error) {
+	if cc.local {
+		return cc.next.getRole(ctx, chat, user)
+	}
+	generation, ok := cc.generation(ctx, membersGeneration, chat)
+	if !ok {
+		return cc.next.getRole(ctx, chat, user)
+	}
+
+	key := fmt.Sprintf("role:%d:%s:%d", chat, generation, user)
+	if value, ok := cc.get(ctx, "getRole", key); ok {
+		return string(value), nil
+	}
+
+	role, err := cc.next.getRole(ctx, chat, user)
+	if err != nil {
+		return "", err
+	}
+	cc.set(ctx, key, []byte(role))
+
+	return role, nil
+}
+
+func (cc *CachingConnector) setRole(ctx context.Context, chat uint64, user uint64, role string) error {
+	if err := cc.next.setRole(ctx, chat, user, role); err != nil {
+		return err
+	}
+	cc.nextGeneration(ctx, membersGeneration, chat)
+
+	return nil
+}
+
+func (cc *CachingConnector) getCharts(ctx context.Context, user uint64) ([]Chat, error) {
+	return cc.next.getCharts(ctx, user)
+}
+
+func (cc *CachingConnector) sendMessage(ctx context.Context, chatID uint64, authorID uint64, text string, replyTo uint64, attachments []Attachment) (Message, error) {
+	message, err := cc.next.sendMessage(ctx, chatID, authorID, text, replyTo, attachments)
+	if err != nil {
+		return Message{}, err
+	}
+	// Новое сообщение, а для ответа и счетчик ответов первого сообщения ветки, меняют страницы истории чата
+	cc.nextGeneration(ctx, messagesGeneration, chatID)
+
+	return message, nil
+}
+
+func (cc *CachingConnector) getMessage(ctx context.Context, messageID uint64) (Message, error) {
+	return cc.next.getMessage(ctx, messageID)
+}
+
+// Кэшируются только страницы без курсора - с начала или с конца истории: их запрашивают при каждом открытии чата
+func (cc *CachingConnector) getMessages(ctx context.Context, chatID uint64, page MessagePage) ([]Message, bool, error) {
+	if page.Cursor != nil {
+		return cc.next.getMessages(ctx, chatID, page)
+	}
+	generation, ok := cc.generation(ctx, messagesGeneration, chatID)
+	if !ok {
+		return cc.next.getMessages(ctx, chatID, page)
+	}
+
+	key := fmt.Sprintf("messages:%d:%s:%d:%d", chatID, generation, page.Direction, page.Limit)
+	if value, ok := cc.get(ctx, "getMessages", key); ok {
+		cached := cachedPage{}
+		if err := json.Unmarshal(value, &cached); err == nil {
+			return cached.Messages, cached.HasMore, nil
+		}
+	}
+
+	messages, hasMore, err := cc.next.getMessages(ctx, chatID, page)
+	if err != nil {
+		return nil, false, err
+	}
+	if value, err := json.Marshal(cachedPage{Messages: messages, HasMore: hasMore}); err == nil {
+		cc.set(ctx, key, value)
+	}
+
+	return messages, hasMore, nil
+}
+
+func (cc *CachingConnector) getThread(ctx context.Context, rootID uint64, page MessagePage) ([]Message, bool, error) {
+	return cc.next.getThread(ctx, rootID, page)
+}
+
+func (cc *CachingConnector) searchMessages(ctx context.Context, userID uint64, query SearchQuery, page MessagePage) ([]Message, bool, error) {
+	return cc.next.searchMessages(ctx, userID, query, page)
+}
+
+func (cc *CachingConnector) markRead(ctx context.Context, chatID uint64, userID uint64, messageID uint64) (uint64, error) {
+	return cc.next.markRead(ctx, chatID, userID, messageID)
+}
+
+func (cc *CachingConnector) getReadCursors(ctx context.Context, chatID uint64) (map[uint64]uint64, error) {
+	return cc.next.getReadCursors(ctx, chatID)
+}
+
+func (cc *CachingConnector) editMessage(ctx context.Context, messageID uint64, text string) (Message, error) {
+	message, err := cc.next.editMessage(ctx, messageID, text)
+	if err != nil {
+		return Message{}, err
+	}
+	cc.nextGeneration(ctx, messagesGeneration, message.Chat)
+
+	return message, nil
+}
+
+func (cc *CachingConnector) deleteMessage(ctx context.Context, messageID uint64) (Message, error) {
+	message, err := cc.next.deleteMessage(ctx, messageID)
+	if err != nil {
+		return Message{}, err
+	}
+	cc.nextGeneration(ctx, messagesGeneration, message.Chat)
+
+	return message, nil
+}
+
+func (cc *CachingConnector) getRevisions(ctx context.Context, messageID uint64) ([]MessageRevision, error) {
+	return cc.next.getRevisions(ctx, messageID)
+}
+
+// Изменение состава чата меняет участников и добавляет в историю системные сообщения
+func (cc *CachingConnector) addMembers(ctx context.Context, chatID uint64, actorID uint64, users []uint64) ([]Message, error) {
+	messages, err := cc.next.addMembers(ctx, chatID, actorID, users)
+	if err != nil {
+		return nil, err
+	}
+	cc.nextGeneration(ctx, membersGeneration, chatID)
+	cc.nextGeneration(ctx, messagesGeneration, chatID)
+
+	return messages, nil
+}
+
+func (cc *CachingConnector) removeMember(ctx context.Context, chatID uint64, actorID uint64, userID uint64) (Message, error) {
+	message, err := cc.next.removeMember(ctx, chatID, actorID, userID)
+	if err != nil {
+		return Message{}, err
+	}
+	cc.nextGeneration(ctx, membersGeneration, chatID)
+	cc.nextGeneration(ctx, messagesGeneration, chatID)
+
+	return message, nil
+}
+
+func (cc *CachingConnector) addReaction(ctx context.Context, messageID uint64, userID uint64, reaction string) error {
+	return cc.next.addReaction(ctx, messageID, userID, reaction)
+}
+
+func (cc *CachingConnector) removeReaction(ctx context.Context, messageID uint64, userID uint64, reaction string) error {
+	return cc.next.removeReaction(ctx, messageID, userID, reaction)
+}
+
+func (cc *CachingConnector) getReactions(ctx context.Context, messageIDs []uint64, userID uint64) (map[uint64][]Reaction, error) {
+	return cc.next.getReactions(ctx, messageIDs, userID)
+}
+
+func (cc *CachingConnector) getAttachment(ctx context.Context, attachmentID uint64) (Attachment, error) {
+	return cc.next.getAttachment(ctx, attachmentID)
+}
+
+func (cc *CachingConnector) getAttachments(ctx context.Context, messageIDs []uint64) (map[uint64][]Attachment, error) {
+	return cc.next.getAttachments(ctx, messageIDs)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Кэш, который коннектор считает общим для копий сервиса, как Redis
+type sharedCache struct {
+	*LRUCache
+}
+
+// Две копии сервиса над одним хранилищем, у каждой свой кэширующий коннектор
+func newCachingReplicas(cacheA Cache, cacheB Cache) (*ConnectorMemory, *CachingConnector, *CachingConnector) {
+	storage := NewConnectorMemory()
+	metrics := NewMetrics()
+
+	return storage,
+		NewCachingConnector(storage, cacheA, time.Minute, metrics),
+		NewCachingConnector(storage, cacheB, time.Minute, metrics)
+}
+
+func expectMember(t *testing.T, c Connector, chat uint64, user uint64, want bool) {
+	t.Helper()
+
+	member, err := c.isMember(context.Background(), chat, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if member != want {
+		t.Fatalf("участие пользователя %d в чате %d: %v, ожидалось %v", user, chat, member, want)
+	}
+}
+
+func TestNewCacheDefault(t *testing.T) {
+	t.Setenv("REDIS_ADDR", "")
+
+	cache, err := NewCache("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache != nil {
+		t.Fatalf("без Redis кэш по умолчанию %T, ожидалось отключение", cache)
+	}
+}
+
+func TestCacheMessagesGeneration(t *testing.T) {
+	ctx := context.Background()
+	cache := sharedCache{NewLRUCache(100)}
+	_, a, b := newCachingReplicas(cache, cache)
+	ids := createUsers(t, a, "alice", "bob")
+	chat, err := a.createChart(ctx, "chat", ids[0], []uint64{ids[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := sendMessages(t, a, chat.ID, ids[0], "first")
+
+	messages, _, err := a.getMessages(ctx, chat.ID, MessagePage{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, "первая страница", messageIDs(messages), sent)
+
+	// Сообщение, отправленное другой копией, меняет поколение, и закэшированная страница больше не читается
+	sent = append(sent, sendMessages(t, b, chat.ID, ids[1], "second")...)
+	messages, _, err = a.getMessages(ctx, chat.ID, MessagePage{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, "страница после отправки", messageIDs(messages), sent)
+}
+
+func TestCacheMembersGeneration(t *testing.T) {
+	ctx := context.Background()
+	cache := sharedCache{NewLRUCache(100)}
+	_, a, b := newCachingReplicas(cache, cache)
+	ids := createUsers(t, a, "alice", "bob")
+	alice, bob := ids[0], ids[1]
+	chat, err := a.createChart(ctx, "chat", alice, []uint64{bob})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectMember(t, a, chat.ID, bob, true)
+	role, err := a.getRole(ctx, chat.ID, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role != RoleMember {
+		t.Fatalf("роль %q, ожидалась %q", role, RoleMember)
+	}
+
+	if err := b.setRole(ctx, chat.ID, bob, RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	role, err = a.getRole(ctx, chat.ID, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role != RoleAdmin {
+		t.Fatalf("роль после назначения %q, ожидалась %q", role, RoleAdmin)
+	}
+
+	if _, err := b.removeMember(ctx, chat.ID, alice, bob); err != nil {
+		t.Fatal(err)
+	}
+	expectMember(t, a, chat.ID, bob, false)
+}
+
+func TestCacheLocal(t *testing.T) {
+	ctx := context.Background()
+	_, a, b := newCachingReplicas(NewLRUCache(100), NewLRUCache(100))
+	ids := createUsers(t, a, "alice", "bob")
+	alice, bob := ids[0], ids[1]
+	chat, err := a.createChart(ctx, "chat", alice, []uint64{bob})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Участие не кэшируется в памяти процесса: исключение другой копией видно сразу
+	expectMember(t, a, chat.ID, bob, true)
+	if _, err := b.removeMember(ctx, chat.ID, alice, bob); err != nil {
+		t.Fatal(err)
+	}
+	expectMember(t, a, chat.ID, bob, false)
+
+	// Отсутствие пользователя не кэшируется: созданный другой копией пользователь находится сразу
+	exists, err := a.checkUserID(ctx, bob+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatalf("пользователь %d существует до создания", bob+1)
+	}
+	created := createUsers(t, b, "carol")
+	exists, err = a.checkUserID(ctx, created[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatalf("пользователь %d, созданный другой копией, не найден", created[0])
+	}
+}
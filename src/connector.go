@@ -1,21 +1,124 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
-// Интерфейс описывает работу с хранилищем данных
+// Интерфейс описывает работу с хранилищем данных.
+// Все методы принимают контекст запроса и прерываются при его отмене или истечении срока.
 type Connector interface {
-	createUser(username string) (User, error)
-	checkUsername(username string) (bool, error)
-	checkUserID(user uint64) (bool, error)
-	createChart(name string, users []uint64) (Chat, error)
-	checkChartName(name string) (bool, error)
-	checkChartID(chat uint64) (bool, error)
-	getCharts(user uint64) ([]Chat, error)
-	sendMessage(chatID uint64, authorID uint64, text string) (Message, error)
-	getMessages(chatID uint64) ([]Message, error)
+	// Проверка доступности хранилища, устанавливает подключение при необходимости
+	ping(ctx context.Context) error
+	createUser(ctx context.Context, username string, passwordHash string) (User, error) // ErrAlreadyExist при занятом имени
+	getCredentials(ctx context.Context, username string) (User, string, error)          // пользователь и хеш пароля; ErrNotExist
+	checkUsername(ctx context.Context, username string) (bool, error)
+	checkUserID(ctx context.Context, user uint64) (bool, error)
+	// Атомарно вместе с участниками, создатель становится владельцем чата; ErrAlreadyExist, ErrNotExist
+	createChart(ctx context.Context, name string, ownerID uint64, users []uint64) (Chat, error)
+	checkChartName(ctx context.Context, name string) (bool, error)
+	checkChartID(ctx context.Context, chat uint64) (bool, error)
+	isMember(ctx context.Context, chat uint64, user uint64) (bool, error)     // пользователь состоит в чате
+	getRole(ctx context.Context, chat uint64, user uint64) (string, error)    // роль участника, пустая строка если пользователь не в чате
+	setRole(ctx context.Context, chat uint64, user uint64, role string) error // ErrNotExist, если пользователь не в чате
+	getCharts(ctx context.Context, user uint64) ([]Chat, error)
+	// Ответ replyTo попадает в ветку исходного сообщения; ErrNotExist, если сообщения replyTo нет в чате.
+	// Вложения с уже записанным содержимым сохраняются атомарно вместе с сообщением
+	sendMessage(ctx context.Context, chatID uint64, authorID uint64, text string, replyTo uint64, attachments []Attachment) (Message, error)
+	getMessage(ctx context.Context, messageID uint64) (Message, error) // ErrNotExist
+	// Страница сообщений в хронологическом порядке и признак наличия следующей страницы
+	getMessages(ctx context.Context, chatID uint64, page MessagePage) ([]Message, bool, error)
+	getThread(ctx context.Context, rootID uint64, page MessagePage) ([]Message, bool, error) // страница ответов ветки
+	// Поиск неудаленных сообщений участников в чатах пользователя userID, страница в хронологическом порядке
+	searchMessages(ctx context.Context, userID uint64, query SearchQuery, page MessagePage) ([]Message, bool, error)
+	// Сдвиг курсора прочтения участника вперед до сообщения, возвращает итоговый курсор
+	markRead(ctx context.Context, chatID uint64, userID uint64, messageID uint64) (uint64, error)
+	getReadCursors(ctx context.Context, chatID uint64) (map[uint64]uint64, error) // id последнего прочитанного сообщения по id участника
+	// Изменение текста и удаление сообщения с сохранением предыдущей версии текста; ErrNotExist для удаленных
+	editMessage(ctx context.Context, messageID uint64, text string) (Message, error)
+	deleteMessage(ctx context.Context, messageID uint64) (Message, error)
+	getRevisions(ctx context.Context, messageID uint64) ([]MessageRevision, error) // от ранней версии к поздней
+	// Изменение состава чата атомарно вместе с системными сообщениями об изменении
+	addMembers(ctx context.Context, chatID uint64, actorID uint64, users []uint64) ([]Message, error) // ErrAlreadyExist, ErrNotExist
+	removeMember(ctx context.Context, chatID uint64, actorID uint64, userID uint64) (Message, error)  // ErrNotExist; actorID == userID - выход из чата
+	// Реакции участника на сообщение; ErrAlreadyExist для повторной реакции, ErrNotExist для снятия отсутствующей
+	addReaction(ctx context.Context, messageID uint64, userID uint64, reaction string) error
+	removeReaction(ctx context.Context, messageID uint64, userID uint64, reaction string) error
+	// Реакции на сообщения по id сообщения в порядке появления, Me отмечает реакции пользователя userID
+	getReactions(ctx context.Context, messageIDs []uint64, userID uint64) (map[uint64][]Reaction, error)
+	getAttachment(ctx context.Context, attachmentID uint64) (Attachment, error)               // ErrNotExist
+	getAttachments(ctx context.Context, messageIDs []uint64) (map[uint64][]Attachment, error) // вложения по id сообщения в порядке загрузки
+}
+
+// Пауза перед повторной проверкой хранилища при запуске, удваивается после каждой неудачи
+const (
+	storageRetryMinDelay = 500 * time.Millisecond
+	storageRetryMaxDelay = 8 * time.Second
+)
+
+// Ожидание доступности хранилища при запуске. Каждая проверка ограничена pingTimeout,
+// попытки повторяются, пока не истечет waitTimeout
+func waitStorage(connector Connector, pingTimeout time.Duration, waitTimeout time.Duration) error {
+	deadline := time.Now().Add(waitTimeout)
+	delay := storageRetryMinDelay
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		err := connector.ping(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("хранилище недоступно после %d попыток: %w", attempt, err)
+		}
+		log.Warn().Err(err).Int("attempt", attempt).Dur("retry in", delay).Msg("Хранилище недоступно")
+
+		time.Sleep(delay)
+		delay *= 2
+		if delay > storageRetryMaxDelay {
+			delay = storageRetryMaxDelay
+		}
+	}
+}
+
+// Ошибки хранилища, по которым сервис выбирает код ответа.
+// Коннекторы оборачивают их, дополняя описанием сущности.
+var (
+	ErrAlreadyExist = errors.New("уже существует")
+	ErrNotExist     = errors.New("не существует")
+)
+
+// Текст системного сообщения об изменении состава чата по именам пользователей
+func systemMessageText(kind string, actor string, target string) string {
+	switch kind {
+	case MessageMemberAdded:
+		return fmt.Sprintf("Пользователь %s добавил в чат пользователя %s", actor, target)
+	case MessageMemberRemoved:
+		return fmt.Sprintf("Пользователь %s исключил из чата пользователя %s", actor, target)
+	default:
+		return fmt.Sprintf("Пользователь %s вышел из чата", target)
+	}
+}
+
+// Список идентификаторов без повторов в исходном порядке
+func uniqueIDs(ids []uint64) []uint64 {
+	seen := make(map[uint64]struct{}, len(ids))
+	result := make([]uint64, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		result = append(result, id)
+	}
+
+	return result
 }
 
 func NewConnector(controllerType string) (Connector, error) {
@@ -27,6 +130,32 @@ func NewConnector(controllerType string) (Connector, error) {
 		}
 
 		return &ConnectorMySQL{config: config}, nil
+	case "postgres":
+		config, err := initConfigPostgres()
+		if err != nil {
+			return nil, err
+		}
+
+		connector := &ConnectorPostgres{config: config}
+		if err := connector.connect(); err != nil {
+			return nil, err
+		}
+
+		return connector, nil
+	case "memory":
+		return NewConnectorMemory(), nil
+	case "sqlite":
+		config, err := initConfigSQLite()
+		if err != nil {
+			return nil, err
+		}
+
+		connector := &ConnectorSQLite{config: config}
+		if err := connector.connect(); err != nil {
+			return nil, err
+		}
+
+		return connector, nil
 	default:
 		return nil, fmt.Errorf("неизвестный коннектор %s", controllerType)
 	}
@@ -0,0 +1,630 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Общие проверки поведения коннекторов. Все коннекторы проверяются одними тестами, поэтому
+// хранилище в памяти и SQLite ведут себя так же, как MySQL.
+//
+// Коннекторы к серверам БД проверяются, если они перечислены в TEST_CONNECTORS через запятую,
+// например TEST_CONNECTORS=mysql,postgres. Подключение задается переменными MYSQL_* и POSTGRES_*.
+// Перед каждым тестом схема БД откатывается и создается миграциями заново,
+// поэтому БД должна быть отдельной тестовой
+
+// Фабрика пустого хранилища для одного теста
+type connectorFactory func(t *testing.T) Connector
+
+func testConnectors(t *testing.T) map[string]connectorFactory {
+	factories := map[string]connectorFactory{
+		"memory": func(t *testing.T) Connector {
+			return NewConnectorMemory()
+		},
+		"sqlite": func(t *testing.T) Connector {
+			connector := &ConnectorSQLite{config: &ConfigSQLite{Path: filepath.Join(t.TempDir(), "chat.db")}}
+			if err := connector.connect(); err != nil {
+				t.Fatal(err)
+			}
+			return migratedConnector(t, connector)
+		},
+	}
+
+	for _, connectorType := range strings.Split(os.Getenv("TEST_CONNECTORS"), ",") {
+		connectorType := strings.TrimSpace(connectorType)
+		if connectorType == "" {
+			continue
+		}
+
+		factories[connectorType] = func(t *testing.T) Connector {
+			connector, err := NewConnector(connectorType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return migratedConnector(t, connector)
+		}
+	}
+
+	return factories
+}
+
+// Пересоздание схемы БД коннектора миграциями
+func migratedConnector(t *testing.T, connector Connector) Connector {
+	t.Helper()
+
+	migrator, err := NewMigrator(connector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, ok, err := migrator.Down()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+	}
+	if _, err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := connector.(SQLConnector).sqlDB()
+	t.Cleanup(func() { db.Close() })
+
+	return connector
+}
+
+// Запуск проверки на всех коннекторах
+func runConnectorTest(t *testing.T, test func(t *testing.T, c Connector)) {
+	for name, factory := range testConnectors(t) {
+		factory := factory
+		t.Run(name, func(t *testing.T) {
+			test(t, factory(t))
+		})
+	}
+}
+
+// Создание пользователей с указанными именами, возвращает их id
+func createUsers(t *testing.T, c Connector, usernames ...string) []uint64 {
+	t.Helper()
+
+	var ids []uint64
+	for _, username := range usernames {
+		user, err := c.createUser(context.Background(), username, "hash-"+username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, user.ID)
+	}
+
+	return ids
+}
+
+// Отправка сообщений в чат, возвращает их id
+func sendMessages(t *testing.T, c Connector, chatID uint64, authorID uint64, texts ...string) []uint64 {
+	t.Helper()
+
+	var ids []uint64
+	for _, text := range texts {
+		message, err := c.sendMessage(context.Background(), chatID, authorID, text, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, message.ID)
+	}
+
+	return ids
+}
+
+func messageIDs(messages []Message) []uint64 {
+	ids := []uint64{}
+	for _, message := range messages {
+		ids = append(ids, message.ID)
+	}
+
+	return ids
+}
+
+func expectIDs(t *testing.T, what string, got []uint64, want []uint64) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("%s: %v, ожидалось %v", what, got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("%s: %v, ожидалось %v", what, got, want)
+		}
+	}
+}
+
+func expectErr(t *testing.T, what string, err error, target error) {
+	t.Helper()
+
+	if !errors.Is(err, target) {
+		t.Fatalf("%s: ошибка %v, ожидалась %v", what, err, target)
+	}
+}
+
+func TestConnectorUsers(t *testing.T) {
+	runConnectorTest(t, func(t *testing.T, c Connector) {
+		ctx := context.Background()
+		ids := createUsers(t, c, "alice", "bob")
+		if ids[0] == ids[1] {
+			t.Fatalf("пользователи получили одинаковый id %d", ids[0])
+		}
+
+		_, err := c.createUser(ctx, "alice", "other")
+		expectErr(t, "повторное имя", err, ErrAlreadyExist)
+
+		user, hash, err := c.getCredentials(ctx, "bob")
+		if err != nil || user.ID != ids[1] || user.Username != "bob" || hash != "hash-bob" {
+			t.Fatalf("учетные данные bob: %+v %q %v", user, hash, err)
+		}
+		_, _, err = c.getCredentials(ctx, "nobody")
+		expectErr(t, "учетные данные отсутствующего пользователя", err, ErrNotExist)
+
+		if ok, err := c.checkUsername(ctx, "alice"); err != nil || !ok {
+			t.Fatalf("checkUsername(alice) = %v, %v", ok, err)
+		}
+		if ok, err := c.checkUsername(ctx, "nobody"); err != nil || ok {
+			t.Fatalf("checkUsername(nobody) = %v, %v", ok, err)
+		}
+		if ok, err := c.checkUserID(ctx, ids[0]); err != nil || !ok {
+			t.Fatalf("checkUserID(%d) = %v, %v", ids[0], ok, err)
+		}
+		if ok, err := c.checkUserID(ctx, ids[1]+100); err != nil || ok {
+			t.Fatalf("checkUserID(%d) = %v, %v", ids[1]+100, ok, err)
+		}
+	})
+}
+
+func TestConnectorChats(t *testing.T) {
+	runConnectorTest(t, func(t *testing.T, c Connector) {
+		ctx := context.Background()
+		ids := createUsers(t, c, "alice", "bob", "carol")
+		alice, bob, carol := ids[0], ids[1], ids[2]
+
+		chat, err := c.createChart(ctx, "general", alice, []uint64{bob, bob})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chat.ID == 0 || chat.Name != "general" || len(chat.Users) != 2 {
+			t.Fatalf("созданный чат %+v", chat)
+		}
+
+		_, err = c.createChart(ctx, "general", bob, nil)
+		expectErr(t, "повторное название", err, ErrAlreadyExist)
+
+		// Чат с несуществующим участником не создается целиком
+		_, err = c.createChart(ctx, "broken", alice, []uint64{carol + 100})
+		expectErr(t, "несуществующий участник", err, ErrNotExist)
+		if ok, err := c.checkChartName(ctx, "broken"); err != nil || ok {
+			t.Fatalf("чат с несуществующим участником создан: %v, %v", ok, err)
+		}
+
+		if ok, err := c.checkChartID(ctx, chat.ID); err != nil || !ok {
+			t.Fatalf("checkChartID(%d) = %v, %v", chat.ID, ok, err)
+		}
+		if ok, err := c.checkChartID(ctx, chat.ID+100); err != nil || ok {
+			t.Fatalf("checkChartID(%d) = %v, %v", chat.ID+100, ok, err)
+		}
+
+		roles := map[uint64]string{alice: RoleOwner, bob: RoleMember, carol: ""}
+		for userID, want := range roles {
+			if role, err := c.getRole(ctx, chat.ID, userID); err != nil || role != want {
+				t.Fatalf("роль пользователя %d: %q, %v, ожидалась %q", userID, role, err, want)
+			}
+			if isMember, err := c.isMember(ctx, chat.ID, userID); err != nil || isMember != (want != "") {
+				t.Fatalf("участие пользователя %d: %v, %v", userID, isMember, err)
+			}
+		}
+
+		if err := c.setRole(ctx, chat.ID, bob, RoleAdmin); err != nil {
+			t.Fatal(err)
+		}
+		if role, err := c.getRole(ctx, chat.ID, bob); err != nil || role != RoleAdmin {
+			t.Fatalf("роль после назначения: %q, %v", role, err)
+		}
+		expectErr(t, "роль не участника", c.setRole(ctx, chat.ID, carol, RoleAdmin), ErrNotExist)
+	})
+}
+
+func TestConnectorChatsOrder(t *testing.T) {
+	runConnectorTest(t, func(t *testing.T, c Connector) {
+		ctx := context.Background()
+		ids := createUsers(t, c, "alice", "bob")
+		alice, bob := ids[0], ids[1]
+
+		var chatIDs []uint64
+		for _, name := range []string{"first", "second", "third"} {
+			chat, err := c.createChart(ctx, name, alice, []uint64{bob})
+			if err != nil {
+				t.Fatal(err)
+			}
+			chatIDs = append(chatIDs, chat.ID)
+		}
+		sendMessages(t, c, chatIDs[1], bob, "hello")
+		last := sendMessages(t, c, chatIDs[0], bob, "hello", "again")
+
+		// Чаты с сообщениями идут по последнему сообщению, остальные - по времени создания
+		chats, err := c.getCharts(ctx, alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []uint64{}
+		for _, chat := range chats {
+			got = append(got, chat.ID)
+		}
+		expectIDs(t, "порядок чатов", got, []uint64{chatIDs[0], chatIDs[1], chatIDs[2]})
+		if len(chats[0].Users) != 2 {
+			t.Fatalf("участники чата %v", chats[0].Users)
+		}
+
+		if chats[0].LastMessage == nil || chats[0].LastMessage.ID != last[1] {
+			t.Fatalf("последнее сообщение %+v, ожидалось %d", chats[0].LastMessage, last[1])
+		}
+		if chats[0].UnreadCount != 2 || chats[2].LastMessage != nil {
+			t.Fatalf("непрочитанных %d, последнее сообщение пустого чата %+v", chats[0].UnreadCount, chats[2].LastMessage)
+		}
+
+		// Свои сообщения не считаются непрочитанными
+		chats, err = c.getCharts(ctx, bob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chats[0].UnreadCount != 0 {
+			t.Fatalf("непрочитанных у автора %d", chats[0].UnreadCount)
+		}
+
+		if chats, err := c.getCharts(ctx, bob+100); err != nil || len(chats) != 0 {
+			t.Fatalf("чаты несуществующего пользователя: %v, %v", chats, err)
+		}
+	})
+}
+
+func TestConnectorSendMessage(t *testing.T) {
+	runConnectorTest(t, func(t *testing.T, c Connector) {
+		ctx := context.Background()
+		alice := createUsers(t, c, "alice")[0]
+		chat, err := c.createChart(ctx, "general", alice, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := c.createChart(ctx, "other", alice, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		message, err := c.sendMessage(ctx, chat.ID, alice, "hello", 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Chat != chat.ID || message.Text != "hello" || message.CreatedAt == "" {
+			t.Fatalf("отправленное сообщение %+v", message)
+		}
+
+		_, err = c.sendMessage(ctx, chat.ID+100, alice, "hello", 0, nil)
+		expectErr(t, "сообщение в несуществующий чат", err, ErrNotExist)
+		_, err = c.sendMessage(ctx, chat.ID, alice+100, "hello", 0, nil)
+		expectErr(t, "сообщение несуществующего автора", err, ErrNotExist)
+		_, err = c.sendMessage(ctx, other.ID, alice, "hello", message.ID, nil)
+		expectErr(t, "ответ на сообщение другого чата", err, ErrNotExist)
+
+		got, err := c.getMessage(ctx, message.ID)
+		if err != nil || got.ID != message.ID || got.Text != "hello" {
+			t.Fatalf("сообщение %d: %+v, %v", message.ID, got, err)
+		}
+		_, err = c.getMessage(ctx, message.ID+100)
+		expectErr(t, "несуществующее сообщение", err, ErrNotExist)
+	})
+}
+
+func TestConnectorMessagesOrder(t *testing.T) {
+	runConnectorTest(t, func(t *testing.T, c Connector) {
+		ctx := context.Background()
+		alice := createUsers(t, c, "alice")[0]
+		chat, err := c.createChart(ctx, "general", alice, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := sendMessages(t, c, chat.ID, alice, "one", "two", "three", "four", "five")
+
+		page := func(direction PageDirection, after *Message) ([]uint64, bool) {
+			t.Helper()
+
+			request := MessagePage{Limit: 2, Direction: direction}
+			if after != nil {
+				request.Cursor = &MessageCursor{CreatedAt: after.CreatedAt, ID: after.ID}
+			}
+			messages, hasMore, err := c.getMessages(ctx, chat.ID, request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return messageIDs(messages), hasMore
+		}
+		message := func(id uint64) *Message {
+			t.Helper()
+
+			message, err := c.getMessage(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return &message
+		}
+
+		// Страница в любом направлении упорядочена от раннего сообщения к позднему
+		got, hasMore := page(PageForward, nil)
+		expectIDs(t, "первая страница", got, ids[:2])
+		got, _ = page(PageForward, message(ids[1]))
+		expectIDs(t, "вторая страница", got, ids[2:4])
+		got, hasMore = page(PageForward, message(ids[3]))
+		expectIDs(t, "последняя страница", got, ids[4:])
+		if hasMore {
+			t.Fatalf("после последней страницы есть следующая")
+		}
+
+		got, hasMore = page(PageBackward, nil)
+		expectIDs(t, "последние сообщения", got, ids[3:])
+		if !hasMore {
+			t.Fatalf("перед последними сообщениями нет страницы")
+		}
+		got, _ = page(PageBackward, message(ids[3]))
+		expectIDs(t, "предыдущая страница", got, ids[1:3])
+	})
+}
+
+func TestConnectorThreads(t *testing.T) {
+	runConnectorTest(t, func(t *testing.T, c Connector) {
+		ctx := context.Background()
+		alice := createUsers(t, c, "alice")[0]
+		chat, err := c.createChart(ctx, "general", alice, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root := sendMessages(t, c, chat.ID, alice, "question")[0]
+
+		reply, err := c.sendMessage(ctx, chat.ID, alice, "answer", root, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Ответ на ответ попадает в ветку исходного сообщения
+		nested, err := c.sendMessage(ctx, chat.ID, alice, "details", reply.ID, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.ThreadRoot != root || nested.ThreadRoot != root || nested.ReplyTo != reply.ID {
+			t.Fatalf("ответы %+v %+v", reply, nested)
+		}
+
+		rootMessage, err := c.getMessage(ctx, root)
+		if err != nil || rootMessage.ReplyCount != 2 {
+			t.Fatalf("первое сообщение ветки %+v, %v", rootMessage, err)
+		}
+
+		thread, _, err := c.getThread(ctx, root, MessagePage{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectIDs(t, "ветка", messageIDs(thread), []uint64{reply.ID, nested.ID})
+	})
+}
+
+func TestConnectorEditMessage(t *testing.T) {
+	runConnectorTest(t, func(t *testing.T, c Connector) {
+		ctx := context.Background()
+		alice := createUsers(t, c, "alice")[0]
+		chat, err := c.createChart(ctx, "general", alice, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := sendMessages(t, c, chat.ID, alice, "first")[0]
+
+		edited, err := c.editMessage(ctx, id, "second")
+		if err != nil || edited.Text != "second" || edited.EditedAt == "" {
+			t.Fatalf("измененное сообщение %+v, %v", edited, err)
+		}
+		deleted, err := c.deleteMessage(ctx, id)
+		if err != nil || deleted.Text != "" || deleted.DeletedAt == "" {
+			t.Fatalf("удаленное сообщение %+v, %v", deleted, err)
+		}
+
+		_, err = c.editMessage(ctx, id, "third")
+		expectErr(t, "изменение удаленного сообщения", err, ErrNotExist)
+		_, err = c.deleteMessage(ctx, id)
+		expectErr(t, "повторное удаление", err, ErrNotExist)
+		_, err = c.editMessage(ctx, id+100, "third")
+		expectErr(t, "изменение несуществующего сообщения", err, ErrNotExist)
+
+		revisions, err := c.getRevisions(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(revisions) != 2 || revisions[0].Text != "first" || revisions[1].Text != "second" {
+			t.Fatalf("история изменений %+v", revisions)
+		}
+	})
+}
+
+func TestConnectorMembers(t *testing.T) {
+	runConnectorTest(t, func(t *testing.T, c Connector) {
+		ctx := context.Background()
+		ids := createUsers(t, c, "alice", "bob", "carol")
+		alice, bob, carol := ids[0], ids[1], ids[2]
+		chat, err := c.createChart(ctx, "general", alice, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		messages, err := c.addMembers(ctx, chat.ID, alice, []uint64{bob, carol})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 2 || messages[0].Kind != MessageMemberAdded || messages[0].Target != bob {
+			t.Fatalf("системные сообщения %+v", messages)
+		}
+		if role, err := c.getRole(ctx, chat.ID, carol); err != nil || role != RoleMember {
+			t.Fatalf("роль добавленного участника %q, %v", role, err)
+		}
+
+		_, err = c.addMembers(ctx, chat.ID, alice, []uint64{bob})
+		expectErr(t, "повторное добавление", err, ErrAlreadyExist)
+		_, err = c.addMembers(ctx, chat.ID, alice, []uint64{carol + 100})
+		expectErr(t, "добавление несуществующего пользователя", err, ErrNotExist)
+
+		message, err := c.removeMember(ctx, chat.ID, alice, bob)
+		if err != nil || message.Kind != MessageMemberRemoved || message.Target != bob {
+			t.Fatalf("исключение участника %+v, %v", message, err)
+		}
+		message, err = c.removeMember(ctx, chat.ID, carol, carol)
+		if err != nil || message.Kind != MessageMemberLeft {
+			t.Fatalf("выход из чата %+v, %v", message, err)
+		}
+		_, err = c.removeMember(ctx, chat.ID, alice, bob)
+		expectErr(t, "исключение не участника", err, ErrNotExist)
+
+		for _, userID := range []uint64{bob, carol} {
+			if isMember, err := c.isMember(ctx, chat.ID, userID); err != nil || isMember {
+				t.Fatalf("пользователь %d остался в чате: %v", userID, err)
+			}
+		}
+
+		history, _, err := c.getMessages(ctx, chat.ID, MessagePage{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 4 {
+			t.Fatalf("системных сообщений в истории %d, ожидалось 4", len(history))
+		}
+	})
+}
+
+func TestConnectorReadCursors(t *testing.T) {
+	runConnectorTest(t, func(t *testing.T, c Connector) {
+		ctx := context.Background()
+		ids := createUsers(t, c, "alice", "bob")
+		alice, bob := ids[0], ids[1]
+		chat, err := c.createChart(ctx, "general", alice, []uint64{bob})
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages := sendMessages(t, c, chat.ID, alice, "one", "two")
+
+		if cursor, err := c.markRead(ctx, chat.ID, bob, messages[1]); err != nil || cursor != messages[1] {
+			t.Fatalf("курсор прочтения %d, %v", cursor, err)
+		}
+		// Курсор не сдвигается назад
+		if cursor, err := c.markRead(ctx, chat.ID, bob, messages[0]); err != nil || cursor != messages[1] {
+			t.Fatalf("курсор после сдвига назад %d, %v", cursor, err)
+		}
+		_, err = c.markRead(ctx, chat.ID, bob+100, messages[0])
+		expectErr(t, "прочтение не участником", err, ErrNotExist)
+
+		cursors, err := c.getReadCursors(ctx, chat.ID)
+		if err != nil || cursors[bob] != messages[1] {
+			t.Fatalf("курсоры чата %v, %v", cursors, err)
+		}
+	})
+}
+
+func TestConnectorReactions(t *testing.T) {
+	runConnectorTest(t, func(t *testing.T, c Connector) {
+		ctx := context.Background()
+		ids := createUsers(t, c, "alice", "bob")
+		alice, bob := ids[0], ids[1]
+		chat, err := c.createChart(ctx, "general", alice, []uint64{bob})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := sendMessages(t, c, chat.ID, alice, "hello")[0]
+
+		for _, reaction := range []struct {
+			user  uint64
+			value string
+		}{{alice, "👍"}, {bob, "👍"}, {bob, ":tada:"}} {
+			if err := c.addReaction(ctx, id, reaction.user, reaction.value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expectErr(t, "повторная реакция", c.addReaction(ctx, id, alice, "👍"), ErrAlreadyExist)
+		expectErr(t, "снятие отсутствующей реакции", c.removeReaction(ctx, id, alice, ":tada:"), ErrNotExist)
+		expectErr(t, "реакция на несуществующее сообщение", c.addReaction(ctx, id+100, alice, "👍"), ErrNotExist)
+
+		reactions, err := c.getReactions(ctx, []uint64{id}, alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []Reaction{{Reaction: "👍", Count: 2, Me: true}, {Reaction: ":tada:", Count: 1, Me: false}}
+		if got := reactions[id]; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+			t.Fatalf("реакции %+v, ожидались %+v", got, want)
+		}
+
+		if err := c.removeReaction(ctx, id, bob, ":tada:"); err != nil {
+			t.Fatal(err)
+		}
+		reactions, err = c.getReactions(ctx, []uint64{id}, alice)
+		if err != nil || len(reactions[id]) != 1 {
+			t.Fatalf("реакции после снятия %+v, %v", reactions, err)
+		}
+	})
+}
+
+func TestConnectorSearch(t *testing.T) {
+	runConnectorTest(t, func(t *testing.T, c Connector) {
+		ctx := context.Background()
+		ids := createUsers(t, c, "alice", "bob")
+		alice, bob := ids[0], ids[1]
+		shared, err := c.createChart(ctx, "shared", alice, []uint64{bob})
+		if err != nil {
+			t.Fatal(err)
+		}
+		private, err := c.createChart(ctx, "private", alice, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := sendMessages(t, c, shared.ID, alice, "Deploy the release tonight", "release notes are ready")
+		sendMessages(t, c, shared.ID, alice, "nothing interesting")
+		sendMessages(t, c, private.ID, alice, "private release plan")
+
+		// Ищутся только чаты пользователя, слово совпадает по началу
+		messages, _, err := c.searchMessages(ctx, bob, SearchQuery{Terms: []string{"releas"}}, MessagePage{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectIDs(t, "найденные сообщения", messageIDs(messages), found)
+
+		messages, _, err = c.searchMessages(ctx, alice, SearchQuery{Terms: []string{"release", "notes"}, Chat: shared.ID}, MessagePage{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectIDs(t, "сообщения со всеми словами", messageIDs(messages), found[1:])
+
+		// Регистр не важен и для кириллицы, после правки ищется новый текст
+		edited := sendMessages(t, c, shared.ID, bob, "Сборка упала")
+		messages, _, err = c.searchMessages(ctx, alice, SearchQuery{Terms: []string{"сборк"}}, MessagePage{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectIDs(t, "сообщения на кириллице", messageIDs(messages), edited)
+
+		if _, err := c.editMessage(ctx, edited[0], "Сборка прошла"); err != nil {
+			t.Fatal(err)
+		}
+		for _, term := range []string{"упала", "прошла"} {
+			messages, _, err = c.searchMessages(ctx, alice, SearchQuery{Terms: []string{term}}, MessagePage{Limit: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := edited
+			if term == "упала" {
+				want = nil
+			}
+			expectIDs(t, "сообщения по слову "+term, messageIDs(messages), want)
+		}
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+	"github.com/rs/zerolog/log"
+)
+
+// EventBus - Шина событий. Подписчики получают события, опубликованные любой копией сервиса,
+// подключенной к той же шине
+type EventBus interface {
+	// Публикация события. Подписчики этой копии сервиса получают событие до возврата,
+	// даже если отправить его остальным копиям не удалось
+	Publish(ctx context.Context, event Event) error
+	// Подписка обработчика. Обработчики вызываются последовательно в порядке публикации событий
+	Subscribe(handler func(Event))
+	// Прекращение получения событий от остальных копий сервиса
+	Close() error
+}
+
+// Создание шины событий по типу. По умолчанию redis, если задан адрес Redis, иначе local
+func NewEventBus(busType string) (EventBus, error) {
+	if busType == "" {
+		busType = "local"
+		if config, err := initConfigRedis(); err == nil && config.Addr != "" {
+			busType = "redis"
+		}
+	}
+
+	switch strings.ToLower(busType) {
+	case "local":
+		return NewLocalEventBus(), nil
+	case "redis":
+		client, err := newRedisClient()
+		if err != nil {
+			return nil, err
+		}
+
+		return NewRedisEventBus(client)
+	default:
+		return nil, fmt.Errorf("неизвестная шина событий %s", busType)
+	}
+}
+
+// Обработчики событий, общие для реализаций шины
+type eventHandlers struct {
+	mu       sync.Mutex
+	handlers []func(Event)
+}
+
+func (eh *eventHandlers) Subscribe(handler func(Event)) {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+
+	eh.handlers = append(eh.handlers, handler)
+}
+
+// Вызов обработчиков. Блокировка сохраняет порядок событий, опубликованных из разных горутин
+func (eh *eventHandlers) dispatch(event Event) {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+
+	for _, handler := range eh.handlers {
+		handler(event)
+	}
+}
+
+// Шина в пределах процесса: события получают только подписчики этой копии сервиса
+type LocalEventBus struct {
+	eventHandlers
+}
+
+func NewLocalEventBus() *LocalEventBus {
+	return &LocalEventBus{}
+}
+
+func (lb *LocalEventBus) Publish(ctx context.Context, event Event) error {
+	lb.dispatch(event)
+
+	return nil
+}
+
+func (lb *LocalEventBus) Close() error {
+	return nil
+}
+
+// Канал Redis, через который копии сервиса обмениваются событиями
+const eventChannel = "events"
+
+// Событие в канале Redis вместе с копией сервиса, которая его опубликовала
+type busMessage struct {
+	Source string `json:"source"`
+	Event  Event  `json:"event"`
+}
+
+// Шина через pub/sub Redis. Собственные события доставляются подписчикам напрямую,
+// а из канала принимаются только события остальных копий, поэтому недоступность Redis
+// не мешает доставке в пределах копии. События, опубликованные, пока подписка
+// переподключается к Redis, до этой копии не доходят
+type RedisEventBus struct {
+	eventHandlers
+	client *redis.Client
+	pubsub *redis.PubSub
+	source string        // случайный идентификатор этой копии сервиса
+	done   chan struct{} // закрывается после остановки приема событий
+}
+
+// Шина поверх переданного клиента. Подписка на канал подтверждается до возврата,
+// чтобы не пропустить события, опубликованные сразу после запуска
+func NewRedisEventBus(client *redis.Client) (*RedisEventBus, error) {
+	source := make([]byte, 16)
+	if _, err := rand.Read(source); err != nil {
+		return nil, err
+	}
+
+	pubsub := client.Subscribe(eventChannel)
+	if _, err := pubsub.ReceiveTimeout(redisPingTimeout); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	rb := &RedisEventBus{
+		client: client,
+		pubsub: pubsub,
+		source: hex.EncodeToString(source),
+		done:   make(chan struct{}),
+	}
+	go rb.receive()
+
+	return rb, nil
+}
+
+func (rb *RedisEventBus) Publish(ctx context.Context, event Event) error {
+	rb.dispatch(event)
+
+	data, err := json.Marshal(busMessage{Source: rb.source, Event: event})
+	if err != nil {
+		return err
+	}
+
+	return rb.client.WithContext(ctx).Publish(eventChannel, data).Err()
+}
+
+// Прием событий остальных копий сервиса до закрытия подписки
+func (rb *RedisEventBus) receive() {
+	defer close(rb.done)
+
+	for msg := range rb.pubsub.Channel() {
+		message := busMessage{}
+		if err := json.Unmarshal([]byte(msg.Payload), &message); err != nil {
+			log.Warn().Err(err).Msg("Не удалось разобрать событие из Redis")
+			continue
+		}
+		if message.Source == rb.source {
+			continue
+		}
+		// Хаб обращается к данным события без проверок, поэтому событие неизвестного типа
+		// или без данных, например от копии сервиса другой версии, пропускается
+		if !message.Event.valid() {
+			log.Warn().Str("event", message.Event.Type).Msg("Пропущено событие из Redis без данных")
+			continue
+		}
+
+		rb.dispatch(message.Event)
+	}
+}
+
+func (rb *RedisEventBus) Close() error {
+	err := rb.pubsub.Close()
+	<-rb.done
+	if closeErr := rb.client.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Публикация события об уже сохраненном изменении. Ошибка шины не прерывает запрос:
+// подписчики этой копии сервиса получают событие в любом случае
+func (s *Service) publish(ctx context.Context, event Event) {
+	if err := s.events.Publish(ctx, event); err != nil {
+		log.Warn().Err(err).Str("event", event.Type).Msg("Не удалось отправить событие остальным копиям сервиса")
+	}
+}
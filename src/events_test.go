@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+// Время ожидания события в тестах
+const eventTimeout = 2 * time.Second
+
+// Шина копии сервиса над общим Redis и канал с событиями, полученными ее подписчиком
+func newTestRedisBus(t *testing.T, mr *miniredis.Miniredis) (*RedisEventBus, chan Event) {
+	t.Helper()
+
+	bus, err := NewRedisEventBus(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan Event, 10)
+	bus.Subscribe(func(event Event) {
+		received <- event
+	})
+
+	return bus, received
+}
+
+func publishMessageEvent(t *testing.T, bus EventBus, messageID uint64) {
+	t.Helper()
+
+	if err := bus.Publish(context.Background(), Event{Type: EventMessageCreated, Message: &Message{ID: messageID}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectEvent(t *testing.T, received chan Event, messageID uint64) {
+	t.Helper()
+
+	select {
+	case event := <-received:
+		if event.Type != EventMessageCreated || event.Message == nil || event.Message.ID != messageID {
+			t.Fatalf("получено событие %+v, ожидалось сообщение %d", event, messageID)
+		}
+	case <-time.After(eventTimeout):
+		t.Fatalf("событие о сообщении %d не получено", messageID)
+	}
+}
+
+func expectNoEvent(t *testing.T, received chan Event) {
+	t.Helper()
+
+	select {
+	case event := <-received:
+		t.Fatalf("получено лишнее событие %+v", event)
+	default:
+	}
+}
+
+func TestRedisEventBus(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, receivedA := newTestRedisBus(t, mr)
+	defer a.Close()
+	b, receivedB := newTestRedisBus(t, mr)
+	defer b.Close()
+
+	// Подписчики копии получают ее событие сразу, остальные копии - через Redis
+	publishMessageEvent(t, a, 1)
+	expectEvent(t, receivedA, 1)
+	expectEvent(t, receivedB, 1)
+
+	// Redis доставляет события копии по порядку, поэтому собственное событие копии a,
+	// если бы оно не отбрасывалось, пришло бы раньше события копии b
+	publishMessageEvent(t, b, 2)
+	expectEvent(t, receivedB, 2)
+	expectEvent(t, receivedA, 2)
+	expectNoEvent(t, receivedA)
+	expectNoEvent(t, receivedB)
+}
+
+func TestRedisEventBusClose(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, receivedA := newTestRedisBus(t, mr)
+	b, _ := newTestRedisBus(t, mr)
+	defer b.Close()
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- a.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(eventTimeout):
+		t.Fatal("закрытие шины не дождалось остановки приема событий")
+	}
+	select {
+	case <-a.done:
+	default:
+		t.Fatal("прием событий не остановлен")
+	}
+
+	// События остальных копий принимает только остановленный цикл, поэтому закрытая шина их не получает
+	publishMessageEvent(t, b, 1)
+	expectNoEvent(t, receivedA)
+}
+
+func TestRedisEventBusInvalidEvents(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, receivedA := newTestRedisBus(t, mr)
+	defer a.Close()
+	a.Subscribe(NewHub().Publish)
+	b, _ := newTestRedisBus(t, mr)
+	defer b.Close()
+
+	// Хаб обратился бы к отсутствующим данным этих событий и уронил бы прием событий
+	for _, payload := range []string{
+		`not json`,
+		`{"source": "other", "event": {"type": "message_created"}}`,
+		`{"source": "other", "event": {"type": "members_added", "message": {"id": 1}}}`,
+		`{"source": "other", "event": {"type": "unknown"}}`,
+	} {
+		mr.Publish(eventChannel, payload)
+	}
+
+	publishMessageEvent(t, b, 1)
+	expectEvent(t, receivedA, 1)
+	expectNoEvent(t, receivedA)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// Типы событий, рассылаемых подписчикам
+const (
+	EventMessageCreated  = "message_created"  // в чат отправлено сообщение
+	EventChatCreated     = "chat_created"     // создан чат с участием пользователя
+	EventMessageEdited   = "message_edited"   // автор изменил текст сообщения
+	EventMessageDeleted  = "message_deleted"  // автор удалил сообщение
+	EventMessagesRead    = "messages_read"    // участник сдвинул курсор прочтения чата
+	EventMembersAdded    = "members_added"    // в чат добавлены участники
+	EventMembersRemoved  = "members_removed"  // участники исключены из чата или покинули его
+	EventReactionAdded   = "reaction_added"   // участник поставил реакцию на сообщение
+	EventReactionRemoved = "reaction_removed" // участник снял реакцию с сообщения
+)
+
+// Event - Событие, отправляемое подписчику отдельным JSON кадром
+type Event struct {
+	Type     string          `json:"type"`               // тип события
+	Chat     *Chat           `json:"chat,omitempty"`     // чат для EventChatCreated
+	Message  *Message        `json:"message,omitempty"`  // сообщение для EventMessageCreated, EventMessageEdited, EventMessageDeleted
+	Read     *ReadReceipt    `json:"read,omitempty"`     // позиция прочтения для EventMessagesRead
+	Members  *Membership     `json:"members,omitempty"`  // изменение состава для EventMembersAdded, EventMembersRemoved
+	Reaction *ReactionChange `json:"reaction,omitempty"` // реакция для EventReactionAdded, EventReactionRemoved
+}
+
+// Событие известного типа с заполненными для него данными
+func (e Event) valid() bool {
+	switch e.Type {
+	case EventMessageCreated, EventMessageEdited, EventMessageDeleted:
+		return e.Message != nil
+	case EventMessagesRead:
+		return e.Read != nil
+	case EventReactionAdded, EventReactionRemoved:
+		return e.Reaction != nil
+	case EventMembersAdded, EventMembersRemoved:
+		return e.Members != nil
+	case EventChatCreated:
+		return e.Chat != nil
+	default:
+		return false
+	}
+}
+
+// Hub - Рассылка событий подключенным по WebSocket пользователям этой копии сервиса.
+// События всех копий поступают в хаб через шину событий.
+// Каждое подключение подписано на чаты своего пользователя.
+type Hub struct {
+	mu      sync.Mutex
+	clients map[*wsClient]struct{}            // все подключения
+	users   map[uint64]map[*wsClient]struct{} // подключения по id пользователя
+	chats   map[uint64]map[*wsClient]struct{} // подписки по id чата
+	closed  bool
+
+	wg sync.WaitGroup // работающие горутины подключений
+}
+
+// Создание пустого хаба
+func NewHub() *Hub {
+	return &Hub{
+		clients: make(map[*wsClient]struct{}),
+		users:   make(map[uint64]map[*wsClient]struct{}),
+		chats:   make(map[uint64]map[*wsClient]struct{}),
+	}
+}
+
+// Регистрация подключения с подпиской на чаты, возвращает false если хаб закрыт.
+// После успешной регистрации должны быть запущены writePump и readPump
+func (h *Hub) register(c *wsClient, chats []uint64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return false
+	}
+
+	h.wg.Add(2)
+	h.clients[c] = struct{}{}
+	addClient(h.users, c.userID, c)
+	for _, chatID := range chats {
+		c.chats[chatID] = struct{}{}
+		addClient(h.chats, chatID, c)
+	}
+
+	return true
+}
+
+// Отключение клиента от рассылки
+func (h *Hub) unregister(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(c)
+}
+
+// Рассылка события подписчикам
+func (h *Hub) Publish(event Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Warn().Err(err).Msg("Не удалось замаршалить событие")
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch event.Type {
+	case EventMessageCreated, EventMessageEdited, EventMessageDeleted:
+		for c := range h.chats[event.Message.Chat] {
+			h.deliver(c, data)
+		}
+	case EventMessagesRead:
+		for c := range h.chats[event.Read.Chat] {
+			h.deliver(c, data)
+		}
+	case EventReactionAdded, EventReactionRemoved:
+		for c := range h.chats[event.Reaction.Chat] {
+			h.deliver(c, data)
+		}
+	case EventMembersAdded:
+		// Подключения новых участников подписываются на чат до рассылки
+		for _, userID := range event.Members.Users {
+			for c := range h.users[userID] {
+				c.chats[event.Members.Chat] = struct{}{}
+				addClient(h.chats, event.Members.Chat, c)
+			}
+		}
+		for c := range h.chats[event.Members.Chat] {
+			h.deliver(c, data)
+		}
+	case EventMembersRemoved:
+		// Исключенные участники получают событие и отписываются от чата
+		for c := range h.chats[event.Members.Chat] {
+			h.deliver(c, data)
+		}
+		for _, userID := range event.Members.Users {
+			for c := range h.users[userID] {
+				delete(c.chats, event.Members.Chat)
+				deleteClient(h.chats, event.Members.Chat, c)
+			}
+		}
+	case EventChatCreated:
+		// Подключения участников подписываются на новый чат
+		for _, userID := range event.Chat.Users {
+			for c := range h.users[userID] {
+				c.chats[event.Chat.ID] = struct{}{}
+				addClient(h.chats, event.Chat.ID, c)
+				h.deliver(c, data)
+			}
+		}
+	}
+}
+
+// Закрытие всех подключений. Накопленные в буферах события отправляются,
+// после чего клиенты получают кадр закрытия
+func (h *Hub) Close(ctx context.Context) error {
+	h.mu.Lock()
+	h.closed = true
+	for c := range h.clients {
+		h.remove(c)
+	}
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Постановка кадра в буфер подключения. Не успевающие читать клиенты отключаются.
+// Вызывается под блокировкой
+func (h *Hub) deliver(c *wsClient, data []byte) {
+	select {
+	case c.send <- data:
+	default:
+		log.Warn().Uint64("user", c.userID).Msg("Буфер подключения переполнен, клиент отключен")
+		h.remove(c)
+	}
+}
+
+// Удаление подключения из всех индексов. Вызывается под блокировкой
+func (h *Hub) remove(c *wsClient) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+
+	delete(h.clients, c)
+	deleteClient(h.users, c.userID, c)
+	for chatID := range c.chats {
+		deleteClient(h.chats, chatID, c)
+	}
+	close(c.send)
+}
+
+func addClient(index map[uint64]map[*wsClient]struct{}, key uint64, c *wsClient) {
+	if index[key] == nil {
+		index[key] = make(map[*wsClient]struct{})
+	}
+	index[key][c] = struct{}{}
+}
+
+func deleteClient(index map[uint64]map[*wsClient]struct{}, key uint64, c *wsClient) {
+	delete(index[key], c)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+// Время ожидания записи кадра
+const wsWriteWait = 10 * time.Second
+
+// Подключение пользователя по WebSocket
+type wsClient struct {
+	hub    *Hub
+	conn   *websocket.Conn
+	userID uint64
+	send   chan []byte         // буфер исходящих кадров, закрывается хабом
+	chats  map[uint64]struct{} // чаты подписки, изменяются под блокировкой хаба
+}
+
+// Запись кадров из буфера и отправка ping с интервалом pingInterval
+func (c *wsClient) writePump(pingInterval time.Duration) {
+	defer c.hub.wg.Done()
+
+	ticker := time.NewTicker(pingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Чтение входящих кадров. Клиент ничего не отправляет, кроме pong и кадров управления,
+// отсутствие pong дольше pongWait считается обрывом соединения
+func (c *wsClient) readPump(pongWait time.Duration) {
+	defer func() {
+		c.hub.unregister(c)
+		c.conn.Close()
+		c.hub.wg.Done()
+	}()
+
+	c.conn.SetReadLimit(512)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
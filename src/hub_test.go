@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Подключение пользователя к /ws. Возвращается после регистрации подключения в хабе,
+// чтобы события, опубликованные сразу после подключения, не терялись
+func dialWS(t *testing.T, s *Service, server *httptest.Server, userID uint64, token string) *websocket.Conn {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?access_token=" + token
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	waitHub(t, s.hub, func(h *Hub) bool { return len(h.users[userID]) > 0 })
+
+	return conn
+}
+
+// Ожидание состояния хаба, которое проверяет ready под блокировкой хаба
+func waitHub(t *testing.T, h *Hub, ready func(h *Hub) bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(eventTimeout)
+	for {
+		h.mu.Lock()
+		ok := ready(h)
+		h.mu.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("хаб не пришел в ожидаемое состояние")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Следующий кадр подключения
+func readEvent(t *testing.T, conn *websocket.Conn) Event {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(eventTimeout))
+	event := Event{}
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+
+	return event
+}
+
+func expectChatCreated(t *testing.T, conn *websocket.Conn, chatID uint64) {
+	t.Helper()
+
+	if event := readEvent(t, conn); event.Type != EventChatCreated || event.Chat == nil || event.Chat.ID != chatID {
+		t.Fatalf("получено событие %+v, ожидалось создание чата %d", event, chatID)
+	}
+}
+
+func expectMessageCreated(t *testing.T, conn *websocket.Conn, messageID uint64, kind string) {
+	t.Helper()
+
+	event := readEvent(t, conn)
+	if event.Type != EventMessageCreated || event.Message == nil || event.Message.ID != messageID || event.Message.Kind != kind {
+		t.Fatalf("получено событие %+v, ожидалось сообщение %d %q", event, messageID, kind)
+	}
+}
+
+func expectMembership(t *testing.T, conn *websocket.Conn, eventType string, chatID uint64, userID uint64) {
+	t.Helper()
+
+	event := readEvent(t, conn)
+	if event.Type != eventType || event.Members == nil || event.Members.Chat != chatID ||
+		len(event.Members.Users) != 1 || event.Members.Users[0] != userID {
+		t.Fatalf("получено событие %+v, ожидалось %s пользователя %d в чате %d", event, eventType, userID, chatID)
+	}
+}
+
+func TestWebSocketDelivery(t *testing.T) {
+	s := newTestService(t)
+	server := httptest.NewServer(s.server.Handler)
+	defer server.Close()
+	alice, aliceToken := addUser(t, s, "alice")
+	bob, bobToken := addUser(t, s, "bob")
+	carol, carolToken := addUser(t, s, "carol")
+	aliceConn := dialWS(t, s, server, alice, aliceToken)
+	carolConn := dialWS(t, s, server, carol, carolToken)
+
+	chatID := addChat(t, s, aliceToken, "chat", bob)
+	expectChatCreated(t, aliceConn, chatID)
+	messageID := addMessage(t, s, bobToken, chatID, "hello")
+	expectMessageCreated(t, aliceConn, messageID, "")
+
+	// События чужого чата до carol не доходят: первое ее событие - создание чата с ней
+	otherID := addChat(t, s, aliceToken, "other", carol)
+	expectChatCreated(t, carolConn, otherID)
+	expectChatCreated(t, aliceConn, otherID)
+	messageID = addMessage(t, s, aliceToken, otherID, "hi carol")
+	expectMessageCreated(t, carolConn, messageID, "")
+
+	// Закрытое клиентом подключение отписывается от всех чатов
+	carolConn.Close()
+	waitHub(t, s.hub, func(h *Hub) bool { return len(h.users[carol]) == 0 && len(h.chats[otherID]) == 1 })
+}
+
+func TestWebSocketMembership(t *testing.T) {
+	s := newTestService(t)
+	server := httptest.NewServer(s.server.Handler)
+	defer server.Close()
+	_, aliceToken := addUser(t, s, "alice")
+	carol, carolToken := addUser(t, s, "carol")
+	chatID := addChat(t, s, aliceToken, "chat")
+	carolConn := dialWS(t, s, server, carol, carolToken)
+
+	// Подключение добавленного участника подписывается на чат
+	response := struct {
+		Messages []Message `json:"messages"`
+	}{}
+	if status := doRequest(t, s, "/chats/members/add", aliceToken, map[string]interface{}{"chat": chatID, "users": []uint64{carol}}, &response); status != http.StatusOK || len(response.Messages) != 1 {
+		t.Fatalf("добавление участника: %d %+v", status, response)
+	}
+	expectMembership(t, carolConn, EventMembersAdded, chatID, carol)
+	expectMessageCreated(t, carolConn, response.Messages[0].ID, MessageMemberAdded)
+	messageID := addMessage(t, s, aliceToken, chatID, "welcome")
+	expectMessageCreated(t, carolConn, messageID, "")
+
+	// Исключенный участник получает системное сообщение и событие исключения, после чего отписывается
+	removed := struct {
+		Message Message `json:"message"`
+	}{}
+	if status := doRequest(t, s, "/chats/members/remove", aliceToken, map[string]interface{}{"chat": chatID, "user": carol}, &removed); status != http.StatusOK {
+		t.Fatalf("исключение участника: %d", status)
+	}
+	expectMessageCreated(t, carolConn, removed.Message.ID, MessageMemberRemoved)
+	expectMembership(t, carolConn, EventMembersRemoved, chatID, carol)
+
+	addMessage(t, s, aliceToken, chatID, "without carol")
+	otherID := addChat(t, s, aliceToken, "other", carol)
+	expectChatCreated(t, carolConn, otherID)
+}
+
+func TestHubCloseDrains(t *testing.T) {
+	s := newTestService(t)
+	server := httptest.NewServer(s.server.Handler)
+	defer server.Close()
+	alice, aliceToken := addUser(t, s, "alice")
+	chatID := addChat(t, s, aliceToken, "chat")
+	conn := dialWS(t, s, server, alice, aliceToken)
+
+	// События, накопленные в буфере к моменту закрытия, отправляются до кадра закрытия
+	for id := uint64(1); id <= 3; id++ {
+		s.hub.Publish(Event{Type: EventMessageCreated, Message: &Message{ID: id, Chat: chatID}})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+	defer cancel()
+	if err := s.hub.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for id := uint64(1); id <= 3; id++ {
+		expectMessageCreated(t, conn, id, "")
+	}
+	conn.SetReadDeadline(time.Now().Add(eventTimeout))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("после событий получено %v, ожидался кадр закрытия", err)
+	}
+
+	// Закрытый хаб не принимает новые подключения
+	if s.hub.register(&wsClient{hub: s.hub, userID: alice, send: make(chan []byte, 1), chats: make(map[uint64]struct{})}, nil) {
+		t.Fatal("закрытый хаб зарегистрировал подключение")
+	}
+}
+
+func TestHubSlowClient(t *testing.T) {
+	h := NewHub()
+	slow := &wsClient{hub: h, userID: 1, send: make(chan []byte, 1), chats: make(map[uint64]struct{})}
+	other := &wsClient{hub: h, userID: 2, send: make(chan []byte, 2), chats: make(map[uint64]struct{})}
+	h.register(slow, []uint64{1})
+	h.register(other, []uint64{1})
+
+	// Клиент, буфер которого переполнен, отключается, остальные получают события
+	h.Publish(Event{Type: EventMessageCreated, Message: &Message{ID: 1, Chat: 1}})
+	h.Publish(Event{Type: EventMessageCreated, Message: &Message{ID: 2, Chat: 1}})
+
+	if _, ok := <-slow.send; !ok {
+		t.Fatal("первое событие не поставлено в буфер")
+	}
+	if _, ok := <-slow.send; ok {
+		t.Fatal("буфер медленного клиента не закрыт")
+	}
+	if len(other.send) != 2 {
+		t.Fatalf("в буфере другого клиента %d событий, ожидалось 2", len(other.send))
+	}
+	if _, ok := h.clients[slow]; ok {
+		t.Fatal("медленный клиент остался в хабе")
+	}
+	if len(h.chats[1]) != 1 {
+		t.Fatalf("подписчиков чата %d, ожидался 1", len(h.chats[1]))
+	}
+}
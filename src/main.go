@@ -3,8 +3,11 @@ package main
 import (
 	"github.com/rs/zerolog/log"
 
+	"context"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -13,12 +16,48 @@ func main() {
 		log.Fatal().Err(err).Msg("не удалось прочитать настройки")
 	}
 
+	// Управление схемой БД: service migrate up|down|status
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(config, os.Args[2:]); err != nil {
+			log.Fatal().Err(err).Msg("не удалось выполнить миграцию")
+		}
+		return
+	}
+
+	// Трассировка настраивается до подключения к хранилищу, чтобы запросы к БД попадали в трассы
+	shutdownTracing, err := initTracing(config)
+	if err != nil {
+		log.Fatal().Err(err).Msg("не удалось настроить трассировку")
+	}
+
 	controller, err := NewConnector(config.ConnectorType)
 	if err != nil {
 		log.Fatal().Err(err).Msg("не создать коннектор")
 	}
 
-	service := NewService(config, controller)
+	// Сервис не запускается, пока хранилище не ответит
+	if err := waitStorage(controller, config.StorageTimeout, config.StorageWaitTimeout); err != nil {
+		log.Fatal().Err(err).Msg("не удалось подключиться к хранилищу")
+	}
+
+	// Встроенная БД не требует отдельной установки, поэтому её схема обновляется всегда
+	if config.MigrateOnStart || strings.ToLower(config.ConnectorType) == "sqlite" {
+		migrator, err := NewMigrator(controller)
+		if err != nil {
+			log.Fatal().Err(err).Msg("не удалось создать мигратор")
+		}
+
+		versions, err := migrator.Up()
+		if err != nil {
+			log.Fatal().Err(err).Msg("не удалось применить миграции")
+		}
+		log.Info().Interface("versions", versions).Msg("Схема БД обновлена")
+	}
+
+	service, err := NewService(config, controller)
+	if err != nil {
+		log.Fatal().Err(err).Msg("не удалось создать сервис")
+	}
 
 	service.Start()
 	c := make(chan os.Signal, 1)
@@ -26,4 +65,10 @@ func main() {
 
 	<-c
 	service.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		log.Warn().Err(err).Msg("Не удалось отправить трассы")
+	}
 }
@@ -0,0 +1,833 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Формат времени создания сущностей, совпадает с DATETIME в MySQL
+const timeLayout = "2006-01-02 15:04:05"
+
+// Коннектор, хранящий данные в памяти процесса.
+// Используется для тестов и локальной разработки, данные теряются при перезапуске.
+type ConnectorMemory struct {
+	mu sync.RWMutex
+
+	users     map[uint64]User              // пользователи по id
+	usernames map[string]uint64            // id пользователей по имени
+	passwords map[uint64]string            // хеши паролей пользователей
+	chats     map[uint64]Chat              // чаты по id
+	chatNames map[string]uint64            // id чатов по имени
+	messages  map[uint64][]Message         // сообщения по id чата в порядке отправки
+	msgChats  map[uint64]uint64            // id чата по id сообщения
+	reads     map[uint64]map[uint64]uint64 // курсоры прочтения по id чата и id участника
+	revisions map[uint64][]MessageRevision // предыдущие версии текста по id сообщения
+	roles     map[uint64]map[uint64]string // роли по id чата и id участника
+	reactions map[uint64][]memoryReaction  // реакции по id сообщения в порядке добавления
+	files     map[uint64][]Attachment      // вложения по id сообщения в порядке загрузки
+	fileIDs   map[uint64]uint64            // id сообщения по id вложения
+	index     map[string]map[uint64]bool   // инвертированный индекс: id сообщений по слову текста
+	words     []string                     // слова индекса по возрастанию для поиска по префиксу
+
+	lastUserID     uint64
+	lastChatID     uint64
+	lastMessageID  uint64
+	lastRevisionID uint64
+	lastFileID     uint64
+}
+
+// Создание пустого хранилища в памяти
+func NewConnectorMemory() *ConnectorMemory {
+	return &ConnectorMemory{
+		users:     make(map[uint64]User),
+		usernames: make(map[string]uint64),
+		passwords: make(map[uint64]string),
+		chats:     make(map[uint64]Chat),
+		chatNames: make(map[string]uint64),
+		messages:  make(map[uint64][]Message),
+		msgChats:  make(map[uint64]uint64),
+		reads:     make(map[uint64]map[uint64]uint64),
+		revisions: make(map[uint64][]MessageRevision),
+		roles:     make(map[uint64]map[uint64]string),
+		reactions: make(map[uint64][]memoryReaction),
+		files:     make(map[uint64][]Attachment),
+		fileIDs:   make(map[uint64]uint64),
+		index:     make(map[string]map[uint64]bool),
+	}
+}
+
+// Реакция участника на сообщение
+type memoryReaction struct {
+	user     uint64
+	reaction string
+}
+
+// Хранилище в памяти доступно всегда
+func (cm *ConnectorMemory) ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (cm *ConnectorMemory) createUser(ctx context.Context, username string, passwordHash string) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if _, ok := cm.usernames[username]; ok {
+		return User{}, fmt.Errorf("пользователь %s %w", username, ErrAlreadyExist)
+	}
+
+	cm.lastUserID++
+	user := User{
+		ID:        cm.lastUserID,
+		Username:  username,
+		CreatedAt: time.Now().Format(timeLayout),
+	}
+	cm.users[user.ID] = user
+	cm.usernames[username] = user.ID
+	cm.passwords[user.ID] = passwordHash
+
+	return user, nil
+}
+
+func (cm *ConnectorMemory) getCredentials(ctx context.Context, username string) (User, string, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, "", err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	userID, ok := cm.usernames[username]
+	if !ok {
+		return User{}, "", fmt.Errorf("пользователь %s %w", username, ErrNotExist)
+	}
+
+	return cm.users[userID], cm.passwords[userID], nil
+}
+
+func (cm *ConnectorMemory) checkUsername(ctx context.Context, username string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	_, ok := cm.usernames[username]
+	return ok, nil
+}
+
+func (cm *ConnectorMemory) checkUserID(ctx context.Context, user uint64) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	_, ok := cm.users[user]
+	return ok, nil
+}
+
+func (cm *ConnectorMemory) createChart(ctx context.Context, name string, ownerID uint64, users []uint64) (Chat, error) {
+	if err := ctx.Err(); err != nil {
+		return Chat{}, err
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if _, ok := cm.chatNames[name]; ok {
+		return Chat{}, fmt.Errorf("чат %s %w", name, ErrAlreadyExist)
+	}
+
+	users = uniqueIDs(append([]uint64{ownerID}, users...))
+	for _, userID := range users {
+		if _, ok := cm.users[userID]; !ok {
+			return Chat{}, fmt.Errorf("пользователь c id %d %w", userID, ErrNotExist)
+		}
+	}
+
+	cm.lastChatID++
+	chat := Chat{
+		ID:        cm.lastChatID,
+		Name:      name,
+		Users:     users,
+		CreatedAt: time.Now().Format(timeLayout),
+	}
+	cm.chats[chat.ID] = chat
+	cm.chatNames[name] = chat.ID
+
+	cm.roles[chat.ID] = make(map[uint64]string)
+	chat.Roles = make(map[uint64]string)
+	for _, userID := range users {
+		cm.roles[chat.ID][userID] = chatRole(ownerID, userID)
+		chat.Roles[userID] = cm.roles[chat.ID][userID]
+	}
+
+	return chat, nil
+}
+
+func (cm *ConnectorMemory) checkChartName(ctx context.Context, name string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	_, ok := cm.chatNames[name]
+	return ok, nil
+}
+
+func (cm *ConnectorMemory) checkChartID(ctx context.Context, chat uint64) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	_, ok := cm.chats[chat]
+	return ok, nil
+}
+
+func (cm *ConnectorMemory) isMember(ctx context.Context, chat uint64, user uint64) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	return cm.member(chat, user), nil
+}
+
+// Проверка участия пользователя в чате, вызывается под блокировкой
+func (cm *ConnectorMemory) member(chat uint64, user uint64) bool {
+	for _, userID := range cm.chats[chat].Users {
+		if userID == user {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Чаты пользователя отсортированы по времени последнего сообщения (от позднего к раннему),
+// чаты без сообщений сортируются по времени создания
+func (cm *ConnectorMemory) getCharts(ctx context.Context, user uint64) ([]Chat, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	type chatOrder struct {
+		chat     Chat
+		lastTime string
+		lastID   uint64
+	}
+
+	var list []chatOrder
+	for _, chat := range cm.chats {
+		if !cm.member(chat.ID, user) {
+			continue
+		}
+
+		item := chatOrder{chat: chat, lastTime: chat.CreatedAt}
+		if messages := cm.messages[chat.ID]; len(messages) > 0 {
+			last := messages[len(messages)-1]
+			item.lastTime, item.lastID = last.CreatedAt, last.ID
+			chat.LastMessage = &last
+		}
+
+		// Сообщения упорядочены по id, непрочитанные идут после курсора
+		lastReadID := cm.reads[chat.ID][user]
+		messages := cm.messages[chat.ID]
+		for i := sort.Search(len(messages), func(i int) bool { return messages[i].ID > lastReadID }); i < len(messages); i++ {
+			if messages[i].Author != strconv.FormatUint(user, 10) && messages[i].DeletedAt == "" {
+				chat.UnreadCount++
+			}
+		}
+
+		chat.Users = append([]uint64(nil), chat.Users...)
+		chat.Roles = make(map[uint64]string, len(chat.Users))
+		for _, userID := range chat.Users {
+			chat.Roles[userID] = cm.roles[chat.ID][userID]
+		}
+		item.chat = chat
+		list = append(list, item)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].lastTime != list[j].lastTime {
+			return list[i].lastTime > list[j].lastTime
+		}
+		if list[i].lastID != list[j].lastID {
+			return list[i].lastID > list[j].lastID
+		}
+		return list[i].chat.ID > list[j].chat.ID
+	})
+
+	result := []Chat{}
+	for _, item := range list {
+		result = append(result, item.chat)
+	}
+
+	return result, nil
+}
+
+func (cm *ConnectorMemory) sendMessage(ctx context.Context, chatID uint64, authorID uint64, text string, replyTo uint64,
+	attachments []Attachment) (Message, error) {
+	if err := ctx.Err(); err != nil {
+		return Message{}, err
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if _, ok := cm.chats[chatID]; !ok {
+		return Message{}, fmt.Errorf("чат c id %d %w", chatID, ErrNotExist)
+	}
+	if _, ok := cm.users[authorID]; !ok {
+		return Message{}, fmt.Errorf("пользователь c id %d %w", authorID, ErrNotExist)
+	}
+
+	// Ответ на ответ остается в ветке исходного сообщения
+	var root *Message
+	if replyTo != 0 {
+		parent := cm.message(replyTo)
+		if parent == nil || parent.Chat != chatID {
+			return Message{}, fmt.Errorf("сообщение c id %d в чате c id %d %w", replyTo, chatID, ErrNotExist)
+		}
+		root = parent
+		if parent.ThreadRoot != 0 {
+			root = cm.message(parent.ThreadRoot)
+		}
+	}
+
+	cm.lastMessageID++
+	message := Message{
+		ID:        cm.lastMessageID,
+		Chat:      chatID,
+		Author:    strconv.FormatUint(authorID, 10),
+		Text:      text,
+		CreatedAt: time.Now().Format(timeLayout),
+		ReplyTo:   replyTo,
+	}
+	if root != nil {
+		message.ThreadRoot = root.ID
+		root.ReplyCount++
+	}
+	for _, attachment := range attachments {
+		cm.lastFileID++
+		attachment.ID, attachment.Message, attachment.CreatedAt = cm.lastFileID, message.ID, message.CreatedAt
+		cm.fileIDs[attachment.ID] = message.ID
+		cm.files[message.ID] = append(cm.files[message.ID], attachment)
+	}
+	cm.messages[chatID] = append(cm.messages[chatID], message)
+	cm.msgChats[message.ID] = chatID
+	cm.indexMessage(message.ID, message.Text)
+	message.Attachments = append([]Attachment(nil), cm.files[message.ID]...)
+
+	return message, nil
+}
+
+func (cm *ConnectorMemory) getMessage(ctx context.Context, messageID uint64) (Message, error) {
+	if err := ctx.Err(); err != nil {
+		return Message{}, err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	message := cm.message(messageID)
+	if message == nil {
+		return Message{}, fmt.Errorf("сообщение c id %d %w", messageID, ErrNotExist)
+	}
+
+	return *message, nil
+}
+
+// Сообщение по id или nil, вызывается под блокировкой
+func (cm *ConnectorMemory) message(messageID uint64) *Message {
+	chatID, ok := cm.msgChats[messageID]
+	if !ok {
+		return nil
+	}
+
+	// Сообщения чата хранятся в порядке возрастания id
+	messages := cm.messages[chatID]
+	i := sort.Search(len(messages), func(i int) bool { return messages[i].ID >= messageID })
+	return &messages[i]
+}
+
+// Страница сообщений чата по ключу (created_at, id). Сообщения хранятся
+// в порядке отправки, который совпадает с порядком ключа
+func (cm *ConnectorMemory) getMessages(ctx context.Context, chatID uint64, page MessagePage) ([]Message, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	result, hasMore := memoryPage(cm.messages[chatID], page)
+	return result, hasMore, nil
+}
+
+// Страница ответов ветки, ответы хранятся в истории чата вместе с остальными сообщениями
+func (cm *ConnectorMemory) getThread(ctx context.Context, rootID uint64, page MessagePage) ([]Message, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	thread := []Message{}
+	for _, message := range cm.messages[cm.msgChats[rootID]] {
+		if message.ThreadRoot == rootID {
+			thread = append(thread, message)
+		}
+	}
+
+	result, hasMore := memoryPage(thread, page)
+	return result, hasMore, nil
+}
+
+// Поиск по инвертированному индексу: для каждого слова запроса объединяются сообщения со словами,
+// начинающимися с него, результаты по словам пересекаются
+func (cm *ConnectorMemory) searchMessages(ctx context.Context, userID uint64, query SearchQuery, page MessagePage) ([]Message, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	var found map[uint64]bool
+	for _, term := range query.Terms {
+		ids := make(map[uint64]bool)
+		for i := sort.SearchStrings(cm.words, term); i < len(cm.words) && strings.HasPrefix(cm.words[i], term); i++ {
+			for id := range cm.index[cm.words[i]] {
+				if found == nil || found[id] {
+					ids[id] = true
+				}
+			}
+		}
+		found = ids
+	}
+
+	result := []Message{}
+	for id := range found {
+		message := cm.message(id)
+		switch {
+		case message == nil || message.DeletedAt != "" || !cm.member(message.Chat, userID):
+		case query.Chat != 0 && message.Chat != query.Chat:
+		case query.Author != 0 && message.Author != strconv.FormatUint(query.Author, 10):
+		case query.From != "" && message.CreatedAt < query.From:
+		case query.Before != "" && message.CreatedAt >= query.Before:
+		default:
+			result = append(result, *message)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt < result[j].CreatedAt || (result[i].CreatedAt == result[j].CreatedAt && result[i].ID < result[j].ID)
+	})
+
+	messages, hasMore := memoryPage(result, page)
+	return messages, hasMore, nil
+}
+
+// Добавление слов текста сообщения в индекс
+func (cm *ConnectorMemory) indexMessage(messageID uint64, text string) {
+	for _, word := range searchTokens(text) {
+		ids, ok := cm.index[word]
+		if !ok {
+			ids = make(map[uint64]bool)
+			cm.index[word] = ids
+
+			i := sort.SearchStrings(cm.words, word)
+			cm.words = append(cm.words, "")
+			copy(cm.words[i+1:], cm.words[i:])
+			cm.words[i] = word
+		}
+		ids[messageID] = true
+	}
+}
+
+// Удаление слов текста сообщения из индекса, слова без сообщений удаляются
+func (cm *ConnectorMemory) unindexMessage(messageID uint64, text string) {
+	for _, word := range searchTokens(text) {
+		ids, ok := cm.index[word]
+		if !ok {
+			continue
+		}
+		delete(ids, messageID)
+		if len(ids) == 0 {
+			delete(cm.index, word)
+			i := sort.SearchStrings(cm.words, word)
+			cm.words = append(cm.words[:i], cm.words[i+1:]...)
+		}
+	}
+}
+
+// Страница из отсортированных по ключу (created_at, id) сообщений
+func memoryPage(messages []Message, page MessagePage) ([]Message, bool) {
+	if page.Direction == PageForward {
+		start := 0
+		if page.Cursor != nil {
+			start = sort.Search(len(messages), func(i int) bool { return page.Cursor.before(messages[i]) })
+		}
+		end := start + page.Limit + 1
+		if end > len(messages) {
+			end = len(messages)
+		}
+
+		return finishPage(append([]Message{}, messages[start:end]...), page)
+	}
+
+	end := len(messages)
+	if page.Cursor != nil {
+		end = sort.Search(len(messages), func(i int) bool { return !page.Cursor.after(messages[i]) })
+	}
+	start := end - page.Limit - 1
+	if start < 0 {
+		start = 0
+	}
+
+	// finishPage ожидает выборку в порядке убывания ключа
+	result := make([]Message, 0, end-start)
+	for i := end - 1; i >= start; i-- {
+		result = append(result, messages[i])
+	}
+
+	return finishPage(result, page)
+}
+
+func (cm *ConnectorMemory) markRead(ctx context.Context, chatID uint64, userID uint64, messageID uint64) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if !cm.member(chatID, userID) {
+		return 0, fmt.Errorf("пользователь c id %d в чате %d %w", userID, chatID, ErrNotExist)
+	}
+
+	if cm.reads[chatID] == nil {
+		cm.reads[chatID] = make(map[uint64]uint64)
+	}
+	if messageID > cm.reads[chatID][userID] {
+		cm.reads[chatID][userID] = messageID
+	}
+
+	return cm.reads[chatID][userID], nil
+}
+
+func (cm *ConnectorMemory) getReadCursors(ctx context.Context, chatID uint64) (map[uint64]uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	result := make(map[uint64]uint64)
+	for _, userID := range cm.chats[chatID].Users {
+		result[userID] = cm.reads[chatID][userID]
+	}
+
+	return result, nil
+}
+
+func (cm *ConnectorMemory) editMessage(ctx context.Context, messageID uint64, text string) (Message, error) {
+	return cm.reviseMessage(ctx, messageID, text, false)
+}
+
+func (cm *ConnectorMemory) deleteMessage(ctx context.Context, messageID uint64) (Message, error) {
+	return cm.reviseMessage(ctx, messageID, "", true)
+}
+
+// Сохранение текущего текста сообщения в историю и замена текста. При удалении текст очищается
+func (cm *ConnectorMemory) reviseMessage(ctx context.Context, messageID uint64, text string, deleted bool) (Message, error) {
+	if err := ctx.Err(); err != nil {
+		return Message{}, err
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	message := cm.message(messageID)
+	if message == nil || message.DeletedAt != "" {
+		return Message{}, fmt.Errorf("сообщение c id %d %w", messageID, ErrNotExist)
+	}
+
+	now := time.Now().Format(timeLayout)
+	cm.lastRevisionID++
+	cm.revisions[messageID] = append(cm.revisions[messageID], MessageRevision{
+		ID:        cm.lastRevisionID,
+		Message:   messageID,
+		Text:      message.Text,
+		CreatedAt: now,
+	})
+
+	cm.unindexMessage(messageID, message.Text)
+	message.Text = text
+	if deleted {
+		message.DeletedAt = now
+	} else {
+		message.EditedAt = now
+		cm.indexMessage(messageID, text)
+	}
+
+	return *message, nil
+}
+
+func (cm *ConnectorMemory) getRevisions(ctx context.Context, messageID uint64) ([]MessageRevision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	return append([]MessageRevision{}, cm.revisions[messageID]...), nil
+}
+
+func (cm *ConnectorMemory) addMembers(ctx context.Context, chatID uint64, actorID uint64, users []uint64) ([]Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	chat, ok := cm.chats[chatID]
+	if !ok {
+		return nil, fmt.Errorf("чат c id %d %w", chatID, ErrNotExist)
+	}
+	for _, userID := range append([]uint64{actorID}, users...) {
+		if _, ok := cm.users[userID]; !ok {
+			return nil, fmt.Errorf("пользователь c id %d %w", userID, ErrNotExist)
+		}
+	}
+	for _, userID := range users {
+		if cm.member(chatID, userID) {
+			return nil, fmt.Errorf("пользователь c id %d в чате c id %d %w", userID, chatID, ErrAlreadyExist)
+		}
+	}
+
+	// Срез участников заменяется новым, а не дополняется на месте
+	chat.Users = append(append([]uint64(nil), chat.Users...), users...)
+	cm.chats[chatID] = chat
+	for _, userID := range users {
+		cm.roles[chatID][userID] = RoleMember
+	}
+
+	var messages []Message
+	for _, userID := range users {
+		messages = append(messages, cm.systemMessage(chatID, actorID, MessageMemberAdded, userID))
+	}
+
+	return messages, nil
+}
+
+func (cm *ConnectorMemory) removeMember(ctx context.Context, chatID uint64, actorID uint64, userID uint64) (Message, error) {
+	if err := ctx.Err(); err != nil {
+		return Message{}, err
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if _, ok := cm.users[actorID]; !ok {
+		return Message{}, fmt.Errorf("пользователь c id %d %w", actorID, ErrNotExist)
+	}
+	if !cm.member(chatID, userID) {
+		return Message{}, fmt.Errorf("пользователь c id %d в чате c id %d %w", userID, chatID, ErrNotExist)
+	}
+
+	chat := cm.chats[chatID]
+	members := make([]uint64, 0, len(chat.Users)-1)
+	for _, id := range chat.Users {
+		if id != userID {
+			members = append(members, id)
+		}
+	}
+	chat.Users = members
+	cm.chats[chatID] = chat
+	delete(cm.reads[chatID], userID)
+	delete(cm.roles[chatID], userID)
+
+	kind := MessageMemberRemoved
+	if actorID == userID {
+		kind = MessageMemberLeft
+	}
+
+	return cm.systemMessage(chatID, actorID, kind, userID), nil
+}
+
+// Запись системного сообщения в историю чата, вызывается под блокировкой
+func (cm *ConnectorMemory) systemMessage(chatID uint64, actorID uint64, kind string, target uint64) Message {
+	cm.lastMessageID++
+	message := Message{
+		ID:        cm.lastMessageID,
+		Chat:      chatID,
+		Author:    strconv.FormatUint(actorID, 10),
+		Text:      systemMessageText(kind, cm.users[actorID].Username, cm.users[target].Username),
+		CreatedAt: time.Now().Format(timeLayout),
+		Kind:      kind,
+		Target:    target,
+	}
+	cm.messages[chatID] = append(cm.messages[chatID], message)
+	cm.msgChats[message.ID] = chatID
+
+	return message
+}
+
+func (cm *ConnectorMemory) getRole(ctx context.Context, chat uint64, user uint64) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	return cm.roles[chat][user], nil
+}
+
+func (cm *ConnectorMemory) setRole(ctx context.Context, chat uint64, user uint64, role string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if !cm.member(chat, user) {
+		return fmt.Errorf("пользователь c id %d в чате c id %d %w", user, chat, ErrNotExist)
+	}
+	cm.roles[chat][user] = role
+
+	return nil
+}
+
+func (cm *ConnectorMemory) addReaction(ctx context.Context, messageID uint64, userID uint64, reaction string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if cm.message(messageID) == nil {
+		return fmt.Errorf("сообщение c id %d %w", messageID, ErrNotExist)
+	}
+
+	record := memoryReaction{user: userID, reaction: reaction}
+	for _, r := range cm.reactions[messageID] {
+		if r == record {
+			return fmt.Errorf("реакция %s пользователя c id %d на сообщение c id %d %w", reaction, userID, messageID, ErrAlreadyExist)
+		}
+	}
+	cm.reactions[messageID] = append(cm.reactions[messageID], record)
+
+	return nil
+}
+
+func (cm *ConnectorMemory) removeReaction(ctx context.Context, messageID uint64, userID uint64, reaction string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	records := cm.reactions[messageID]
+	for i, r := range records {
+		if r.user == userID && r.reaction == reaction {
+			cm.reactions[messageID] = append(records[:i:i], records[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("реакция %s пользователя c id %d на сообщение c id %d %w", reaction, userID, messageID, ErrNotExist)
+}
+
+// Реакции сгруппированы по значению в порядке первой из оставшихся реакций
+func (cm *ConnectorMemory) getReactions(ctx context.Context, messageIDs []uint64, userID uint64) (map[uint64][]Reaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	result := make(map[uint64][]Reaction)
+	for _, messageID := range messageIDs {
+		index := make(map[string]int)
+		for _, r := range cm.reactions[messageID] {
+			i, ok := index[r.reaction]
+			if !ok {
+				i = len(result[messageID])
+				index[r.reaction] = i
+				result[messageID] = append(result[messageID], Reaction{Reaction: r.reaction})
+			}
+			result[messageID][i].Count++
+			if r.user == userID {
+				result[messageID][i].Me = true
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (cm *ConnectorMemory) getAttachment(ctx context.Context, attachmentID uint64) (Attachment, error) {
+	if err := ctx.Err(); err != nil {
+		return Attachment{}, err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	for _, attachment := range cm.files[cm.fileIDs[attachmentID]] {
+		if attachment.ID == attachmentID {
+			return attachment, nil
+		}
+	}
+
+	return Attachment{}, fmt.Errorf("вложение c id %d %w", attachmentID, ErrNotExist)
+}
+
+func (cm *ConnectorMemory) getAttachments(ctx context.Context, messageIDs []uint64) (map[uint64][]Attachment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	result := make(map[uint64][]Attachment)
+	for _, messageID := range messageIDs {
+		if files, ok := cm.files[messageID]; ok {
+			result[messageID] = append([]Attachment(nil), files...)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Префикс имен метрик сервиса
+const metricsNamespace = "chat"
+
+// Метка маршрута для запросов, не подошедших ни к одному маршруту роутера
+const unmatchedRoute = "unmatched"
+
+// Metrics - Метрики сервиса в формате Prometheus
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec   // запросы по маршруту, методу и коду ответа
+	requestDuration *prometheus.HistogramVec // время обработки запроса по маршруту и методу
+	inFlight        prometheus.Gauge         // запросы в обработке
+
+	storageDuration *prometheus.HistogramVec // время обращения к хранилищу по методу коннектора
+	storageErrors   *prometheus.CounterVec   // ошибки хранилища по методу коннектора и виду ошибки
+	cacheRequests   *prometheus.CounterVec   // обращения к кэшу по методу коннектора и результату
+}
+
+// Создание метрик с собственным реестром, в который также входят метрики процесса и среды Go
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "Число обработанных HTTP запросов по маршруту, методу и коду ответа.",
+		}, []string{"route", "method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Время обработки HTTP запроса по маршруту и методу.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "requests_in_flight",
+			Help:      "Число HTTP запросов в обработке.",
+		}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "storage",
+			Name:      "operation_duration_seconds",
+			Help:      "Время выполнения метода коннектора хранилища.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"method"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "storage",
+			Name:      "errors_total",
+			Help:      "Число ошибок метода коннектора хранилища по виду ошибки.",
+		}, []string{"method", "kind"}),
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "cache",
+			Name:      "requests_total",
+			Help:      "Число обращений к кэшу коннектора по методу и результату: hit или miss.",
+		}, []string{"method", "result"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.inFlight,
+		m.storageDuration,
+		m.storageErrors,
+		m.cacheRequests,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// Обработчик, отдающий метрики
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Статистика пула подключений к БД, метрики go_sql_* с меткой db_name
+func (m *Metrics) registerDB(db *sql.DB, name string) error {
+	return m.registry.Register(collectors.NewDBStatsCollector(db, name))
+}
+
+// Миделвара метрик запросов. Маршрут берется из шаблона пути, поэтому метки
+// не зависят от идентификаторов в пути запроса
+func (m *Metrics) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		h.ServeHTTP(recorder, r)
+
+		m.requestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		m.requests.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+	})
+}
+
+// Шаблон пути маршрута запроса, unmatchedRoute для запросов без подходящего маршрута
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+
+	return unmatchedRoute
+}
+
+// Учет метода коннектора, вызывается отложенно с указателем на возвращаемую ошибку
+func (m *Metrics) observeStorage(method string, start time.Time, err *error) {
+	m.storageDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		m.storageErrors.WithLabelValues(method, storageErrorKind(*err)).Inc()
+	}
+}
+
+// Учет обращения к кэшу коннектора
+func (m *Metrics) observeCache(method string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheRequests.WithLabelValues(method, result).Inc()
+}
+
+// Вид ошибки хранилища. Отсутствие и повтор сущности - ожидаемые ответы на запросы клиентов,
+// на сбои указывают timeout и internal
+func storageErrorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrNotExist):
+		return "not_exist"
+	case errors.Is(err, ErrAlreadyExist):
+		return "already_exist"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "internal"
+	}
+}
+
+// Обертка ответа, запоминающая код. Сохраняет Hijacker и Flusher исходного ответа,
+// без них не работают WebSocket подключения
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if !sr.wroteHeader {
+		sr.status = status
+		sr.wroteHeader = true
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	sr.wroteHeader = true
+	return sr.ResponseWriter.Write(b)
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		sr.wroteHeader = true
+		flusher.Flush()
+	}
+}
+
+// После перехвата подключения ответ пишется в обход ResponseWriter, поэтому
+// перехваченный запрос учитывается с кодом 101 Switching Protocols
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("ответ %T не поддерживает перехват подключения", sr.ResponseWriter)
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && !sr.wroteHeader {
+		sr.status = http.StatusSwitchingProtocols
+		sr.wroteHeader = true
+	}
+
+	return conn, rw, err
+}
+
+// MetricsConnector - Коннектор, учитывающий время выполнения и ошибки методов другого коннектора
+type MetricsConnector struct {
+	next    Connector
+	metrics *Metrics
+}
+
+func NewMetricsConnector(next Connector, metrics *Metrics) *MetricsConnector {
+	return &MetricsConnector{next: next, metrics: metrics}
+}
+
+func (mc *MetricsConnector) ping(ctx context.Context) (err error) {
+	defer mc.metrics.observeStorage("ping", time.Now(), &err)
+	return mc.next.ping(ctx)
+}
+
+func (mc *MetricsConnector) createUser(ctx context.Context, username string, passwordHash string) (user User, err error) {
+	defer mc.metrics.observeStorage("createUser", time.Now(), &err)
+	return mc.next.createUser(ctx, username, passwordHash)
+}
+
+func (mc *MetricsConnector) getCredentials(ctx context.Context, username string) (user User, hash string, err error) {
+	defer mc.metrics.observeStorage("getCredentials", time.Now(), &err)
+	return mc.next.getCredentials(ctx, username)
+}
+
+func (mc *MetricsConnector) checkUsername(ctx context.Context, username string) (ok bool, err error) {
+	defer mc.metrics.observeStorage("checkUsername", time.Now(), &err)
+	return mc.next.checkUsername(ctx, username)
+}
+
+func (mc *MetricsConnector) checkUserID(ctx context.Context, user uint64) (ok bool, err error) {
+	defer mc.metrics.observeStorage("checkUserID", time.Now(), &err)
+	return mc.next.checkUserID(ctx, user)
+}
+
+func (mc *MetricsConnector) createChart(ctx context.Context, name string, ownerID uint64, users []uint64) (chat Chat, err error) {
+	defer mc.metrics.observeStorage("createChart", time.Now(), &err)
+	return mc.next.createChart(ctx, name, ownerID, users)
+}
+
+func (mc *MetricsConnector) checkChartName(ctx context.Context, name string) (ok bool, err error) {
+	defer mc.metrics.observeStorage("checkChartName", time.Now(), &err)
+	return mc.next.checkChartName(ctx, name)
+}
+
+func (mc *MetricsConnector) checkChartID(ctx context.Context, chat uint64) (ok bool, err error) {
+	defer mc.metrics.observeStorage("checkChartID", time.Now(), &err)
+	return mc.next.checkChartID(ctx, chat)
+}
+
+func (mc *MetricsConnector) isMember(ctx context.Context, chat uint64, user uint64) (ok bool, err error) {
+	defer mc.metrics.observeStorage("isMember", time.Now(), &err)
+	return mc.next.isMember(ctx, chat, user)
+}
+
+func (mc *MetricsConnector) getRole(ctx context.Context, chat uint64, user uint64) (role string, err error) {
+	defer mc.metrics.observeStorage("getRole", time.Now(), &err)
+	return mc.next.getRole(ctx, chat, user)
+}
+
+func (mc *MetricsConnector) setRole(ctx context.Context, chat uint64, user uint64, role string) (err error) {
+	defer mc.metrics.observeStorage("setRole", time.Now(), &err)
+	return mc.next.setRole(ctx, chat, user, role)
+}
+
+func (mc *MetricsConnector) getCharts(ctx context.Context, user uint64) (chats []Chat, err error) {
+	defer mc.metrics.observeStorage("getCharts", time.Now(), &err)
+	return mc.next.getCharts(ctx, user)
+}
+
+func (mc *MetricsConnector) sendMessage(ctx context.Context, chatID uint64, authorID uint64, text string, replyTo uint64, attachments []Attachment) (message Message, err error) {
+	defer mc.metrics.observeStorage("sendMessage", time.Now(), &err)
+	return mc.next.sendMessage(ctx, chatID, authorID, text, replyTo, attachments)
+}
+
+func (mc *MetricsConnector) getMessage(ctx context.Context, messageID uint64) (message Message, err error) {
+	defer mc.metrics.observeStorage("getMessage", time.Now(), &err)
+	return mc.next.getMessage(ctx, messageID)
+}
+
+func (mc *MetricsConnector) getMessages(ctx context.Context, chatID uint64, page MessagePage) (messages []Message, hasMore bool, err error) {
+	defer mc.metrics.observeStorage("getMessages", time.Now(), &err)
+	return mc.next.getMessages(ctx, chatID, page)
+}
+
+func (mc *MetricsConnector) getThread(ctx context.Context, rootID uint64, page MessagePage) (messages []Message, hasMore bool, err error) {
+	defer mc.metrics.observeStorage("getThread", time.Now(), &err)
+	return mc.next.getThread(ctx, rootID, page)
+}
+
+func (mc *MetricsConnector) searchMessages(ctx context.Context, userID uint64, query SearchQuery, page MessagePage) (messages []Message, hasMore bool, err error) {
+	defer mc.metrics.observeStorage("searchMessages", time.Now(), &err)
+	return mc.next.searchMessages(ctx, userID, query, page)
+}
+
+func (mc *MetricsConnector) markRead(ctx context.Context, chatID uint64, userID uint64, messageID uint64) (cursor uint64, err error) {
+	defer mc.metrics.observeStorage("markRead", time.Now(), &err)
+	return mc.next.markRead(ctx, chatID, userID, messageID)
+}
+
+func (mc *MetricsConnector) getReadCursors(ctx context.Context, chatID uint64) (cursors map[uint64]uint64, err error) {
+	defer mc.metrics.observeStorage("getReadCursors", time.Now(), &err)
+	return mc.next.getReadCursors(ctx, chatID)
+}
+
+func (mc *MetricsConnector) editMessage(ctx context.Context, messageID uint64, text string) (message Message, err error) {
+	defer mc.metrics.observeStorage("editMessage", time.Now(), &err)
+	return mc.next.editMessage(ctx, messageID, text)
+}
+
+func (mc *MetricsConnector) deleteMessage(ctx context.Context, messageID uint64) (message Message, err error) {
+	defer mc.metrics.observeStorage("deleteMessage", time.Now(), &err)
+	return mc.next.deleteMessage(ctx, messageID)
+}
+
+func (mc *MetricsConnector) getRevisions(ctx context.Context, messageID uint64) (revisions []MessageRevision, err error) {
+	defer mc.metrics.observeStorage("getRevisions", time.Now(), &err)
+	return mc.next.getRevisions(ctx, messageID)
+}
+
+func (mc *MetricsConnector) addMembers(ctx context.Context, chatID uint64, actorID uint64, users []uint64) (messages []Message, err error) {
+	defer mc.metrics.observeStorage("addMembers", time.Now(), &err)
+	return mc.next.addMembers(ctx, chatID, actorID, users)
+}
+
+func (mc *MetricsConnector) removeMember(ctx context.Context, chatID uint64, actorID uint64, userID uint64) (message Message, err error) {
+	defer mc.metrics.observeStorage("removeMember", time.Now(), &err)
+	return mc.next.removeMember(ctx, chatID, actorID, userID)
+}
+
+func (mc *MetricsConnector) addReaction(ctx context.Context, messageID uint64, userID uint64, reaction string) (err error) {
+	defer mc.metrics.observeStorage("addReaction", time.Now(), &err)
+	return mc.next.addReaction(ctx, messageID, userID, reaction)
+}
+
+func (mc *MetricsConnector) removeReaction(ctx context.Context, messageID uint64, userID uint64, reaction string) (err error) {
+	defer mc.metrics.observeStorage("removeReaction", time.Now(), &err)
+	return mc.next.removeReaction(ctx, messageID, userID, reaction)
+}
+
+func (mc *MetricsConnector) getReactions(ctx context.Context, messageIDs []uint64, userID uint64) (reactions map[uint64][]Reaction, err error) {
+	defer mc.metrics.observeStorage("getReactions", time.Now(), &err)
+	return mc.next.getReactions(ctx, messageIDs, userID)
+}
+
+func (mc *MetricsConnector) getAttachment(ctx context.Context, attachmentID uint64) (attachment Attachment, err error) {
+	defer mc.metrics.observeStorage("getAttachment", time.Now(), &err)
+	return mc.next.getAttachment(ctx, attachmentID)
+}
+
+func (mc *MetricsConnector) getAttachments(ctx context.Context, messageIDs []uint64) (attachments map[uint64][]Attachment, err error) {
+	defer mc.metrics.observeStorage("getAttachments", time.Now(), &err)
+	return mc.next.getAttachments(ctx, messageIDs)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	s := newTestService(t)
+	addUser(t, s, "alice")
+	doRequest(t, s, "/users/login", "", map[string]string{"username": "bob", "password": "secret"}, nil)
+	s.server.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/1", nil))
+
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("метрики: %d", w.Code)
+	}
+
+	// Запрос к /metrics учитывается после выдачи метрик, поэтому в ответе его нет
+	body := w.Body.String()
+	for _, line := range []string{
+		`chat_http_requests_total{code="201",method="POST",route="/users/add"} 1`,
+		`chat_http_requests_total{code="401",method="POST",route="/users/login"} 1`,
+		`chat_http_requests_total{code="404",method="GET",route="unmatched"} 1`,
+		`chat_http_request_duration_seconds_count{method="POST",route="/users/add"} 1`,
+		`chat_http_requests_in_flight 1`,
+		`chat_storage_operation_duration_seconds_count{method="createUser"} 1`,
+		`chat_storage_errors_total{kind="not_exist",method="getCredentials"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("в метриках нет строки %s:\n%s", line, body)
+		}
+	}
+	if !strings.Contains(body, "go_goroutines ") || !strings.Contains(body, "process_") {
+		t.Fatal("в метриках нет метрик процесса и среды Go")
+	}
+	if strings.Contains(body, `route="/metrics"`) {
+		t.Fatal("в метриках учтен запрос к /metrics")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Коннектор, хранящий данные в SQL БД. Схема таких хранилищ обновляется миграциями
+type SQLConnector interface {
+	Connector
+	sqlDB() (*sql.DB, error) // подключение к БД
+	sqlDialect() string      // диалект SQL, по которому выбираются запросы миграций
+}
+
+// Таблица с применёнными версиями схемы
+const migrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations
+(
+    version     BIGINT NOT NULL PRIMARY KEY,
+    description VARCHAR(255),
+    applied_at  VARCHAR(32)
+)`
+
+// Состояние отдельной миграции
+type MigrationStatus struct {
+	Migration
+	Applied   bool   // миграция применена
+	AppliedAt string // время применения
+}
+
+// Объект, применяющий миграции к SQL БД
+type Migrator struct {
+	db         *sql.DB
+	dialect    string
+	migrations []Migration
+}
+
+// Создание мигратора для коннектора. Коннектор должен хранить данные в SQL БД
+func NewMigrator(connector Connector) (*Migrator, error) {
+	sqlConnector, ok := connector.(SQLConnector)
+	if !ok {
+		return nil, fmt.Errorf("коннектор %T не поддерживает миграции", connector)
+	}
+
+	db, err := sqlConnector.sqlDB()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		db:         db,
+		dialect:    sqlConnector.sqlDialect(),
+		migrations: migrations,
+	}, nil
+}
+
+// Применить все неприменённые миграции, возвращает список применённых версий
+func (m *Migrator) Up() ([]uint64, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []uint64
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		if err := m.apply(migration, true); err != nil {
+			return versions, err
+		}
+		versions = append(versions, migration.Version)
+	}
+
+	return versions, nil
+}
+
+// Откатить последнюю применённую миграцию, возвращает false если откатывать нечего
+func (m *Migrator) Down() (Migration, bool, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return Migration{}, false, err
+	}
+
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+
+		if err := m.apply(migration, false); err != nil {
+			return Migration{}, false, err
+		}
+		return migration, true, nil
+	}
+
+	return Migration{}, false, nil
+}
+
+// Состояние всех известных миграций
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []MigrationStatus
+	for _, migration := range m.migrations {
+		appliedAt, ok := applied[migration.Version]
+		result = append(result, MigrationStatus{
+			Migration: migration,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		})
+	}
+
+	return result, nil
+}
+
+// Применённые версии и время их применения
+func (m *Migrator) applied() (map[uint64]string, error) {
+	if _, err := m.db.Exec(migrationsTable); err != nil {
+		return nil, fmt.Errorf("не удалось создать таблицу миграций: %w", err)
+	}
+
+	rows, err := m.db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[uint64]string)
+	for rows.Next() {
+		var version uint64
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		result[version] = appliedAt
+	}
+
+	return result, rows.Err()
+}
+
+// Применение или откат миграции в транзакции.
+// MySQL фиксирует DDL неявно, поэтому там миграция атомарна только по записи версии.
+func (m *Migrator) apply(migration Migration, up bool) error {
+	queries, ok := migration.Up[m.dialect]
+	if !up {
+		queries, ok = migration.Down[m.dialect]
+	}
+	if !ok {
+		return fmt.Errorf("миграция %d не описана для диалекта %s", migration.Version, m.dialect)
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			return fmt.Errorf("миграция %d: %w", migration.Version, err)
+		}
+	}
+
+	if up {
+		_, err = tx.Exec(m.bind("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?,?,?)"),
+			migration.Version, migration.Description, time.Now().Format(timeLayout))
+	} else {
+		_, err = tx.Exec(m.bind("DELETE FROM schema_migrations WHERE version = ?"), migration.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("миграция %d: %w", migration.Version, err)
+	}
+
+	return tx.Commit()
+}
+
+// Замена плейсхолдеров ? на $1, $2... для PostgreSQL
+func (m *Migrator) bind(query string) string {
+	if m.dialect != dialectPostgres {
+		return query
+	}
+
+	var builder strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&builder, "$%d", n)
+			continue
+		}
+		builder.WriteRune(r)
+	}
+
+	return builder.String()
+}
+
+// Команда migrate up|down|status
+func runMigrateCommand(config *Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("использование: migrate up|down|status")
+	}
+
+	connector, err := NewConnector(config.ConnectorType)
+	if err != nil {
+		return err
+	}
+
+	migrator, err := NewMigrator(connector)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		versions, err := migrator.Up()
+		for _, version := range versions {
+			fmt.Printf("применена миграция %d\n", version)
+		}
+		if err != nil {
+			return err
+		}
+		if len(versions) == 0 {
+			fmt.Println("схема в актуальном состоянии")
+		}
+	case "down":
+		migration, ok, err := migrator.Down()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Println("нет применённых миграций")
+			return nil
+		}
+		fmt.Printf("откачена миграция %d\n", migration.Version)
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ВЕРСИЯ\tПРИМЕНЕНА\tОПИСАНИЕ")
+		for _, status := range statuses {
+			appliedAt := "нет"
+			if status.Applied {
+				appliedAt = status.AppliedAt
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, appliedAt, status.Description)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("неизвестная команда migrate %s", args[0])
+	}
+
+	return nil
+}
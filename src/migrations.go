@@ -0,0 +1,530 @@
+package main
+
+// Диалекты SQL, для которых описаны миграции
+const (
+	dialectMySQL    = "mysql"
+	dialectPostgres = "postgres"
+	dialectSQLite   = "sqlite"
+)
+
+// Migration - Версия схемы БД. Запросы описываются отдельно для каждого диалекта SQL
+type Migration struct {
+	Version     uint64              // номер версии, миграции применяются по возрастанию
+	Description string              // краткое описание изменений
+	Up          map[string][]string // запросы применения миграции
+	Down        map[string][]string // запросы отката миграции
+}
+
+// Список миграций схемы. Применённые миграции не изменяются, новые добавляются в конец
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "начальная схема",
+		Up: map[string][]string{
+			dialectMySQL: {
+				`CREATE TABLE IF NOT EXISTS E1_Users
+(
+    id         INTEGER AUTO_INCREMENT,
+    username   VARCHAR(32),
+    created_at DATETIME,
+
+    PRIMARY KEY (id),
+    UNIQUE (username)
+)`,
+				`CREATE TABLE IF NOT EXISTS E2_Chat
+(
+    id         INTEGER AUTO_INCREMENT,
+    name       VARCHAR(32),
+    created_at DATETIME,
+
+    PRIMARY KEY (id),
+    UNIQUE (name)
+)`,
+				`CREATE TABLE IF NOT EXISTS E3_Chatroom
+(
+    id_user INTEGER NOT NULL,
+    id_chat INTEGER NOT NULL,
+
+    PRIMARY KEY (id_user, id_chat),
+    FOREIGN KEY (id_user) REFERENCES E1_Users (id),
+    FOREIGN KEY (id_chat) REFERENCES E2_Chat (id)
+)`,
+				`CREATE TABLE IF NOT EXISTS E4_Messages
+(
+    id         INTEGER AUTO_INCREMENT,
+    id_chat    INTEGER NOT NULL,
+    id_user    INTEGER NOT NULL,
+    text       VARCHAR(32),
+    created_at DATETIME,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (id_user) REFERENCES E1_Users (id),
+    FOREIGN KEY (id_chat) REFERENCES E2_Chat (id)
+)`,
+			},
+			dialectPostgres: {
+				`CREATE TABLE IF NOT EXISTS E1_Users
+(
+    id         SERIAL,
+    username   VARCHAR(32),
+    created_at TIMESTAMP,
+
+    PRIMARY KEY (id),
+    UNIQUE (username)
+)`,
+				`CREATE TABLE IF NOT EXISTS E2_Chat
+(
+    id         SERIAL,
+    name       VARCHAR(32),
+    created_at TIMESTAMP,
+
+    PRIMARY KEY (id),
+    UNIQUE (name)
+)`,
+				`CREATE TABLE IF NOT EXISTS E3_Chatroom
+(
+    id_user INTEGER NOT NULL,
+    id_chat INTEGER NOT NULL,
+
+    PRIMARY KEY (id_user, id_chat),
+    FOREIGN KEY (id_user) REFERENCES E1_Users (id),
+    FOREIGN KEY (id_chat) REFERENCES E2_Chat (id)
+)`,
+				`CREATE TABLE IF NOT EXISTS E4_Messages
+(
+    id         SERIAL,
+    id_chat    INTEGER NOT NULL,
+    id_user    INTEGER NOT NULL,
+    text       VARCHAR(32),
+    created_at TIMESTAMP,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (id_user) REFERENCES E1_Users (id),
+    FOREIGN KEY (id_chat) REFERENCES E2_Chat (id)
+)`,
+			},
+			// Время хранится текстом, чтобы драйвер не преобразовывал его в time.Time
+			dialectSQLite: {
+				`CREATE TABLE IF NOT EXISTS E1_Users
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    username   VARCHAR(32) UNIQUE,
+    created_at TEXT
+)`,
+				`CREATE TABLE IF NOT EXISTS E2_Chat
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    name       VARCHAR(32) UNIQUE,
+    created_at TEXT
+)`,
+				`CREATE TABLE IF NOT EXISTS E3_Chatroom
+(
+    id_user INTEGER NOT NULL,
+    id_chat INTEGER NOT NULL,
+
+    PRIMARY KEY (id_user, id_chat),
+    FOREIGN KEY (id_user) REFERENCES E1_Users (id),
+    FOREIGN KEY (id_chat) REFERENCES E2_Chat (id)
+)`,
+				`CREATE TABLE IF NOT EXISTS E4_Messages
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    id_chat    INTEGER NOT NULL,
+    id_user    INTEGER NOT NULL,
+    text       VARCHAR(32),
+    created_at TEXT,
+
+    FOREIGN KEY (id_user) REFERENCES E1_Users (id),
+    FOREIGN KEY (id_chat) REFERENCES E2_Chat (id)
+)`,
+			},
+		},
+		Down: map[string][]string{
+			dialectMySQL: {
+				"DROP TABLE IF EXISTS E4_Messages",
+				"DROP TABLE IF EXISTS E3_Chatroom",
+				"DROP TABLE IF EXISTS E2_Chat",
+				"DROP TABLE IF EXISTS E1_Users",
+			},
+			dialectPostgres: {
+				"DROP TABLE IF EXISTS E4_Messages",
+				"DROP TABLE IF EXISTS E3_Chatroom",
+				"DROP TABLE IF EXISTS E2_Chat",
+				"DROP TABLE IF EXISTS E1_Users",
+			},
+			dialectSQLite: {
+				"DROP TABLE IF EXISTS E4_Messages",
+				"DROP TABLE IF EXISTS E3_Chatroom",
+				"DROP TABLE IF EXISTS E2_Chat",
+				"DROP TABLE IF EXISTS E1_Users",
+			},
+		},
+	},
+	{
+		Version:     2,
+		Description: "увеличение длины текста сообщения до 1024 символов",
+		Up: map[string][]string{
+			dialectMySQL:    {"ALTER TABLE E4_Messages MODIFY text VARCHAR(1024)"},
+			dialectPostgres: {"ALTER TABLE E4_Messages ALTER COLUMN text TYPE VARCHAR(1024)"},
+			// SQLite не ограничивает длину VARCHAR
+			dialectSQLite: {},
+		},
+		Down: map[string][]string{
+			dialectMySQL:    {"ALTER TABLE E4_Messages MODIFY text VARCHAR(32)"},
+			dialectPostgres: {"ALTER TABLE E4_Messages ALTER COLUMN text TYPE VARCHAR(32) USING left(text, 32)"},
+			dialectSQLite:   {},
+		},
+	}, {
+		Version:     3,
+		Description: "хеш пароля пользователя",
+		Up: map[string][]string{
+			dialectMySQL:    {"ALTER TABLE E1_Users ADD COLUMN password_hash VARCHAR(255)"},
+			dialectPostgres: {"ALTER TABLE E1_Users ADD COLUMN password_hash VARCHAR(255)"},
+			dialectSQLite:   {"ALTER TABLE E1_Users ADD COLUMN password_hash VARCHAR(255)"},
+		},
+		Down: map[string][]string{
+			dialectMySQL:    {"ALTER TABLE E1_Users DROP COLUMN password_hash"},
+			dialectPostgres: {"ALTER TABLE E1_Users DROP COLUMN password_hash"},
+			dialectSQLite:   {"ALTER TABLE E1_Users DROP COLUMN password_hash"},
+		},
+	}, {
+		Version:     4,
+		Description: "индекс сообщений по чату и времени создания",
+		Up: map[string][]string{
+			dialectMySQL:    {"CREATE INDEX idx_messages_chat_created ON E4_Messages (id_chat, created_at, id)"},
+			dialectPostgres: {"CREATE INDEX IF NOT EXISTS idx_messages_chat_created ON E4_Messages (id_chat, created_at, id)"},
+			dialectSQLite:   {"CREATE INDEX IF NOT EXISTS idx_messages_chat_created ON E4_Messages (id_chat, created_at, id)"},
+		},
+		Down: map[string][]string{
+			// Индекс может использоваться внешним ключом id_chat, поэтому сначала создаем замену
+			dialectMySQL:    {"ALTER TABLE E4_Messages ADD INDEX idx_messages_chat (id_chat), DROP INDEX idx_messages_chat_created"},
+			dialectPostgres: {"DROP INDEX IF EXISTS idx_messages_chat_created"},
+			dialectSQLite:   {"DROP INDEX IF EXISTS idx_messages_chat_created"},
+		},
+	}, {
+		Version:     5,
+		Description: "курсор прочтения участника чата",
+		Up: map[string][]string{
+			dialectMySQL:    {"ALTER TABLE E3_Chatroom ADD COLUMN last_read_id INTEGER NOT NULL DEFAULT 0"},
+			dialectPostgres: {"ALTER TABLE E3_Chatroom ADD COLUMN last_read_id INTEGER NOT NULL DEFAULT 0"},
+			dialectSQLite:   {"ALTER TABLE E3_Chatroom ADD COLUMN last_read_id INTEGER NOT NULL DEFAULT 0"},
+		},
+		Down: map[string][]string{
+			dialectMySQL:    {"ALTER TABLE E3_Chatroom DROP COLUMN last_read_id"},
+			dialectPostgres: {"ALTER TABLE E3_Chatroom DROP COLUMN last_read_id"},
+			dialectSQLite:   {"ALTER TABLE E3_Chatroom DROP COLUMN last_read_id"},
+		},
+	}, {
+		Version:     6,
+		Description: "изменение и удаление сообщений, история версий",
+		Up: map[string][]string{
+			dialectMySQL: {
+				"ALTER TABLE E4_Messages ADD COLUMN edited_at DATETIME NULL, ADD COLUMN deleted_at DATETIME NULL",
+				`CREATE TABLE IF NOT EXISTS E5_MessageRevisions
+(
+    id         INTEGER AUTO_INCREMENT,
+    id_message INTEGER NOT NULL,
+    text       VARCHAR(1024),
+    created_at DATETIME,
+
+    PRIMARY KEY (id),
+    INDEX (id_message),
+    FOREIGN KEY (id_message) REFERENCES E4_Messages (id)
+)`,
+			},
+			dialectPostgres: {
+				"ALTER TABLE E4_Messages ADD COLUMN edited_at TIMESTAMP NULL, ADD COLUMN deleted_at TIMESTAMP NULL",
+				`CREATE TABLE IF NOT EXISTS E5_MessageRevisions
+(
+    id         SERIAL,
+    id_message INTEGER NOT NULL,
+    text       VARCHAR(1024),
+    created_at TIMESTAMP,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (id_message) REFERENCES E4_Messages (id)
+)`,
+				"CREATE INDEX IF NOT EXISTS idx_revisions_message ON E5_MessageRevisions (id_message)",
+			},
+			dialectSQLite: {
+				"ALTER TABLE E4_Messages ADD COLUMN edited_at TEXT NULL",
+				"ALTER TABLE E4_Messages ADD COLUMN deleted_at TEXT NULL",
+				`CREATE TABLE IF NOT EXISTS E5_MessageRevisions
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    id_message INTEGER NOT NULL,
+    text       VARCHAR(1024),
+    created_at TEXT,
+
+    FOREIGN KEY (id_message) REFERENCES E4_Messages (id)
+)`,
+				"CREATE INDEX IF NOT EXISTS idx_revisions_message ON E5_MessageRevisions (id_message)",
+			},
+		},
+		Down: map[string][]string{
+			dialectMySQL: {
+				"DROP TABLE IF EXISTS E5_MessageRevisions",
+				"ALTER TABLE E4_Messages DROP COLUMN edited_at, DROP COLUMN deleted_at",
+			},
+			dialectPostgres: {
+				"DROP TABLE IF EXISTS E5_MessageRevisions",
+				"ALTER TABLE E4_Messages DROP COLUMN edited_at, DROP COLUMN deleted_at",
+			},
+			dialectSQLite: {
+				"DROP TABLE IF EXISTS E5_MessageRevisions",
+				"ALTER TABLE E4_Messages DROP COLUMN edited_at",
+				"ALTER TABLE E4_Messages DROP COLUMN deleted_at",
+			},
+		},
+	}, {
+		Version:     7,
+		Description: "системные сообщения об изменении состава чата",
+		Up: map[string][]string{
+			dialectMySQL:    {"ALTER TABLE E4_Messages ADD COLUMN kind VARCHAR(16) NULL, ADD COLUMN id_target INTEGER NULL"},
+			dialectPostgres: {"ALTER TABLE E4_Messages ADD COLUMN kind VARCHAR(16) NULL, ADD COLUMN id_target INTEGER NULL"},
+			dialectSQLite: {
+				"ALTER TABLE E4_Messages ADD COLUMN kind VARCHAR(16) NULL",
+				"ALTER TABLE E4_Messages ADD COLUMN id_target INTEGER NULL",
+			},
+		},
+		Down: map[string][]string{
+			dialectMySQL:    {"ALTER TABLE E4_Messages DROP COLUMN kind, DROP COLUMN id_target"},
+			dialectPostgres: {"ALTER TABLE E4_Messages DROP COLUMN kind, DROP COLUMN id_target"},
+			dialectSQLite: {
+				"ALTER TABLE E4_Messages DROP COLUMN kind",
+				"ALTER TABLE E4_Messages DROP COLUMN id_target",
+			},
+		},
+	}, {
+		Version:     8,
+		Description: "роли участников чата",
+		Up: map[string][]string{
+			dialectMySQL:    {"ALTER TABLE E3_Chatroom ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'member'"},
+			dialectPostgres: {"ALTER TABLE E3_Chatroom ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'member'"},
+			dialectSQLite:   {"ALTER TABLE E3_Chatroom ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'member'"},
+		},
+		Down: map[string][]string{
+			dialectMySQL:    {"ALTER TABLE E3_Chatroom DROP COLUMN role"},
+			dialectPostgres: {"ALTER TABLE E3_Chatroom DROP COLUMN role"},
+			dialectSQLite:   {"ALTER TABLE E3_Chatroom DROP COLUMN role"},
+		},
+	}, {
+		Version:     9,
+		Description: "ветки ответов на сообщения",
+		Up: map[string][]string{
+			dialectMySQL: {
+				`ALTER TABLE E4_Messages ADD COLUMN id_reply_to INTEGER NULL, ADD COLUMN id_thread_root INTEGER NULL,
+    ADD COLUMN reply_count INTEGER NOT NULL DEFAULT 0`,
+				"CREATE INDEX idx_messages_thread_created ON E4_Messages (id_thread_root, created_at, id)",
+			},
+			dialectPostgres: {
+				`ALTER TABLE E4_Messages ADD COLUMN id_reply_to INTEGER NULL, ADD COLUMN id_thread_root INTEGER NULL,
+    ADD COLUMN reply_count INTEGER NOT NULL DEFAULT 0`,
+				"CREATE INDEX IF NOT EXISTS idx_messages_thread_created ON E4_Messages (id_thread_root, created_at, id)",
+			},
+			dialectSQLite: {
+				"ALTER TABLE E4_Messages ADD COLUMN id_reply_to INTEGER NULL",
+				"ALTER TABLE E4_Messages ADD COLUMN id_thread_root INTEGER NULL",
+				"ALTER TABLE E4_Messages ADD COLUMN reply_count INTEGER NOT NULL DEFAULT 0",
+				"CREATE INDEX IF NOT EXISTS idx_messages_thread_created ON E4_Messages (id_thread_root, created_at, id)",
+			},
+		},
+		Down: map[string][]string{
+			dialectMySQL: {
+				"ALTER TABLE E4_Messages DROP INDEX idx_messages_thread_created",
+				"ALTER TABLE E4_Messages DROP COLUMN id_reply_to, DROP COLUMN id_thread_root, DROP COLUMN reply_count",
+			},
+			dialectPostgres: {
+				"DROP INDEX IF EXISTS idx_messages_thread_created",
+				"ALTER TABLE E4_Messages DROP COLUMN id_reply_to, DROP COLUMN id_thread_root, DROP COLUMN reply_count",
+			},
+			dialectSQLite: {
+				"DROP INDEX IF EXISTS idx_messages_thread_created",
+				"ALTER TABLE E4_Messages DROP COLUMN id_reply_to",
+				"ALTER TABLE E4_Messages DROP COLUMN id_thread_root",
+				"ALTER TABLE E4_Messages DROP COLUMN reply_count",
+			},
+		},
+	}, {
+		Version:     10,
+		Description: "реакции на сообщения",
+		Up: map[string][]string{
+			// Эмодзи требуют utf8mb4, двоичное сравнение различает эмодзи в уникальном ключе
+			dialectMySQL: {
+				`CREATE TABLE IF NOT EXISTS E6_Reactions
+(
+    id         INTEGER AUTO_INCREMENT,
+    id_message INTEGER NOT NULL,
+    id_user    INTEGER NOT NULL,
+    reaction   VARCHAR(32) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+    created_at DATETIME,
+
+    PRIMARY KEY (id),
+    UNIQUE (id_message, id_user, reaction),
+    FOREIGN KEY (id_message) REFERENCES E4_Messages (id),
+    FOREIGN KEY (id_user) REFERENCES E1_Users (id)
+)`,
+			},
+			dialectPostgres: {
+				`CREATE TABLE IF NOT EXISTS E6_Reactions
+(
+    id         SERIAL,
+    id_message INTEGER NOT NULL,
+    id_user    INTEGER NOT NULL,
+    reaction   VARCHAR(32) NOT NULL,
+    created_at TIMESTAMP,
+
+    PRIMARY KEY (id),
+    UNIQUE (id_message, id_user, reaction),
+    FOREIGN KEY (id_message) REFERENCES E4_Messages (id),
+    FOREIGN KEY (id_user) REFERENCES E1_Users (id)
+)`,
+			},
+			dialectSQLite: {
+				`CREATE TABLE IF NOT EXISTS E6_Reactions
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    id_message INTEGER NOT NULL,
+    id_user    INTEGER NOT NULL,
+    reaction   VARCHAR(32) NOT NULL,
+    created_at TEXT,
+
+    UNIQUE (id_message, id_user, reaction),
+    FOREIGN KEY (id_message) REFERENCES E4_Messages (id),
+    FOREIGN KEY (id_user) REFERENCES E1_Users (id)
+)`,
+			},
+		},
+		Down: map[string][]string{
+			dialectMySQL:    {"DROP TABLE IF EXISTS E6_Reactions"},
+			dialectPostgres: {"DROP TABLE IF EXISTS E6_Reactions"},
+			dialectSQLite:   {"DROP TABLE IF EXISTS E6_Reactions"},
+		},
+	}, {
+		Version:     11,
+		Description: "кодировка utf8mb4 для текстов",
+		Up: map[string][]string{
+			// utf8 в MySQL хранит не больше 3 байт на символ, эмодзи в тексте и именах отклоняются.
+			// Таблицы, созданные следующими миграциями, получают кодировку БД
+			dialectMySQL: {
+				"ALTER DATABASE CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci",
+				"ALTER TABLE E1_Users CONVERT TO CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci",
+				"ALTER TABLE E2_Chat CONVERT TO CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci",
+				"ALTER TABLE E4_Messages CONVERT TO CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci",
+				"ALTER TABLE E5_MessageRevisions CONVERT TO CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci",
+			},
+			// PostgreSQL и SQLite хранят текст в UTF-8 целиком
+			dialectPostgres: {},
+			dialectSQLite:   {},
+		},
+		Down: map[string][]string{
+			// Символы, которых нет в utf8, заменяются на ?
+			dialectMySQL: {
+				"ALTER TABLE E5_MessageRevisions CONVERT TO CHARACTER SET utf8 COLLATE utf8_general_ci",
+				"ALTER TABLE E4_Messages CONVERT TO CHARACTER SET utf8 COLLATE utf8_general_ci",
+				"ALTER TABLE E2_Chat CONVERT TO CHARACTER SET utf8 COLLATE utf8_general_ci",
+				"ALTER TABLE E1_Users CONVERT TO CHARACTER SET utf8 COLLATE utf8_general_ci",
+				"ALTER DATABASE CHARACTER SET utf8 COLLATE utf8_general_ci",
+			},
+			dialectPostgres: {},
+			dialectSQLite:   {},
+		},
+	}, {
+		Version:     12,
+		Description: "вложения сообщений",
+		Up: map[string][]string{
+			dialectMySQL: {
+				`CREATE TABLE IF NOT EXISTS E7_Attachments
+(
+    id          INTEGER AUTO_INCREMENT,
+    id_message  INTEGER NOT NULL,
+    name        VARCHAR(255) NOT NULL,
+    mime_type   VARCHAR(127) NOT NULL,
+    size        BIGINT NOT NULL,
+    checksum    CHAR(64) NOT NULL,
+    storage_key VARCHAR(64) NOT NULL,
+    created_at  DATETIME,
+
+    PRIMARY KEY (id),
+    INDEX (id_message),
+    FOREIGN KEY (id_message) REFERENCES E4_Messages (id)
+)`,
+			},
+			dialectPostgres: {
+				`CREATE TABLE IF NOT EXISTS E7_Attachments
+(
+    id          SERIAL,
+    id_message  INTEGER NOT NULL,
+    name        VARCHAR(255) NOT NULL,
+    mime_type   VARCHAR(127) NOT NULL,
+    size        BIGINT NOT NULL,
+    checksum    CHAR(64) NOT NULL,
+    storage_key VARCHAR(64) NOT NULL,
+    created_at  TIMESTAMP,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (id_message) REFERENCES E4_Messages (id)
+)`,
+				"CREATE INDEX IF NOT EXISTS idx_attachments_message ON E7_Attachments (id_message)",
+			},
+			dialectSQLite: {
+				`CREATE TABLE IF NOT EXISTS E7_Attachments
+(
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    id_message  INTEGER NOT NULL,
+    name        VARCHAR(255) NOT NULL,
+    mime_type   VARCHAR(127) NOT NULL,
+    size        BIGINT NOT NULL,
+    checksum    CHAR(64) NOT NULL,
+    storage_key VARCHAR(64) NOT NULL,
+    created_at  TEXT,
+
+    FOREIGN KEY (id_message) REFERENCES E4_Messages (id)
+)`,
+				"CREATE INDEX IF NOT EXISTS idx_attachments_message ON E7_Attachments (id_message)",
+			},
+		},
+		Down: map[string][]string{
+			dialectMySQL:    {"DROP TABLE IF EXISTS E7_Attachments"},
+			dialectPostgres: {"DROP TABLE IF EXISTS E7_Attachments"},
+			dialectSQLite:   {"DROP TABLE IF EXISTS E7_Attachments"},
+		},
+	}, {
+		Version:     13,
+		Description: "полнотекстовый поиск сообщений",
+		Up: map[string][]string{
+			dialectMySQL:    {"ALTER TABLE E4_Messages ADD FULLTEXT INDEX idx_messages_text (text)"},
+			dialectPostgres: {"CREATE INDEX IF NOT EXISTS idx_messages_text ON E4_Messages USING GIN (to_tsvector('simple', text))"},
+			// FTS4 входит в сборку go-sqlite3 без тегов, в отличие от FTS5. Таблица хранит только индекс,
+			// текст берется из E4_Messages, поэтому индекс обновляют триггеры. unicode61 приводит
+			// к нижнему регистру любые буквы, а не только латиницу, диакритика сохраняется, как в памяти
+			dialectSQLite: {
+				`CREATE VIRTUAL TABLE IF NOT EXISTS E4_Messages_fts USING fts4(content="E4_Messages", text, tokenize=unicode61 "remove_diacritics=0")`,
+				`CREATE TRIGGER IF NOT EXISTS messages_fts_before_update BEFORE UPDATE ON E4_Messages BEGIN
+    DELETE FROM E4_Messages_fts WHERE docid = old.id;
+END`,
+				`CREATE TRIGGER IF NOT EXISTS messages_fts_before_delete BEFORE DELETE ON E4_Messages BEGIN
+    DELETE FROM E4_Messages_fts WHERE docid = old.id;
+END`,
+				`CREATE TRIGGER IF NOT EXISTS messages_fts_after_update AFTER UPDATE ON E4_Messages BEGIN
+    INSERT INTO E4_Messages_fts (docid, text) VALUES (new.id, new.text);
+END`,
+				`CREATE TRIGGER IF NOT EXISTS messages_fts_after_insert AFTER INSERT ON E4_Messages BEGIN
+    INSERT INTO E4_Messages_fts (docid, text) VALUES (new.id, new.text);
+END`,
+				"INSERT INTO E4_Messages_fts (E4_Messages_fts) VALUES ('rebuild')",
+			},
+		},
+		Down: map[string][]string{
+			dialectMySQL:    {"ALTER TABLE E4_Messages DROP INDEX idx_messages_text"},
+			dialectPostgres: {"DROP INDEX IF EXISTS idx_messages_text"},
+			dialectSQLite: {
+				"DROP TRIGGER IF EXISTS messages_fts_after_insert",
+				"DROP TRIGGER IF EXISTS messages_fts_after_update",
+				"DROP TRIGGER IF EXISTS messages_fts_before_delete",
+				"DROP TRIGGER IF EXISTS messages_fts_before_update",
+				"DROP TABLE IF EXISTS E4_Messages_fts",
+			},
+		},
+	},
+}
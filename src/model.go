@@ -13,13 +13,88 @@ type Chat struct {
 	Name      string   `json:"name"`       //уникальное имя чата
 	Users     []uint64 `json:"users"`      //список пользователей в чате, отношение многие-ко-многим
 	CreatedAt string   `json:"created_at"` //время создания
+
+	Roles map[uint64]string `json:"roles,omitempty"` //роли участников по id пользователя
+
+	LastMessage *Message `json:"last_message,omitempty"` //последнее сообщение в чате, заполняется в списке чатов пользователя
+	UnreadCount uint64   `json:"unread_count"`           //количество непрочитанных пользователем сообщений других участников
 }
 
-//Message - Сообщение в чате. Имеет следующие свойства:
+// Message - Сообщение в чате. Имеет следующие свойства:
 type Message struct {
-	ID        uint64 `json:"id"`         //уникальный идентификатор сообщения
-	Chat      uint64 `json:"chat"`       //ссылка на идентификатор чата, в который было отправлено сообщение
-	Author    string `json:"author"`     //ссылка на идентификатор отправителя сообщения, отношение многие-к-одному
-	Text      string `json:"text"`       //текст отправленного сообщения
-	CreatedAt string `json:"created_at"` //время создания
+	ID        uint64 `json:"id"`                   //уникальный идентификатор сообщения
+	Chat      uint64 `json:"chat"`                 //ссылка на идентификатор чата, в который было отправлено сообщение
+	Author    string `json:"author"`               //ссылка на идентификатор отправителя сообщения, отношение многие-к-одному
+	Text      string `json:"text"`                 //текст отправленного сообщения
+	CreatedAt string `json:"created_at"`           //время создания
+	EditedAt  string `json:"edited_at,omitempty"`  //время последнего изменения текста
+	DeletedAt string `json:"deleted_at,omitempty"` //время удаления, текст удаленного сообщения не возвращается
+	Kind      string `json:"kind,omitempty"`       //тип системного сообщения, для сообщений пользователей не задается
+	Target    uint64 `json:"target,omitempty"`     //пользователь, которого касается системное сообщение
+
+	ReplyTo    uint64 `json:"reply_to,omitempty"`    //сообщение, на которое дан ответ
+	ThreadRoot uint64 `json:"thread_root,omitempty"` //первое сообщение ветки ответов
+	ReplyCount uint64 `json:"reply_count,omitempty"` //количество ответов в ветке, задается для первого сообщения ветки
+
+	ReadBy      []uint64     `json:"read_by,omitempty"`     //участники, прочитавшие сообщение, заполняется для небольших чатов
+	Reactions   []Reaction   `json:"reactions,omitempty"`   //реакции участников, заполняются при выдаче истории
+	Attachments []Attachment `json:"attachments,omitempty"` //вложения, содержимое загружается отдельно
+}
+
+// Максимальная длина текста сообщения в символах, совпадает с размером столбца text
+const maxMessageLength = 1024
+
+// Типы системных сообщений об изменении состава чата. Автор системного сообщения - пользователь, выполнивший действие
+const (
+	MessageMemberAdded   = "member_added"   // участник добавлен в чат
+	MessageMemberRemoved = "member_removed" // участник исключен из чата
+	MessageMemberLeft    = "member_left"    // участник покинул чат
+)
+
+// MessageRevision - Предыдущая версия текста сообщения, сохраняется при изменении и удалении
+type MessageRevision struct {
+	ID        uint64 `json:"id"`         //уникальный идентификатор версии
+	Message   uint64 `json:"message"`    //идентификатор сообщения
+	Text      string `json:"text"`       //текст сообщения до изменения
+	CreatedAt string `json:"created_at"` //время, когда текст был заменен
+}
+
+// ReadReceipt - Позиция прочтения чата участником
+type ReadReceipt struct {
+	Chat       uint64 `json:"chat"`         //идентификатор чата
+	User       uint64 `json:"user"`         //идентификатор участника
+	LastReadID uint64 `json:"last_read_id"` //идентификатор последнего прочитанного сообщения
+}
+
+// Membership - Изменение состава участников чата
+type Membership struct {
+	Chat  uint64   `json:"chat"`  //идентификатор чата
+	Users []uint64 `json:"users"` //добавленные или исключенные участники
+}
+
+// Reaction - Реакция на сообщение, агрегированная по значению
+type Reaction struct {
+	Reaction string `json:"reaction"` //эмодзи или его короткое имя вида :thumbsup:
+	Count    uint64 `json:"count"`    //количество участников, оставивших реакцию
+	Me       bool   `json:"me"`       //реакцию оставил запросивший пользователь
+}
+
+// ReactionChange - Реакция участника, поставленная на сообщение или снятая с него
+type ReactionChange struct {
+	Chat     uint64 `json:"chat"`     //идентификатор чата
+	Message  uint64 `json:"message"`  //идентификатор сообщения
+	User     uint64 `json:"user"`     //идентификатор участника
+	Reaction string `json:"reaction"` //значение реакции
+}
+
+// Attachment - Вложение сообщения. Содержимое хранится в BlobStore по ключу StorageKey
+type Attachment struct {
+	ID         uint64 `json:"id"`         //уникальный идентификатор вложения
+	Message    uint64 `json:"message"`    //идентификатор сообщения
+	Name       string `json:"name"`       //имя файла
+	MIMEType   string `json:"mime_type"`  //тип содержимого
+	Size       int64  `json:"size"`       //размер в байтах
+	Checksum   string `json:"checksum"`   //SHA-256 содержимого в шестнадцатеричном виде
+	CreatedAt  string `json:"created_at"` //время загрузки
+	StorageKey string `json:"-"`          //ключ содержимого в хранилище вложений
 }
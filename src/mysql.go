@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/kelseyhightower/envconfig"
+	"time"
+)
+import "database/sql"
+import _ "github.com/go-sql-driver/mysql"
+
+type ConfigMySQL struct {
+	Login    string `default:"root"`
+	Password string `default:"password"`
+	Host     string `default:"127.0.0.1"`
+	Port     string `default:"3306"`
+	Database string `default:"chat"`
+}
+
+func initConfigMySQL() (*ConfigMySQL, error) {
+	config := &ConfigMySQL{}
+	err := envconfig.Process("MySQL", config)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+type ConnectorMySQL struct {
+	config *ConfigMySQL
+	db     *sql.DB
+}
+
+func (cp *ConnectorMySQL) connect() error {
+	sourceAddr := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s",
+		cp.config.Login, cp.config.Password, cp.config.Host, cp.config.Port, cp.config.Database)
+	db, err := openTracedDB("mysql", sourceAddr, dialectMySQL)
+	if err != nil {
+		return err
+	}
+
+	cp.db = db
+	return nil
+}
+
+func (cp *ConnectorMySQL) sqlDB() (*sql.DB, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	return cp.db, nil
+}
+
+func (cp *ConnectorMySQL) sqlDialect() string {
+	return dialectMySQL
+}
+
+// sql.Open не устанавливает подключение, поэтому доступность БД проверяется отдельным запросом
+func (cp *ConnectorMySQL) ping(ctx context.Context) error {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return err
+		}
+	}
+
+	return cp.db.PingContext(ctx)
+}
+
+func (cp *ConnectorMySQL) createUser(ctx context.Context, username string, passwordHash string) (User, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return User{}, err
+		}
+	}
+
+	user := User{
+		Username:  username,
+		CreatedAt: time.Now().Format(timeLayout),
+	}
+	res, err := cp.db.ExecContext(ctx, "INSERT INTO E1_Users (username, created_at, password_hash) VALUE(?,?,?)",
+		user.Username, user.CreatedAt, passwordHash)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return User{}, fmt.Errorf("пользователь %s %w", username, ErrAlreadyExist)
+		}
+		return User{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	user.ID = uint64(id)
+
+	return user, nil
+}
+
+func (cp *ConnectorMySQL) getCredentials(ctx context.Context, username string) (User, string, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return User{}, "", err
+		}
+	}
+
+	user := User{}
+	var passwordHash sql.NullString
+	err := cp.db.QueryRowContext(ctx, "SELECT id, username, created_at, password_hash FROM E1_Users WHERE username = ?", username).
+		Scan(&user.ID, &user.Username, &user.CreatedAt, &passwordHash)
+	if err == sql.ErrNoRows {
+		return User{}, "", fmt.Errorf("пользователь %s %w", username, ErrNotExist)
+	}
+	if err != nil {
+		return User{}, "", err
+	}
+
+	return user, passwordHash.String, nil
+}
+
+func (cp *ConnectorMySQL) checkUsername(ctx context.Context, username string) (bool, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return false, err
+		}
+	}
+
+	rows, err := cp.db.QueryContext(ctx, "SELECT * FROM E1_Users WHERE username = ?", username)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (cp *ConnectorMySQL) checkUserID(ctx context.Context, user uint64) (bool, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return false, err
+		}
+	}
+
+	rows, err := cp.db.QueryContext(ctx, "SELECT * FROM E1_Users WHERE id = ?", user)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (cp *ConnectorMySQL) createChart(ctx context.Context, name string, ownerID uint64, users []uint64) (Chat, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return Chat{}, err
+		}
+	}
+
+	chat := Chat{
+		Name:      name,
+		Users:     uniqueIDs(append([]uint64{ownerID}, users...)),
+		Roles:     make(map[uint64]string),
+		CreatedAt: time.Now().Format(timeLayout),
+	}
+
+	tx, err := cp.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Chat{}, err
+	}
+	defer tx.Rollback()
+
+	if err := sqlCheckUsers(ctx, tx, dialectMySQL, chat.Users); err != nil {
+		return Chat{}, err
+	}
+
+	res, err := tx.ExecContext(ctx, "INSERT INTO E2_Chat (name, created_at) VALUE(?,?)", chat.Name, chat.CreatedAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return Chat{}, fmt.Errorf("чат %s %w", name, ErrAlreadyExist)
+		}
+		return Chat{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Chat{}, err
+	}
+	chat.ID = uint64(id)
+
+	for _, userID := range chat.Users {
+		chat.Roles[userID] = chatRole(ownerID, userID)
+		_, err := tx.ExecContext(ctx, "INSERT INTO E3_Chatroom (id_user, id_chat, role) VALUE (?,?,?)", userID, chat.ID, chat.Roles[userID])
+		if err != nil {
+			return Chat{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Chat{}, err
+	}
+
+	return chat, nil
+}
+
+func (cp *ConnectorMySQL) checkChartName(ctx context.Context, name string) (bool, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return false, err
+		}
+	}
+
+	rows, err := cp.db.QueryContext(ctx, "SELECT * FROM E2_Chat WHERE name = ?", name)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (cp *ConnectorMySQL) checkChartID(ctx context.Context, chat uint64) (bool, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return false, err
+		}
+	}
+
+	rows, err := cp.db.QueryContext(ctx, "SELECT * FROM E2_Chat WHERE id = ?", chat)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (cp *ConnectorMySQL) isMember(ctx context.Context, chat uint64, user uint64) (bool, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return false, err
+		}
+	}
+
+	rows, err := cp.db.QueryContext(ctx, "SELECT 1 FROM E3_Chatroom WHERE id_chat = ? AND id_user = ?", chat, user)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	return rows.Next(), rows.Err()
+}
+
+func (cp *ConnectorMySQL) getCharts(ctx context.Context, user uint64) ([]Chat, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	return sqlGetCharts(ctx, cp.db, dialectMySQL, user)
+}
+
+func (cp *ConnectorMySQL) sendMessage(ctx context.Context, chatID uint64, authorID uint64, text string, replyTo uint64,
+	attachments []Attachment) (Message, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return Message{}, err
+		}
+	}
+
+	return sqlSendMessage(ctx, cp.db, dialectMySQL, chatID, authorID, text, replyTo, attachments)
+}
+
+func (cp *ConnectorMySQL) getMessage(ctx context.Context, messageID uint64) (Message, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return Message{}, err
+		}
+	}
+
+	message := Message{}
+	err := sqlScanMessage(cp.db.QueryRowContext(ctx, "SELECT "+sqlMessageColumns(dialectMySQL)+" FROM E4_Messages WHERE id = ?", messageID), &message)
+	if err == sql.ErrNoRows {
+		return Message{}, fmt.Errorf("сообщение c id %d %w", messageID, ErrNotExist)
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	return message, nil
+}
+
+func (cp *ConnectorMySQL) getMessages(ctx context.Context, chatID uint64, page MessagePage) ([]Message, bool, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return sqlGetMessages(ctx, cp.db, dialectMySQL, "id_chat", chatID, page)
+}
+
+func (cp *ConnectorMySQL) getThread(ctx context.Context, rootID uint64, page MessagePage) ([]Message, bool, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return sqlGetMessages(ctx, cp.db, dialectMySQL, "id_thread_root", rootID, page)
+}
+
+func (cp *ConnectorMySQL) searchMessages(ctx context.Context, userID uint64, query SearchQuery, page MessagePage) ([]Message, bool, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return sqlSearchMessages(ctx, cp.db, dialectMySQL, userID, query, page)
+}
+
+func (cp *ConnectorMySQL) markRead(ctx context.Context, chatID uint64, userID uint64, messageID uint64) (uint64, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return 0, err
+		}
+	}
+
+	return sqlMarkRead(ctx, cp.db, dialectMySQL, chatID, userID, messageID)
+}
+
+func (cp *ConnectorMySQL) getReadCursors(ctx context.Context, chatID uint64) (map[uint64]uint64, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	return sqlGetReadCursors(ctx, cp.db, dialectMySQL, chatID)
+}
+
+func (cp *ConnectorMySQL) editMessage(ctx context.Context, messageID uint64, text string) (Message, error) {
+	return cp.reviseMessage(ctx, messageID, text, false)
+}
+
+func (cp *ConnectorMySQL) deleteMessage(ctx context.Context, messageID uint64) (Message, error) {
+	return cp.reviseMessage(ctx, messageID, "", true)
+}
+
+// Сохранение текущего текста сообщения в историю и замена текста. При удалении текст очищается
+func (cp *ConnectorMySQL) reviseMessage(ctx context.Context, messageID uint64, text string, deleted bool) (Message, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return Message{}, err
+		}
+	}
+
+	now := time.Now().Format(timeLayout)
+	tx, err := cp.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Message{}, err
+	}
+	defer tx.Rollback()
+
+	var current sql.NullString
+	err = tx.QueryRowContext(ctx, "SELECT text FROM E4_Messages WHERE id = ? AND deleted_at IS NULL FOR UPDATE", messageID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return Message{}, fmt.Errorf("сообщение c id %d %w", messageID, ErrNotExist)
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO E5_MessageRevisions (id_message, text, created_at) VALUE(?,?,?)", messageID, current.String, now)
+	if err != nil {
+		return Message{}, err
+	}
+
+	query := "UPDATE E4_Messages SET text = ?, edited_at = ? WHERE id = ?"
+	if deleted {
+		query = "UPDATE E4_Messages SET text = ?, deleted_at = ? WHERE id = ?"
+	}
+	if _, err := tx.ExecContext(ctx, query, text, now, messageID); err != nil {
+		return Message{}, err
+	}
+
+	message := Message{}
+	err = sqlScanMessage(tx.QueryRowContext(ctx, "SELECT "+sqlMessageColumns(dialectMySQL)+" FROM E4_Messages WHERE id = ?", messageID), &message)
+	if err != nil {
+		return Message{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Message{}, err
+	}
+
+	return message, nil
+}
+
+func (cp *ConnectorMySQL) getRevisions(ctx context.Context, messageID uint64) ([]MessageRevision, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	return sqlGetRevisions(ctx, cp.db, dialectMySQL, messageID)
+}
+
+func (cp *ConnectorMySQL) addMembers(ctx context.Context, chatID uint64, actorID uint64, users []uint64) ([]Message, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	return sqlAddMembers(ctx, cp.db, dialectMySQL, chatID, actorID, users)
+}
+
+func (cp *ConnectorMySQL) removeMember(ctx context.Context, chatID uint64, actorID uint64, userID uint64) (Message, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return Message{}, err
+		}
+	}
+
+	return sqlRemoveMember(ctx, cp.db, dialectMySQL, chatID, actorID, userID)
+}
+
+func (cp *ConnectorMySQL) getRole(ctx context.Context, chat uint64, user uint64) (string, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return "", err
+		}
+	}
+
+	return sqlGetRole(ctx, cp.db, dialectMySQL, chat, user)
+}
+
+func (cp *ConnectorMySQL) setRole(ctx context.Context, chat uint64, user uint64, role string) error {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return err
+		}
+	}
+
+	return sqlSetRole(ctx, cp.db, dialectMySQL, chat, user, role)
+}
+
+func (cp *ConnectorMySQL) addReaction(ctx context.Context, messageID uint64, userID uint64, reaction string) error {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return err
+		}
+	}
+
+	return sqlAddReaction(ctx, cp.db, dialectMySQL, messageID, userID, reaction)
+}
+
+func (cp *ConnectorMySQL) removeReaction(ctx context.Context, messageID uint64, userID uint64, reaction string) error {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return err
+		}
+	}
+
+	return sqlRemoveReaction(ctx, cp.db, dialectMySQL, messageID, userID, reaction)
+}
+
+func (cp *ConnectorMySQL) getReactions(ctx context.Context, messageIDs []uint64, userID uint64) (map[uint64][]Reaction, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	return sqlGetReactions(ctx, cp.db, dialectMySQL, messageIDs, userID)
+}
+
+func (cp *ConnectorMySQL) getAttachment(ctx context.Context, attachmentID uint64) (Attachment, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return Attachment{}, err
+		}
+	}
+
+	return sqlGetAttachment(ctx, cp.db, dialectMySQL, attachmentID)
+}
+
+func (cp *ConnectorMySQL) getAttachments(ctx context.Context, messageIDs []uint64) (map[uint64][]Attachment, error) {
+	if cp.db == nil {
+		if err := cp.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	return sqlGetAttachments(ctx, cp.db, dialectMySQL, messageIDs)
+}
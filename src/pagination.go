@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// Ограничения размера страницы сообщений
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// Ошибка разбора курсора страницы
+var ErrInvalidCursor = errors.New("некорректный курсор")
+
+// Направление выборки страницы сообщений
+type PageDirection int
+
+const (
+	PageForward  PageDirection = iota // от ранних сообщений к поздним
+	PageBackward                      // от поздних сообщений к ранним
+)
+
+// MessageCursor - Позиция в истории чата, ключ (created_at, id) сообщения
+type MessageCursor struct {
+	CreatedAt string `json:"t"`
+	ID        uint64 `json:"i"`
+}
+
+// Позиция курсора находится позже сообщения
+func (c MessageCursor) after(message Message) bool {
+	if message.CreatedAt != c.CreatedAt {
+		return message.CreatedAt < c.CreatedAt
+	}
+	return message.ID < c.ID
+}
+
+// Позиция курсора находится раньше сообщения
+func (c MessageCursor) before(message Message) bool {
+	if message.CreatedAt != c.CreatedAt {
+		return message.CreatedAt > c.CreatedAt
+	}
+	return message.ID > c.ID
+}
+
+// MessagePage - Параметры выборки страницы сообщений по ключу (created_at, id)
+type MessagePage struct {
+	Limit     int            // количество сообщений на странице
+	Direction PageDirection  // направление выборки
+	Cursor    *MessageCursor // позиция, после которой в направлении выборки начинается страница; nil - с начала истории (с конца для PageBackward)
+}
+
+// Курсор, который передается клиенту для получения следующей страницы
+type pageToken struct {
+	MessageCursor
+	Backward bool `json:"b,omitempty"`
+}
+
+// Кодирование непрозрачного курсора следующей страницы
+func encodePageCursor(cursor MessageCursor, direction PageDirection) string {
+	data, _ := json.Marshal(pageToken{MessageCursor: cursor, Backward: direction == PageBackward})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Разбор непрозрачного курсора
+func decodePageCursor(value string) (MessageCursor, PageDirection, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return MessageCursor{}, PageForward, ErrInvalidCursor
+	}
+
+	token := pageToken{}
+	if err := json.Unmarshal(data, &token); err != nil || token.ID == 0 {
+		return MessageCursor{}, PageForward, ErrInvalidCursor
+	}
+
+	if token.Backward {
+		return token.MessageCursor, PageBackward, nil
+	}
+	return token.MessageCursor, PageForward, nil
+}
+
+// Условие и порядок keyset выборки для SQL коннекторов.
+// Плейсхолдеры курсора нумеруются для PostgreSQL начиная с start
+func sqlPageClause(dialect string, page MessagePage, start int) (string, []interface{}, string) {
+	order := " ORDER BY created_at ASC, id ASC"
+	op := ">"
+	if page.Direction == PageBackward {
+		order = " ORDER BY created_at DESC, id DESC"
+		op = "<"
+	}
+
+	if page.Cursor == nil {
+		return "", nil, order
+	}
+
+	p := func(i int) string {
+		return sqlPlaceholders(dialect, start+i, 1)
+	}
+	where := " AND (created_at " + op + " " + p(0) + " OR (created_at = " + p(1) + " AND id " + op + " " + p(2) + "))"
+	args := []interface{}{page.Cursor.CreatedAt, page.Cursor.CreatedAt, page.Cursor.ID}
+
+	return where, args, order
+}
+
+// Приведение выборки limit+1 строк к странице в хронологическом порядке и признаку наличия продолжения
+func finishPage(messages []Message, page MessagePage) ([]Message, bool) {
+	hasMore := len(messages) > page.Limit
+	if hasMore {
+		messages = messages[:page.Limit]
+	}
+
+	if page.Direction == PageBackward {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+
+	return messages, hasMore
+}
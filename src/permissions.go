@@ -0,0 +1,59 @@
+package main
+
+// Роли участников чата
+const (
+	RoleOwner    = "owner"    // создатель чата, единственный в чате
+	RoleAdmin    = "admin"    // управляет участниками и модерирует сообщения
+	RoleMember   = "member"   // пишет в чат, роль по умолчанию
+	RoleReadOnly = "readonly" // только читает историю чата
+)
+
+// Действия в чате, требующие прав
+type Permission int
+
+const (
+	PermPost          Permission = iota // отправка, изменение и удаление своих сообщений
+	PermManageMembers                   // добавление и исключение участников
+	PermManageRoles                     // назначение ролей участникам
+	PermModerate                        // удаление чужих сообщений и просмотр их истории
+)
+
+// Матрица прав ролей
+var rolePermissions = map[string]map[Permission]bool{
+	RoleOwner:    {PermPost: true, PermManageMembers: true, PermManageRoles: true, PermModerate: true},
+	RoleAdmin:    {PermPost: true, PermManageMembers: true, PermModerate: true},
+	RoleMember:   {PermPost: true},
+	RoleReadOnly: {},
+}
+
+// Старшинство ролей, участник может исключать только участников с младшей ролью
+var roleRanks = map[string]int{
+	RoleOwner:    3,
+	RoleAdmin:    2,
+	RoleMember:   1,
+	RoleReadOnly: 0,
+}
+
+// Роль участника нового чата
+func chatRole(ownerID uint64, userID uint64) string {
+	if userID == ownerID {
+		return RoleOwner
+	}
+
+	return RoleMember
+}
+
+// Роль разрешает действие
+func roleCan(role string, permission Permission) bool {
+	return rolePermissions[role][permission]
+}
+
+// Роль старше другой роли
+func roleOutranks(role string, other string) bool {
+	return roleRanks[role] > roleRanks[other]
+}
+
+// Роль может быть назначена участнику через API. Владелец назначается только при создании чата
+func assignableRole(role string) bool {
+	return role == RoleAdmin || role == RoleMember || role == RoleReadOnly
+}
@@ -1,24 +1,29 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
+
 	"github.com/kelseyhightower/envconfig"
-	"time"
+	_ "github.com/lib/pq"
 )
-import "database/sql"
-import _ "github.com/go-sql-driver/mysql"
 
-type ConfigMySQL struct {
-	Login    string `default:"root"`
+// Формат времени создания сущностей в запросах к PostgreSQL, совпадает с timeLayout
+const timeFormatPostgres = "YYYY-MM-DD HH24:MI:SS"
+
+type ConfigPostgres struct {
+	Login    string `default:"postgres"`
 	Password string `default:"password"`
 	Host     string `default:"127.0.0.1"`
-	Port     string `default:"3306"`
+	Port     string `default:"5432"`
 	Database string `default:"chat"`
+	SSLMode  string `split_words:"true" default:"disable"`
 }
 
-func initConfigMySQL() (*ConfigMySQL, error) {
-	config := &ConfigMySQL{}
-	err := envconfig.Process("MySQL", config)
+func initConfigPostgres() (*ConfigPostgres, error) {
+	config := &ConfigPostgres{}
+	err := envconfig.Process("Postgres", config)
 	if err != nil {
 		return nil, err
 	}
@@ -26,14 +31,16 @@ func initConfigMySQL() (*ConfigMySQL, error) {
 	return config, nil
 }
 
-type ConnectorMySQL struct {
-	config *ConfigMySQL
+// Коннектор к PostgreSQL, схема описана в db/install_db_postgres.sql
+type ConnectorPostgres struct {
+	config *ConfigPostgres
 	db     *sql.DB
 }
 
-func (cp *ConnectorMySQL) connect() error {
-	sourceAddr := fmt.Sprintf("%s:%s@/%s", cp.config.Login, cp.config.Password, cp.config.Database)
-	db, err := sql.Open("mysql", sourceAddr)
+func (cp *ConnectorPostgres) connect() error {
+	sourceAddr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		cp.config.Host, cp.config.Port, cp.config.Login, cp.config.Password, cp.config.Database, cp.config.SSLMode)
+	db, err := openTracedDB("postgres", sourceAddr, dialectPostgres)
 	if err != nil {
 		return err
 	}
@@ -42,239 +49,246 @@ func (cp *ConnectorMySQL) connect() error {
 	return nil
 }
 
-func (cp *ConnectorMySQL) createUser(username string) (User, error) {
-	if cp.db == nil {
-		if err := cp.connect(); err != nil {
-			return User{}, err
-		}
-	}
-	_, err := cp.db.Query("INSERT INTO E1_Users (username, created_at) VALUE(?,?)", username, time.Now().String())
-	if err != nil {
-		return User{}, err
-	}
+func (cp *ConnectorPostgres) sqlDB() (*sql.DB, error) {
+	return cp.db, nil
+}
 
-	user := User{}
-	rows, err := cp.db.Query("SELECT * FROM E1_Users WHERE username = ?", username)
-	if err != nil {
-		return User{}, err
-	}
+func (cp *ConnectorPostgres) sqlDialect() string {
+	return dialectPostgres
+}
 
-	for rows.Next() {
-		err = rows.Scan(&user.ID, &user.Username, &user.CreatedAt)
-		if err != nil {
-			return User{}, err
+func (cp *ConnectorPostgres) ping(ctx context.Context) error {
+	return cp.db.PingContext(ctx)
+}
+
+func (cp *ConnectorPostgres) createUser(ctx context.Context, username string, passwordHash string) (User, error) {
+	user := User{Username: username}
+	err := cp.db.QueryRowContext(ctx, `INSERT INTO E1_Users (username, created_at, password_hash) VALUES ($1, now(), $2)
+RETURNING id, to_char(created_at, '`+timeFormatPostgres+`')`, username, passwordHash).Scan(&user.ID, &user.CreatedAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return User{}, fmt.Errorf("пользователь %s %w", username, ErrAlreadyExist)
 		}
-		break
+		return User{}, err
 	}
-	rows.Close()
 
 	return user, nil
 }
 
-func (cp *ConnectorMySQL) checkUsername(username string) (bool, error) {
-	if cp.db == nil {
-		if err := cp.connect(); err != nil {
-			return false, err
-		}
+func (cp *ConnectorPostgres) getCredentials(ctx context.Context, username string) (User, string, error) {
+	user := User{}
+	var passwordHash sql.NullString
+	err := cp.db.QueryRowContext(ctx, `SELECT id, username, to_char(created_at, '`+timeFormatPostgres+`'), password_hash
+FROM E1_Users WHERE username = $1`, username).Scan(&user.ID, &user.Username, &user.CreatedAt, &passwordHash)
+	if err == sql.ErrNoRows {
+		return User{}, "", fmt.Errorf("пользователь %s %w", username, ErrNotExist)
 	}
-
-	rows, err := cp.db.Query("SELECT * FROM E1_Users WHERE username = ?", username)
 	if err != nil {
-		return false, err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		return true, nil
+		return User{}, "", err
 	}
 
-	return false, nil
+	return user, passwordHash.String, nil
 }
 
-func (cp *ConnectorMySQL) checkUserID(user uint64) (bool, error) {
-	if cp.db == nil {
-		if err := cp.connect(); err != nil {
-			return false, err
-		}
-	}
-
-	rows, err := cp.db.Query("SELECT * FROM E1_Users WHERE id = ?", user)
-	if err != nil {
-		return false, err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		return true, nil
-	}
+func (cp *ConnectorPostgres) checkUsername(ctx context.Context, username string) (bool, error) {
+	return cp.exists(ctx, "SELECT 1 FROM E1_Users WHERE username = $1", username)
+}
 
-	return false, nil
+func (cp *ConnectorPostgres) checkUserID(ctx context.Context, user uint64) (bool, error) {
+	return cp.exists(ctx, "SELECT 1 FROM E1_Users WHERE id = $1", user)
 }
 
-func (cp *ConnectorMySQL) createChart(name string, users []uint64) (Chat, error) {
-	if cp.db == nil {
-		if err := cp.connect(); err != nil {
-			return Chat{}, err
-		}
-	}
-	_, err := cp.db.Query("INSERT INTO E2_Chat (name, created_at) VALUE(?,?)", name, time.Now().String())
+func (cp *ConnectorPostgres) createChart(ctx context.Context, name string, ownerID uint64, users []uint64) (Chat, error) {
+	chat := Chat{Name: name, Users: uniqueIDs(append([]uint64{ownerID}, users...)), Roles: make(map[uint64]string)}
+
+	tx, err := cp.db.BeginTx(ctx, nil)
 	if err != nil {
 		return Chat{}, err
 	}
+	defer tx.Rollback()
 
-	chat := Chat{}
-	rows, err := cp.db.Query("SELECT * FROM E2_Chat WHERE name = ?", name)
-	if err != nil {
+	if err := sqlCheckUsers(ctx, tx, dialectPostgres, chat.Users); err != nil {
 		return Chat{}, err
 	}
 
-	defer rows.Close()
-	for rows.Next() {
-		err = rows.Scan(&chat.ID, &chat.Name, &chat.CreatedAt)
-		break
+	err = tx.QueryRowContext(ctx, `INSERT INTO E2_Chat (name, created_at) VALUES ($1, now())
+RETURNING id, to_char(created_at, '`+timeFormatPostgres+`')`, name).Scan(&chat.ID, &chat.CreatedAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return Chat{}, fmt.Errorf("чат %s %w", name, ErrAlreadyExist)
+		}
+		return Chat{}, err
 	}
 
-	for _, userID := range users {
-		_, err := cp.db.Query("INSERT INTO E3_Chatroom (id_user, id_chat) VALUE (?,?)", userID, chat.ID)
+	for _, userID := range chat.Users {
+		chat.Roles[userID] = chatRole(ownerID, userID)
+		_, err := tx.ExecContext(ctx, "INSERT INTO E3_Chatroom (id_user, id_chat, role) VALUES ($1, $2, $3)", userID, chat.ID, chat.Roles[userID])
 		if err != nil {
 			return Chat{}, err
 		}
 	}
 
+	if err := tx.Commit(); err != nil {
+		return Chat{}, err
+	}
+
 	return chat, nil
 }
 
-func (cp *ConnectorMySQL) checkChartName(name string) (bool, error) {
-	if cp.db == nil {
-		if err := cp.connect(); err != nil {
-			return false, err
-		}
-	}
+func (cp *ConnectorPostgres) checkChartName(ctx context.Context, name string) (bool, error) {
+	return cp.exists(ctx, "SELECT 1 FROM E2_Chat WHERE name = $1", name)
+}
 
-	rows, err := cp.db.Query("SELECT * FROM E2_Chat WHERE name = ?", name)
-	if err != nil {
-		return false, err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		return true, nil
-	}
+func (cp *ConnectorPostgres) checkChartID(ctx context.Context, chat uint64) (bool, error) {
+	return cp.exists(ctx, "SELECT 1 FROM E2_Chat WHERE id = $1", chat)
+}
 
-	return false, nil
+func (cp *ConnectorPostgres) isMember(ctx context.Context, chat uint64, user uint64) (bool, error) {
+	return cp.exists(ctx, "SELECT 1 FROM E3_Chatroom WHERE id_chat = $1 AND id_user = $2", chat, user)
 }
 
-func (cp *ConnectorMySQL) checkChartID(chat uint64) (bool, error) {
-	if cp.db == nil {
-		if err := cp.connect(); err != nil {
-			return false, err
-		}
-	}
+// Чаты пользователя отсортированы по времени последнего сообщения (от позднего к раннему),
+// чаты без сообщений сортируются по времени создания
+func (cp *ConnectorPostgres) getCharts(ctx context.Context, user uint64) ([]Chat, error) {
+	return sqlGetCharts(ctx, cp.db, dialectPostgres, user)
+}
 
-	rows, err := cp.db.Query("SELECT * FROM E2_Chat WHERE id = ?", chat)
-	if err != nil {
-		return false, err
+func (cp *ConnectorPostgres) sendMessage(ctx context.Context, chatID uint64, authorID uint64, text string, replyTo uint64,
+	attachments []Attachment) (Message, error) {
+	return sqlSendMessage(ctx, cp.db, dialectPostgres, chatID, authorID, text, replyTo, attachments)
+}
+
+func (cp *ConnectorPostgres) getMessage(ctx context.Context, messageID uint64) (Message, error) {
+	message := Message{}
+	err := sqlScanMessage(cp.db.QueryRowContext(ctx, "SELECT "+sqlMessageColumns(dialectPostgres)+" FROM E4_Messages WHERE id = $1", messageID), &message)
+	if err == sql.ErrNoRows {
+		return Message{}, fmt.Errorf("сообщение c id %d %w", messageID, ErrNotExist)
 	}
-	defer rows.Close()
-	for rows.Next() {
-		return true, nil
+	if err != nil {
+		return Message{}, err
 	}
 
-	return false, nil
+	return message, nil
 }
 
-func (cp *ConnectorMySQL) getCharts(user uint64) ([]Chat, error) {
-	querry := `SELECT
-E2_Chat.id,
-E2_Chat.name
-FROM E2_Chat
-JOIN E3_Chatroom E3C on E2_Chat.id = E3C.id_chat
-JOIN
-    (SELECT id_chat, created_at FROM E4_Messages ORDER BY created_at DESC LIMIT 1) as E4M on E2_Chat.id = E4M.id_chat
-WHERE E3C.id_user = ?`
-
-	var result []Chat
+func (cp *ConnectorPostgres) getMessages(ctx context.Context, chatID uint64, page MessagePage) ([]Message, bool, error) {
+	return sqlGetMessages(ctx, cp.db, dialectPostgres, "id_chat", chatID, page)
+}
 
-	rows, err := cp.db.Query(querry, user)
-	if err != nil {
-		return nil, err
-	}
+func (cp *ConnectorPostgres) getThread(ctx context.Context, rootID uint64, page MessagePage) ([]Message, bool, error) {
+	return sqlGetMessages(ctx, cp.db, dialectPostgres, "id_thread_root", rootID, page)
+}
 
-	defer rows.Close()
-	for rows.Next() {
-		chat := Chat{}
-		err = rows.Scan(&chat.ID, &chat.Name)
-		if err != nil {
-			return nil, err
-		}
+func (cp *ConnectorPostgres) searchMessages(ctx context.Context, userID uint64, query SearchQuery, page MessagePage) ([]Message, bool, error) {
+	return sqlSearchMessages(ctx, cp.db, dialectPostgres, userID, query, page)
+}
 
-		rowsUserID, err := cp.db.Query("SELECT id_user FROM E3_Chatroom WHERE id_chat = ?", chat.ID)
-		if err != nil {
-			return nil, err
-		}
+func (cp *ConnectorPostgres) markRead(ctx context.Context, chatID uint64, userID uint64, messageID uint64) (uint64, error) {
+	return sqlMarkRead(ctx, cp.db, dialectPostgres, chatID, userID, messageID)
+}
 
-		for rowsUserID.Next() {
-			var userID uint64
-			err = rowsUserID.Scan(&userID)
-			if err != nil {
-				return nil, err
-			}
-			chat.Users = append(chat.Users, userID)
-		}
+func (cp *ConnectorPostgres) getReadCursors(ctx context.Context, chatID uint64) (map[uint64]uint64, error) {
+	return sqlGetReadCursors(ctx, cp.db, dialectPostgres, chatID)
+}
 
-		result = append(result, chat)
-	}
+func (cp *ConnectorPostgres) editMessage(ctx context.Context, messageID uint64, text string) (Message, error) {
+	return cp.reviseMessage(ctx, messageID, text, false)
+}
 
-	return result, nil
+func (cp *ConnectorPostgres) deleteMessage(ctx context.Context, messageID uint64) (Message, error) {
+	return cp.reviseMessage(ctx, messageID, "", true)
 }
 
-func (cp *ConnectorMySQL) sendMessage(chatID uint64, authorID uint64, text string) (Message, error) {
-	if cp.db == nil {
-		if err := cp.connect(); err != nil {
-			return Message{}, err
-		}
+// Сохранение текущего текста сообщения в историю и замена текста. При удалении текст очищается
+func (cp *ConnectorPostgres) reviseMessage(ctx context.Context, messageID uint64, text string, deleted bool) (Message, error) {
+	tx, err := cp.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Message{}, err
+	}
+	defer tx.Rollback()
+
+	var current sql.NullString
+	err = tx.QueryRowContext(ctx, "SELECT text FROM E4_Messages WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", messageID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return Message{}, fmt.Errorf("сообщение c id %d %w", messageID, ErrNotExist)
+	}
+	if err != nil {
+		return Message{}, err
 	}
 
-	createTime := time.Now().String()
-	_, err := cp.db.Query("INSERT INTO E4_Messages(id_chat, id_user, text , created_at) VALUE(?,?,?,?)",
-		chatID, authorID, text, createTime)
+	_, err = tx.ExecContext(ctx, "INSERT INTO E5_MessageRevisions (id_message, text, created_at) VALUES ($1, $2, LOCALTIMESTAMP(0))", messageID, current.String)
 	if err != nil {
 		return Message{}, err
 	}
 
-	rows, err := cp.db.Query("SELECT * FROM E4_Messages WHERE id_chat = ? AND id_user = ? AND created_at=?",
-		chatID, authorID, createTime)
+	query := "UPDATE E4_Messages SET text = $1, edited_at = LOCALTIMESTAMP(0) WHERE id = $2"
+	if deleted {
+		query = "UPDATE E4_Messages SET text = $1, deleted_at = LOCALTIMESTAMP(0) WHERE id = $2"
+	}
+	if _, err := tx.ExecContext(ctx, query, text, messageID); err != nil {
+		return Message{}, err
+	}
 
 	message := Message{}
-	defer rows.Close()
-	for rows.Next() {
-		err = rows.Scan(&message.ID, &message.Chat, &message.Author, &message.CreatedAt)
-		break
+	err = sqlScanMessage(tx.QueryRowContext(ctx, "SELECT "+sqlMessageColumns(dialectPostgres)+" FROM E4_Messages WHERE id = $1", messageID), &message)
+	if err != nil {
+		return Message{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Message{}, err
 	}
 
 	return message, nil
 }
 
-func (cp *ConnectorMySQL) getMessages(chatID uint64) ([]Message, error) {
-	if cp.db == nil {
-		if err := cp.connect(); err != nil {
-			return nil, err
-		}
-	}
+func (cp *ConnectorPostgres) getRevisions(ctx context.Context, messageID uint64) ([]MessageRevision, error) {
+	return sqlGetRevisions(ctx, cp.db, dialectPostgres, messageID)
+}
+
+func (cp *ConnectorPostgres) addMembers(ctx context.Context, chatID uint64, actorID uint64, users []uint64) ([]Message, error) {
+	return sqlAddMembers(ctx, cp.db, dialectPostgres, chatID, actorID, users)
+}
+
+func (cp *ConnectorPostgres) removeMember(ctx context.Context, chatID uint64, actorID uint64, userID uint64) (Message, error) {
+	return sqlRemoveMember(ctx, cp.db, dialectPostgres, chatID, actorID, userID)
+}
+
+func (cp *ConnectorPostgres) getRole(ctx context.Context, chat uint64, user uint64) (string, error) {
+	return sqlGetRole(ctx, cp.db, dialectPostgres, chat, user)
+}
+
+func (cp *ConnectorPostgres) setRole(ctx context.Context, chat uint64, user uint64, role string) error {
+	return sqlSetRole(ctx, cp.db, dialectPostgres, chat, user, role)
+}
 
-	var result []Message
-	rows, err := cp.db.Query("SELECT * FROM E4_Messages WHERE id_chat = ? ORDER BY created_at ASC",
-		chatID)
+func (cp *ConnectorPostgres) addReaction(ctx context.Context, messageID uint64, userID uint64, reaction string) error {
+	return sqlAddReaction(ctx, cp.db, dialectPostgres, messageID, userID, reaction)
+}
+
+func (cp *ConnectorPostgres) removeReaction(ctx context.Context, messageID uint64, userID uint64, reaction string) error {
+	return sqlRemoveReaction(ctx, cp.db, dialectPostgres, messageID, userID, reaction)
+}
+
+func (cp *ConnectorPostgres) getReactions(ctx context.Context, messageIDs []uint64, userID uint64) (map[uint64][]Reaction, error) {
+	return sqlGetReactions(ctx, cp.db, dialectPostgres, messageIDs, userID)
+}
+
+func (cp *ConnectorPostgres) getAttachment(ctx context.Context, attachmentID uint64) (Attachment, error) {
+	return sqlGetAttachment(ctx, cp.db, dialectPostgres, attachmentID)
+}
+
+func (cp *ConnectorPostgres) getAttachments(ctx context.Context, messageIDs []uint64) (map[uint64][]Attachment, error) {
+	return sqlGetAttachments(ctx, cp.db, dialectPostgres, messageIDs)
+}
+
+// Проверка существования хотя бы одной строки в выборке
+func (cp *ConnectorPostgres) exists(ctx context.Context, query string, args ...interface{}) (bool, error) {
+	rows, err := cp.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 	defer rows.Close()
 
-	for rows.Next() {
-		chat := Message{}
-		err = rows.Scan(&chat.ID, &chat.Chat, &chat.Author, &chat.Text, &chat.CreatedAt)
-		if err != nil {
-			return nil, err
-		}
-		result = append(result, chat)
-	}
-
-	return result, nil
+	return rows.Next(), rows.Err()
 }
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/rs/zerolog/log"
+)
+
+// Политики ограничения частоты запросов по умолчанию
+const defaultRateLimits = "/users/add=10/m,/users/login=10/m,/messages/add=5/s:20,/messages/upload=1/s:5,*=50/s:100"
+
+// Маршрут политики, которая применяется к маршрутам без собственной политики
+const defaultRateRoute = "*"
+
+// Пауза между удалениями заполнившихся корзин локального ограничителя
+const rateSweepInterval = time.Minute
+
+// RatePolicy - Политика ограничения частоты: корзина на burst запросов, которая пополняется
+// со скоростью rate запросов в секунду. Запрос забирает из корзины один токен
+type RatePolicy struct {
+	Route string  // шаблон пути маршрута или defaultRateRoute
+	Rate  float64 // пополнение корзины, токенов в секунду
+	Burst int     // емкость корзины
+}
+
+// Разбор политик вида "<маршрут>=<число>/<период>[:<емкость>]" через запятую, например
+// "/messages/add=5/s:20,*=50/s". Период - s, m, h или длительность Go, емкость по умолчанию равна числу.
+// Значение off отключает ограничение
+func parseRatePolicies(spec string) (map[string]RatePolicy, error) {
+	policies := make(map[string]RatePolicy)
+	if strings.TrimSpace(spec) == "off" {
+		return policies, nil
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("недопустимая политика ограничения частоты %q", item)
+		}
+		route, limit := parts[0], parts[1]
+
+		burstValue := ""
+		if burstParts := strings.SplitN(limit, ":", 2); len(burstParts) == 2 {
+			limit, burstValue = burstParts[0], burstParts[1]
+		}
+		parts = strings.SplitN(limit, "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("недопустимая политика ограничения частоты %q", item)
+		}
+		countValue, periodValue := parts[0], parts[1]
+
+		count, err := strconv.Atoi(countValue)
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("недопустимое число запросов в политике %q", item)
+		}
+		if periodValue == "s" || periodValue == "m" || periodValue == "h" {
+			periodValue = "1" + periodValue
+		}
+		period, err := time.ParseDuration(periodValue)
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("недопустимый период в политике %q", item)
+		}
+		burst := count
+		if burstValue != "" {
+			burst, err = strconv.Atoi(burstValue)
+			if err != nil || burst <= 0 {
+				return nil, fmt.Errorf("недопустимая емкость в политике %q", item)
+			}
+		}
+
+		policies[route] = RatePolicy{
+			Route: route,
+			Rate:  float64(count) / period.Seconds(),
+			Burst: burst,
+		}
+	}
+
+	return policies, nil
+}
+
+// RateLimiter - Хранилище корзин ограничения частоты запросов
+type RateLimiter interface {
+	// Забирает токен из корзины key. Если корзина пуста, возвращает время до появления токена
+	Allow(ctx context.Context, key string, policy RatePolicy) (bool, time.Duration, error)
+}
+
+// Создание хранилища корзин по типу
+func NewRateLimiter(storeType string) (RateLimiter, error) {
+	switch strings.ToLower(storeType) {
+	case "local":
+		return NewLocalRateLimiter(), nil
+	case "redis":
+		client, err := newRedisClient()
+		if err != nil {
+			return nil, err
+		}
+
+		return NewRedisRateLimiter(client), nil
+	default:
+		return nil, fmt.Errorf("неизвестное хранилище ограничения частоты %s", storeType)
+	}
+}
+
+// Корзины в памяти процесса. Ограничения действуют для каждой копии сервиса отдельно
+type LocalRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	policy  RatePolicy
+}
+
+func NewLocalRateLimiter() *LocalRateLimiter {
+	return &LocalRateLimiter{
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (ll *LocalRateLimiter) Allow(ctx context.Context, key string, policy RatePolicy) (bool, time.Duration, error) {
+	now := time.Now()
+
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	ll.sweep(now)
+
+	bucket, ok := ll.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(policy.Burst), updated: now, policy: policy}
+		ll.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(policy.Burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*policy.Rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return false, secondsDuration((1 - bucket.tokens) / policy.Rate), nil
+	}
+	bucket.tokens--
+
+	return true, 0, nil
+}
+
+// Удаление корзин, которые успели заполниться: они не отличаются от новых
+func (ll *LocalRateLimiter) sweep(now time.Time) {
+	if now.Sub(ll.lastSweep) < rateSweepInterval {
+		return
+	}
+	ll.lastSweep = now
+
+	for key, bucket := range ll.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*bucket.policy.Rate >= float64(bucket.policy.Burst) {
+			delete(ll.buckets, key)
+		}
+	}
+}
+
+// Корзина пополняется и забирается атомарно скриптом по времени сервера Redis,
+// поэтому ограничения общие для всех копий сервиса и не зависят от расхождения их часов.
+// Корзина удаляется, когда успевает заполниться
+var rateLimitScript = redis.NewScript(`
+redis.replicate_commands()
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1]) or burst
+local updated = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = (1 - tokens) / rate
+end
+redis.call('HMSET', KEYS[1], 'tokens', tokens, 'updated', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000))
+return {allowed, tostring(wait)}
+`)
+
+// Префикс ключей корзин в Redis
+const rateLimitKeyPrefix = "ratelimit:"
+
+// Корзины в Redis, общие для всех копий сервиса
+type RedisRateLimiter struct {
+	client *redis.Client
+}
+
+func NewRedisRateLimiter(client *redis.Client) *RedisRateLimiter {
+	return &RedisRateLimiter{client: client}
+}
+
+func (rl *RedisRateLimiter) Allow(ctx context.Context, key string, policy RatePolicy) (bool, time.Duration, error) {
+	result, err := rateLimitScript.Run(rl.client.WithContext(ctx), []string{rateLimitKeyPrefix + key},
+		policy.Rate, policy.Burst).Result()
+	if err != nil {
+		return false, 0, err
+	}
+
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, fmt.Errorf("неожиданный ответ скрипта ограничения частоты %v", result)
+	}
+	allowed, _ := values[0].(int64)
+	waitValue, _ := values[1].(string)
+	wait, err := strconv.ParseFloat(waitValue, 64)
+	if err != nil {
+		return false, 0, fmt.Errorf("неожиданный ответ скрипта ограничения частоты %v", result)
+	}
+
+	return allowed == 1, secondsDuration(wait), nil
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Вызывающий, по которому считаются запросы: пользователь из действительного токена доступа,
+// иначе адрес клиента
+func (s *Service) rateLimitCaller(r *http.Request) string {
+	if userID, err := s.tokens.Parse(bearerToken(r)); err == nil {
+		return "user:" + strconv.FormatUint(userID, 10)
+	}
+
+	return "ip:" + clientAddr(r, s.config.TrustedProxies)
+}
+
+// Адрес клиента. За trustedProxies прокси адрес клиента берется из X-Forwarded-For: каждый прокси
+// дописывает в конец заголовка адрес, с которого к нему пришел запрос, поэтому значения левее
+// адреса, записанного первым доверенным прокси, мог подставить сам клиент
+func clientAddr(r *http.Request, trustedProxies int) string {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if trustedProxies <= 0 {
+		return addr
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, value := range strings.Split(header, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				forwarded = append(forwarded, value)
+			}
+		}
+	}
+	// Адрес последнего прокси - RemoteAddr, остальные доверенные прокси записаны в конце заголовка
+	if index := len(forwarded) - trustedProxies; index >= 0 {
+		return forwarded[index]
+	}
+	if len(forwarded) > 0 {
+		return forwarded[0]
+	}
+
+	return addr
+}
+
+// Миделвара ограничения частоты запросов. Корзина выбирается по политике маршрута и вызывающему;
+// маршруты без собственной политики делят одну корзину политики по умолчанию.
+// Если хранилище корзин недоступно, запросы пропускаются
+func (s *Service) RateLimitMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		policy, ok := s.ratePolicies[route]
+		if !ok {
+			policy, ok = s.ratePolicies[defaultRateRoute]
+		}
+		if !ok || serviceRoutes[route] {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, retryAfter, err := s.limiter.Allow(r.Context(), policy.Route+"|"+s.rateLimitCaller(r), policy)
+		if err != nil {
+			log.Warn().Err(err).Msg("Не удалось проверить ограничение частоты запросов")
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, TooManyRequests, "Превышена частота запросов")
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+func TestClientAddr(t *testing.T) {
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		forwarded      []string
+		trustedProxies int
+		want           string
+	}{
+		{"без прокси", "10.0.0.1:1234", nil, 0, "10.0.0.1"},
+		{"без доверенных прокси заголовок не учитывается", "10.0.0.1:1234", []string{"1.1.1.1"}, 0, "10.0.0.1"},
+		{"адрес без порта", "10.0.0.1", nil, 0, "10.0.0.1"},
+		{"один прокси", "10.0.0.1:1234", []string{"1.1.1.1"}, 1, "1.1.1.1"},
+		{"подставленный клиентом адрес", "10.0.0.1:1234", []string{"6.6.6.6, 1.1.1.1"}, 1, "1.1.1.1"},
+		{"два прокси", "10.0.0.1:1234", []string{"6.6.6.6, 1.1.1.1, 10.0.0.2"}, 2, "1.1.1.1"},
+		{"несколько заголовков", "10.0.0.1:1234", []string{"6.6.6.6", "1.1.1.1, 10.0.0.2"}, 2, "1.1.1.1"},
+		{"пустые значения", "10.0.0.1:1234", []string{" , 1.1.1.1 ,"}, 1, "1.1.1.1"},
+		{"адресов меньше, чем прокси", "10.0.0.1:1234", []string{"1.1.1.1"}, 2, "1.1.1.1"},
+		{"без заголовка за прокси", "10.0.0.1:1234", nil, 1, "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = test.remoteAddr
+			for _, value := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			if addr := clientAddr(r, test.trustedProxies); addr != test.want {
+				t.Fatalf("адрес клиента %q, ожидался %q", addr, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRatePolicies(t *testing.T) {
+	policies, err := parseRatePolicies("/messages/add=5/s:20, /users/login=10/m,*=3/2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]RatePolicy{
+		"/messages/add": {Route: "/messages/add", Rate: 5, Burst: 20},
+		"/users/login":  {Route: "/users/login", Rate: 10.0 / 60, Burst: 10},
+		"*":             {Route: "*", Rate: 1.5, Burst: 3},
+	}
+	if len(policies) != len(want) {
+		t.Fatalf("политики %+v, ожидались %+v", policies, want)
+	}
+	for route, policy := range want {
+		if policies[route] != policy {
+			t.Fatalf("политика %s %+v, ожидалась %+v", route, policies[route], policy)
+		}
+	}
+
+	if policies, err := parseRatePolicies("off"); err != nil || len(policies) != 0 {
+		t.Fatalf("off: %+v %v", policies, err)
+	}
+	for _, spec := range []string{"/messages/add", "=5/s", "/messages/add=5", "/messages/add=0/s", "/messages/add=5/x", "/messages/add=5/s:0"} {
+		if _, err := parseRatePolicies(spec); err == nil {
+			t.Fatalf("политика %q разобрана без ошибки", spec)
+		}
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	mr := miniredis.RunT(t)
+	limiters := map[string]RateLimiter{
+		"local": NewLocalRateLimiter(),
+		"redis": NewRedisRateLimiter(redis.NewClient(&redis.Options{Addr: mr.Addr()})),
+	}
+	policy := RatePolicy{Route: "*", Rate: 20, Burst: 2}
+
+	for name, limiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for i := 0; i < policy.Burst; i++ {
+				if allowed, _, err := limiter.Allow(ctx, "key", policy); err != nil || !allowed {
+					t.Fatalf("запрос %d в пределах емкости отклонен: %v", i+1, err)
+				}
+			}
+			allowed, wait, err := limiter.Allow(ctx, "key", policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed || wait <= 0 || wait > 50*time.Millisecond {
+				t.Fatalf("запрос сверх емкости: %v, ожидание %v", allowed, wait)
+			}
+			if allowed, _, err := limiter.Allow(ctx, "other", policy); err != nil || !allowed {
+				t.Fatalf("запрос с другим ключом отклонен: %v", err)
+			}
+
+			// Через время ожидания в корзине появляется один токен
+			time.Sleep(wait)
+			if allowed, _, err := limiter.Allow(ctx, "key", policy); err != nil || !allowed {
+				t.Fatalf("запрос после пополнения отклонен: %v", err)
+			}
+			if allowed, _, err := limiter.Allow(ctx, "key", policy); err != nil || allowed {
+				t.Fatalf("второй запрос после пополнения пропущен: %v", err)
+			}
+		})
+	}
+}
+
+// Сервис с заданными политиками ограничения частоты и числом доверенных прокси
+func newRateLimitedService(t *testing.T, rateLimits string, trustedProxies int) *Service {
+	t.Helper()
+
+	s := newTestService(t)
+	policies, err := parseRatePolicies(rateLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ratePolicies = policies
+	s.config.TrustedProxies = trustedProxies
+
+	return s
+}
+
+// Запрос к сервису с адреса remoteAddr и заголовком X-Forwarded-For, если он задан
+func doRateLimitedRequest(s *Service, method string, path string, remoteAddr string, forwarded string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	r.RemoteAddr = remoteAddr
+	if forwarded != "" {
+		r.Header.Set("X-Forwarded-For", forwarded)
+	}
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	s := newRateLimitedService(t, "/users/login=1/m,*=2/m", 0)
+
+	if w := doRateLimitedRequest(s, http.MethodPost, "/users/login", "10.0.0.1:1234", ""); w.Code == http.StatusTooManyRequests {
+		t.Fatal("первый запрос отклонен")
+	}
+	w := doRateLimitedRequest(s, http.MethodPost, "/users/login", "10.0.0.1:1234", "")
+	response := ErrorResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	expectError(t, w.Code, response, http.StatusTooManyRequests, TooManyRequests)
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "60" {
+		t.Fatalf("Retry-After %q, ожидалось 60", retryAfter)
+	}
+
+	// У другого адреса своя корзина, у маршрута без политики - корзина политики по умолчанию
+	if w := doRateLimitedRequest(s, http.MethodPost, "/users/login", "10.0.0.2:1234", ""); w.Code == http.StatusTooManyRequests {
+		t.Fatal("запрос с другого адреса отклонен")
+	}
+	if w := doRateLimitedRequest(s, http.MethodPost, "/users/add", "10.0.0.1:1234", ""); w.Code == http.StatusTooManyRequests {
+		t.Fatal("запрос к маршруту без политики отклонен")
+	}
+
+	// Служебные маршруты не ограничиваются
+	for i := 0; i < 3; i++ {
+		if w := doRateLimitedRequest(s, http.MethodGet, "/healthz", "10.0.0.1:1234", ""); w.Code != http.StatusOK {
+			t.Fatalf("служебный маршрут: %d", w.Code)
+		}
+	}
+}
+
+func TestRateLimitMiddlewareForwarded(t *testing.T) {
+	s := newRateLimitedService(t, "*=1/m", 1)
+
+	// Клиенты за одним прокси считаются по адресам, записанным прокси
+	if w := doRateLimitedRequest(s, http.MethodPost, "/users/login", "10.0.0.1:1234", "1.1.1.1"); w.Code == http.StatusTooManyRequests {
+		t.Fatal("запрос первого клиента отклонен")
+	}
+	if w := doRateLimitedRequest(s, http.MethodPost, "/users/login", "10.0.0.1:1234", "2.2.2.2"); w.Code == http.StatusTooManyRequests {
+		t.Fatal("запрос второго клиента отклонен")
+	}
+
+	// Адрес, подставленный клиентом в начало заголовка, не дает новую корзину
+	if w := doRateLimitedRequest(s, http.MethodPost, "/users/login", "10.0.0.1:1234", "3.3.3.3, 1.1.1.1"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("запрос с подставленным адресом: %d, ожидался %d", w.Code, http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Максимальная длина реакции в байтах, совпадает с размером столбца reaction
+const maxReactionLength = 32
+
+// Символ клавиши, вместе с цифрой, # или * образует эмодзи
+const keycap = '\u20e3'
+
+// Короткое имя эмодзи вида :thumbsup:
+var reactionShortcode = regexp.MustCompile(`^:[a-z0-9_+-]+:$`)
+
+// Реакция - короткое имя эмодзи или сам эмодзи. Эмодзи может состоять из нескольких символов:
+// модификаторов цвета кожи, селекторов варианта, соединителей (ZWJ) и символов клавиш вида 1️⃣
+func validReaction(reaction string) bool {
+	if reaction == "" || len(reaction) > maxReactionLength || !utf8.ValidString(reaction) {
+		return false
+	}
+	if reactionShortcode.MatchString(reaction) {
+		return true
+	}
+
+	hasSymbol := false
+	for _, r := range reaction {
+		switch {
+		case r == '#' || r == '*' || (r >= '0' && r <= '9'):
+		case r < utf8.RuneSelf:
+			return false
+		case unicode.IsSymbol(r) || r == keycap:
+			hasSymbol = true
+		case unicode.IsMark(r) || unicode.Is(unicode.Cf, r):
+		default:
+			return false
+		}
+	}
+
+	return hasSymbol
+}
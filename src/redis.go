@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/kelseyhightower/envconfig"
+)
+
+// Предельное время проверки подключения к Redis при создании клиента
+const redisPingTimeout = 5 * time.Second
+
+type ConfigRedis struct {
+	Addr     string // адрес сервера host:port
+	Password string // пароль, если сервер его требует
+	DB       int    `default:"0"` // номер БД
+}
+
+func initConfigRedis() (*ConfigRedis, error) {
+	config := &ConfigRedis{}
+	err := envconfig.Process("Redis", config)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Клиент Redis по настройкам из окружения. Сервер должен быть доступен при создании клиента
+func newRedisClient() (*redis.Client, error) {
+	config, err := initConfigRedis()
+	if err != nil {
+		return nil, err
+	}
+	if config.Addr == "" {
+		return nil, fmt.Errorf("не задан адрес Redis REDIS_ADDR")
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     config.Addr,
+		Password: config.Password,
+		DB:       config.DB,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisPingTimeout)
+	defer cancel()
+	if err := client.WithContext(ctx).Ping().Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
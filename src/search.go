@@ -0,0 +1,133 @@
+package main
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// Минимальная длина слова запроса. Совпадает с innodb_ft_min_token_size MySQL по умолчанию,
+// более короткие слова не попадают в полнотекстовый индекс
+const minSearchTermLength = 3
+
+// Наибольшее число слов запроса
+const maxSearchTerms = 10
+
+// Длина фрагмента текста с найденными словами и число символов перед первым найденным словом
+const (
+	snippetLength  = 160
+	snippetContext = 40
+)
+
+// SearchQuery - Условия поиска сообщений
+type SearchQuery struct {
+	Terms  []string // слова в нижнем регистре, в сообщении для каждого должно быть слово, начинающееся с него
+	Chat   uint64   // только в чате, если задан
+	Author uint64   // только сообщения автора, если задан
+	From   string   // отправленные не раньше, если задано
+	Before string   // отправленные раньше, если задано
+}
+
+// SearchHit - Найденное сообщение с фрагментом текста, в котором выделены найденные слова
+type SearchHit struct {
+	Message Message `json:"message"` //найденное сообщение
+	Snippet string  `json:"snippet"` //фрагмент текста в HTML, найденные слова выделены тегом mark
+}
+
+// Слова текста в нижнем регистре. Слово - последовательность букв и цифр
+func searchTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Слова запроса без повторов, короткие слова отбрасываются
+func searchTerms(query string) []string {
+	terms := []string{}
+	seen := make(map[string]bool)
+	for _, token := range searchTokens(query) {
+		if len([]rune(token)) < minSearchTermLength || seen[token] {
+			continue
+		}
+		seen[token] = true
+		terms = append(terms, token)
+	}
+
+	return terms
+}
+
+// Слово подходит под одно из слов запроса
+func matchesTerm(token string, terms []string) bool {
+	for _, term := range terms {
+		if strings.HasPrefix(token, term) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Фрагмент текста вокруг первого найденного слова. Текст экранируется для HTML,
+// найденные слова выделяются тегом mark
+func searchSnippet(text string, terms []string) string {
+	runes := []rune(text)
+
+	// Границы слов в символах текста
+	type span struct{ start, end int }
+	var matches []span
+	for i := 0; i < len(runes); {
+		if !unicode.IsLetter(runes[i]) && !unicode.IsNumber(runes[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsNumber(runes[j])) {
+			j++
+		}
+		if matchesTerm(strings.ToLower(string(runes[i:j])), terms) {
+			matches = append(matches, span{i, j})
+		}
+		i = j
+	}
+
+	// Фрагмент начинается с начала слова
+	start := 0
+	if len(matches) > 0 && matches[0].start > snippetContext {
+		start = matches[0].start - snippetContext
+		for start < matches[0].start && (unicode.IsLetter(runes[start-1]) || unicode.IsNumber(runes[start-1])) {
+			start++
+		}
+	}
+	end := start + snippetLength
+	if end > len(runes) {
+		end = len(runes)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, m := range matches {
+		if m.end <= start || m.start >= end {
+			continue
+		}
+		if m.start < pos {
+			m.start = pos
+		}
+		if m.end > end {
+			m.end = end
+		}
+		b.WriteString(html.EscapeString(string(runes[pos:m.start])))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(string(runes[m.start:m.end])))
+		b.WriteString("</mark>")
+		pos = m.end
+	}
+	b.WriteString(html.EscapeString(string(runes[pos:end])))
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+
+	return b.String()
+}
@@ -2,14 +2,29 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
+	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Объект описывающий сервис
@@ -17,13 +32,27 @@ type Service struct {
 	config    *Config
 	connector Connector
 	server    http.Server
+	tokens    *TokenIssuer
+	hub       *Hub
+	events    EventBus
+	blobs     BlobStore
+	metrics   *Metrics
+	limiter   RateLimiter
+	upgrader  websocket.Upgrader
+	ready     int32 // 1, пока сервис принимает запросы; сбрасывается в начале остановки
+
+	ratePolicies map[string]RatePolicy // политики ограничения частоты по шаблону пути маршрута
+
+	ctx    context.Context    // родительский контекст всех запросов
+	cancel context.CancelFunc // отмена запросов, не завершившихся при остановке
 }
 
 // Запуск сервиса
 func (s *Service) Start() {
+	atomic.StoreInt32(&s.ready, 1)
 	go func() {
 		log.Info().Str("Host", s.config.Host).Int("Port", s.config.Port).Msg("Сервис запущен")
-		if err := s.server.ListenAndServe(); err != nil {
+		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatal().Err(err).Msg("Не удалось запустить сервис")
 		}
 	}()
@@ -32,34 +61,135 @@ func (s *Service) Start() {
 // Остановка сервиса
 func (s *Service) Stop() {
 	log.Info().Msg("Сервис закрывается...")
+	// Проверка готовности начинает отвечать отказом, и балансировщик перестает направлять запросы.
+	// До истечения паузы запросы по-прежнему обрабатываются
+	atomic.StoreInt32(&s.ready, 0)
+	time.Sleep(s.config.ShutdownDelay)
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*time.Second)
 	defer cancel()
+	// Запросы, не успевшие завершиться за время ожидания, прерываются вместе с запросами к хранилищу
+	defer s.cancel()
+	// WebSocket подключения не отслеживаются http.Server, поэтому закрываются отдельно
+	if err := s.hub.Close(ctx); err != nil {
+		log.Warn().Err(err).Msg("Не все WebSocket подключения закрыты")
+	}
 	if err := s.server.Shutdown(ctx); err != nil {
 		log.Warn().Err(err).Msg("Ошибка закрытия сервиса")
 	}
+	if err := s.events.Close(); err != nil {
+		log.Warn().Err(err).Msg("Ошибка закрытия шины событий")
+	}
 	log.Info().Msg("Сервис закрыт")
 }
 
 // Создание нового экземпляра сервиса
-func NewService(config *Config, controller Connector) *Service {
+func NewService(config *Config, controller Connector) (*Service, error) {
+	tokens, err := NewTokenIssuer(config.AuthSecret, config.TokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs, err := NewBlobStore(config.BlobStoreType)
+	if err != nil {
+		return nil, err
+	}
+
+	rateLimits := config.RateLimits
+	if rateLimits == "" {
+		rateLimits = defaultRateLimits
+	}
+	ratePolicies, err := parseRatePolicies(rateLimits)
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := NewRateLimiter(config.RateLimitStore)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := NewCache(config.CacheStore, config.CacheSize)
+	if err != nil {
+		return nil, err
+	}
+	// WebSocket подключения получают события всех копий сервиса через шину
+	hub := NewHub()
+	events, err := NewEventBus(config.EventBus)
+	if err != nil {
+		return nil, err
+	}
+	events.Subscribe(hub.Publish)
+
+	// Статистика пула подключений доступна только у коннекторов к БД
+	metrics := NewMetrics()
+	if sqlConnector, ok := controller.(SQLConnector); ok {
+		db, err := sqlConnector.sqlDB()
+		if err != nil {
+			return nil, err
+		}
+		if err := metrics.registerDB(db, sqlConnector.sqlDialect()); err != nil {
+			return nil, err
+		}
+	}
+
+	// Кэш оборачивает измеряемый коннектор, поэтому метрики и трассы хранилища учитывают только обращения к нему
+	var connector Connector = NewMetricsConnector(NewTracingConnector(controller), metrics)
+	if cache != nil {
+		connector = NewCachingConnector(connector, cache, config.CacheTTL, metrics)
+	}
+
 	service := &Service{
 		config:    config,
-		connector: controller,
+		connector: connector,
+		tokens:    tokens,
+		hub:       hub,
+		events:    events,
+		blobs:     blobs,
+		metrics:   metrics,
+		limiter:   limiter,
+
+		ratePolicies: ratePolicies,
 	}
+	service.ctx, service.cancel = context.WithCancel(context.Background())
 
 	service.server = http.Server{
 		Addr:    fmt.Sprintf(":%d", config.Port),
 		Handler: service.initRouter(),
+		BaseContext: func(net.Listener) context.Context {
+			return service.ctx
+		},
 	}
 
-	return service
+	return service, nil
 }
 
 // Конфигурация сервиса
 type Config struct {
-	Port          int    `default:"9000"`
-	Host          string `default:""`
-	ConnectorType string `split_words:"true" default:"mysql"`
+	Port               int           `default:"9000"`
+	Host               string        `default:""`
+	ConnectorType      string        `split_words:"true" default:"mysql"`
+	MigrateOnStart     bool          `split_words:"true" default:"false"`    // применять миграции схемы при запуске
+	StorageTimeout     time.Duration `split_words:"true" default:"5s"`       // предельное время обращения к хранилищу за один запрос
+	StorageWaitTimeout time.Duration `split_words:"true" default:"30s"`      // время ожидания доступности хранилища при запуске
+	ShutdownDelay      time.Duration `split_words:"true" default:"5s"`       // пауза между отказом в готовности и остановкой сервера при завершении
+	AuthSecret         string        `split_words:"true"`                    // секрет подписи токенов доступа
+	TokenTTL           time.Duration `split_words:"true" default:"24h"`      // время жизни токена доступа
+	WSSendBuffer       int           `split_words:"true" default:"64"`       // размер буфера исходящих событий WebSocket подключения
+	WSPingInterval     time.Duration `split_words:"true" default:"30s"`      // интервал ping WebSocket подключений
+	ReadByLimit        int           `split_words:"true" default:"20"`       // наибольшее число участников чата, для которого сообщения дополняются списком прочитавших
+	BlobStoreType      string        `split_words:"true" default:"local"`    // хранилище содержимого вложений
+	AttachmentMaxSize  int64         `split_words:"true" default:"10485760"` // наибольший размер одного вложения в байтах
+	AttachmentMaxCount int           `split_words:"true" default:"10"`       // наибольшее число вложений в сообщении
+	TraceExporter      string        `split_words:"true" default:"none"`     // экспорт трасс: none, otlp или stdout
+	TraceEndpoint      string        `split_words:"true"`                    // адрес OTLP/HTTP коллектора трасс, по умолчанию http://localhost:4318
+	TraceFile          string        `split_words:"true"`                    // файл для экспортера stdout, по умолчанию стандартный вывод
+	TraceSampleRatio   float64       `split_words:"true" default:"1"`        // доля трассируемых запросов без входящего контекста трассировки
+	RateLimits         string        `split_words:"true"`                    // политики ограничения частоты запросов, off отключает ограничение
+	RateLimitStore     string        `split_words:"true" default:"local"`    // хранилище корзин ограничения частоты: local или redis
+	TrustedProxies     int           `split_words:"true" default:"0"`        // число доверенных прокси перед сервисом, адрес клиента берется из X-Forwarded-For
+	CacheStore         string        `split_words:"true"`                    // кэш коннектора: redis, lru или off; по умолчанию redis, если задан REDIS_ADDR, иначе off
+	CacheTTL           time.Duration `split_words:"true" default:"1m"`       // время жизни значений в кэше коннектора
+	CacheSize          int           `split_words:"true" default:"10000"`    // наибольшее число значений в кэше lru
+	EventBus           string        `split_words:"true"`                    // шина событий: local или redis; по умолчанию redis, если задан REDIS_ADDR
 }
 
 // Инициализация настроек сервиса
@@ -73,22 +203,67 @@ func InitConfig() (*Config, error) {
 	return config, nil
 }
 
+// Служебные маршруты, которые опрашиваются балансировщиком и системой мониторинга.
+// Они не трассируются и не ограничиваются по частоте
+var serviceRoutes = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
 // Инициализация роутера сервиса
 func (s *Service) initRouter() *mux.Router {
 	router := mux.NewRouter()
 
 	userRouter := router.PathPrefix("/users").Subrouter()
 	userRouter.HandleFunc("/add", s.createUser).Methods(http.MethodPost)
+	userRouter.HandleFunc("/login", s.login).Methods(http.MethodPost)
 
+	// Остальные методы выполняются от лица пользователя, указанного в токене доступа
 	chatRouter := router.PathPrefix("/chats").Subrouter()
 	chatRouter.HandleFunc("/add", s.createChat).Methods(http.MethodPost)
 	chatRouter.HandleFunc("/get", s.getChats).Methods(http.MethodPost)
+	chatRouter.HandleFunc("/read", s.markRead).Methods(http.MethodPost)
+	chatRouter.HandleFunc("/members/add", s.addMembers).Methods(http.MethodPost)
+	chatRouter.HandleFunc("/members/remove", s.removeMember).Methods(http.MethodPost)
+	chatRouter.HandleFunc("/members/role", s.setRole).Methods(http.MethodPost)
+	chatRouter.HandleFunc("/leave", s.leaveChat).Methods(http.MethodPost)
+	chatRouter.Use(s.AuthMiddleware)
 
 	messagesRouter := router.PathPrefix("/messages").Subrouter()
 	messagesRouter.HandleFunc("/add", s.sendMessage).Methods(http.MethodPost)
+	messagesRouter.HandleFunc("/upload", s.uploadMessage).Methods(http.MethodPost)
 	messagesRouter.HandleFunc("/get", s.getMessages).Methods(http.MethodPost)
+	messagesRouter.HandleFunc("/thread", s.getThread).Methods(http.MethodPost)
+	messagesRouter.HandleFunc("/search", s.searchMessages).Methods(http.MethodPost)
+	messagesRouter.HandleFunc("/edit", s.editMessage).Methods(http.MethodPost)
+	messagesRouter.HandleFunc("/delete", s.deleteMessage).Methods(http.MethodPost)
+	messagesRouter.HandleFunc("/revisions", s.getRevisions).Methods(http.MethodPost)
+	messagesRouter.HandleFunc("/reactions/add", s.addReaction).Methods(http.MethodPost)
+	messagesRouter.HandleFunc("/reactions/remove", s.removeReaction).Methods(http.MethodPost)
+	messagesRouter.Use(s.AuthMiddleware)
+
+	attachmentsRouter := router.PathPrefix("/attachments").Subrouter()
+	attachmentsRouter.HandleFunc("/{id:[0-9]+}", s.downloadAttachment).Methods(http.MethodGet, http.MethodHead)
+	attachmentsRouter.Use(s.AuthMiddleware)
+
+	router.Handle("/ws", s.AuthMiddleware(http.HandlerFunc(s.subscribe))).Methods(http.MethodGet)
+
+	router.Handle("/metrics", s.metrics.Handler()).Methods(http.MethodGet)
+	router.HandleFunc("/healthz", s.healthz).Methods(http.MethodGet, http.MethodHead)
+	router.HandleFunc("/readyz", s.readyz).Methods(http.MethodGet, http.MethodHead)
+
+	// Миделвары роутера не вызываются для запросов без подходящего маршрута
+	unmatched := func(h http.Handler) http.Handler {
+		return TraceMiddleware(LogMiddleware(s.metrics.Middleware(h)))
+	}
+	router.NotFoundHandler = unmatched(http.NotFoundHandler())
+	router.MethodNotAllowedHandler = unmatched(http.HandlerFunc(methodNotAllowed))
 
+	router.Use(TraceMiddleware)
 	router.Use(LogMiddleware)
+	router.Use(s.metrics.Middleware)
+	router.Use(s.RateLimitMiddleware)
 
 	return router
 }
@@ -96,7 +271,11 @@ func (s *Service) initRouter() *mux.Router {
 // Миделвара логирования
 func LogMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Info().
+		event := log.Info()
+		if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.HasTraceID() {
+			event = event.Str("trace id", spanContext.TraceID().String())
+		}
+		event.
 			Str("path", r.URL.Path).
 			Str("remote addr", r.RemoteAddr).
 			Str("user agent", r.UserAgent()).
@@ -106,13 +285,25 @@ func LogMiddleware(h http.Handler) http.Handler {
 	})
 }
 
+// Ответ на запрос с методом, который не поддерживает маршрут
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
 // Код ошибок при ответе
 type ErrorCodeType int
 
 const (
-	AlreadyExist ErrorCodeType = iota // сущность уже существует
-	NotExist                          // сущность не существует
-	EmptyFields                       // задан пустой параметр
+	AlreadyExist     ErrorCodeType = iota // сущность уже существует
+	NotExist                              // сущность не существует
+	EmptyFields                           // задан пустой параметр
+	Timeout                               // хранилище не ответило за отведенное время
+	Forbidden                             // пользователь не состоит в чате или не имеет прав на действие
+	Unauthorized                          // не передан или недействителен токен доступа, неверный пароль
+	InvalidParam                          // недопустимое значение параметра
+	PermissionDenied                      // роль участника не позволяет выполнить действие
+	TooLarge                              // размер или количество вложений превышает допустимое
+	TooManyRequests                       // превышена частота запросов
 )
 
 // Тело ответа в случае ошибки
@@ -121,457 +312,1531 @@ type ErrorResponse struct {
 	Description string        `json:"description"` // описание ошибки
 }
 
-// Добавить нового пользователя
-func (s *Service) createUser(w http.ResponseWriter, r *http.Request) {
+// Контекст обращения к хранилищу, ограниченный по времени настройкой StorageTimeout
+func (s *Service) storageContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), s.config.StorageTimeout)
+}
+
+// Чтение JSON тела запроса, в случае ошибки отвечает кодом 400
+func readRequest(w http.ResponseWriter, r *http.Request, requestBody interface{}) bool {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Warn().Err(err).Msg("Не удалось прочитать тело")
 		w.WriteHeader(http.StatusBadRequest)
-		return
+		return false
 	}
 	defer r.Body.Close()
 
-	requestBody := struct {
-		Username string `json:"username"`
-	}{}
-
-	if err := json.Unmarshal(body, &requestBody); err != nil {
+	if err := json.Unmarshal(body, requestBody); err != nil {
 		log.Warn().Err(err).Msg("Не удалось анмаршалить тело")
 		w.WriteHeader(http.StatusBadRequest)
-		return
+		return false
 	}
 
-	// Проверка полей
-	if requestBody.Username == "" {
-		responseBody := ErrorResponse{
-			ErrorCode:   EmptyFields,
-			Description: fmt.Sprintf("Не задано имя пльзователя"),
-		}
+	return true
+}
 
-		body, err = json.Marshal(responseBody)
-		if err != nil {
-			log.Warn().Err(err).Msg("Не удалось замаршалить ответ")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(body)
+// Ответ с JSON телом
+func writeResponse(w http.ResponseWriter, status int, responseBody interface{}) {
+	body, err := json.Marshal(responseBody)
+	if err != nil {
+		log.Warn().Err(err).Msg("Не удалось замаршалить ответ")
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
 
-	// Проверяем существование пользователей
-	isExist, err := s.connector.checkUsername(requestBody.Username)
-	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось проверить пользователя")
-		w.WriteHeader(http.StatusInternalServerError)
+// Ответ с описанием ошибки
+func writeError(w http.ResponseWriter, status int, code ErrorCodeType, description string) {
+	writeResponse(w, status, ErrorResponse{
+		ErrorCode:   code,
+		Description: description,
+	})
+}
+
+// Ответ в случае ошибки хранилища. Нарушения ограничений хранилища возвращаются с кодом 400,
+// истечение StorageTimeout отличается от прочих ошибок кодом 504
+func writeStorageError(ctx context.Context, w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, ErrAlreadyExist):
+		writeError(w, http.StatusBadRequest, AlreadyExist, errorDescription(err))
+		return
+	case errors.Is(err, ErrNotExist):
+		writeError(w, http.StatusBadRequest, NotExist, errorDescription(err))
 		return
 	}
 
-	if isExist {
-		responseBody := ErrorResponse{
-			ErrorCode:   AlreadyExist,
-			Description: fmt.Sprintf("Пользователь уже %s существует", requestBody.Username),
-		}
+	log.Warn().Err(err).Msg(msg)
 
-		body, err = json.Marshal(responseBody)
-		if err != nil {
-			log.Warn().Err(err).Msg("Не удалось замаршалить ответ")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(body)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		writeError(w, http.StatusGatewayTimeout, Timeout, "Хранилище не ответило за отведенное время")
 		return
 	}
+	w.WriteHeader(http.StatusInternalServerError)
+}
 
-	// Создаем нового пользователя
-	user, err := s.connector.createUser(requestBody.Username)
+// Проверка существования чата, если чата нет, отвечает кодом 400
+func (s *Service) checkChat(ctx context.Context, w http.ResponseWriter, chatID uint64) bool {
+	isExist, err := s.connector.checkChartID(ctx, chatID)
 	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось создать пользователя")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		writeStorageError(ctx, w, err, "Не удалось проверить чат")
+		return false
 	}
 
-	responseBody := struct {
-		ID uint64 `json:"id"`
-	}{
-		ID: user.ID,
+	if !isExist {
+		writeError(w, http.StatusBadRequest, NotExist, fmt.Sprintf("Чат c id %d не существует", chatID))
+		return false
 	}
 
-	body, err = json.Marshal(responseBody)
-	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось замаршалить ответ")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	return true
+}
+
+// Проверка длины текста сообщения, если текст длиннее maxMessageLength, отвечает кодом 400
+func checkMessageLength(w http.ResponseWriter, text string) bool {
+	if utf8.RuneCountInString(text) > maxMessageLength {
+		writeError(w, http.StatusBadRequest, InvalidParam, fmt.Sprintf("Текст сообщения длиннее %d символов", maxMessageLength))
+		return false
 	}
-	w.WriteHeader(http.StatusCreated)
-	w.Write(body)
+
+	return true
 }
 
-// Создать новый чат между пользователями
-func (s *Service) createChat(w http.ResponseWriter, r *http.Request) {
-	requestBody := struct {
-		Name  string   `json:"name"`
-		Users []uint64 `json:"users"`
-	}{}
+// Проверка участия пользователя в чате, в случае отказа отвечает кодом 403
+func (s *Service) checkMember(ctx context.Context, w http.ResponseWriter, chatID uint64, userID uint64) bool {
+	isMember, err := s.connector.isMember(ctx, chatID, userID)
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось проверить участника чата")
+		return false
+	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	if !isMember {
+		writeError(w, http.StatusForbidden, Forbidden, fmt.Sprintf("Пользователь c id %d не состоит в чате c id %d", userID, chatID))
+		return false
+	}
+
+	return true
+}
+
+// Роль участника чата, если пользователь не состоит в чате, отвечает кодом 403
+func (s *Service) memberRole(ctx context.Context, w http.ResponseWriter, chatID uint64, userID uint64) (string, bool) {
+	role, err := s.connector.getRole(ctx, chatID, userID)
 	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось прочитать тело")
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		writeStorageError(ctx, w, err, "Не удалось проверить участника чата")
+		return "", false
 	}
-	defer r.Body.Close()
 
-	if err := json.Unmarshal(body, &requestBody); err != nil {
-		log.Warn().Err(err).Msg("Не удалось анмаршалить тело")
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	if role == "" {
+		writeError(w, http.StatusForbidden, Forbidden, fmt.Sprintf("Пользователь c id %d не состоит в чате c id %d", userID, chatID))
+		return "", false
 	}
 
-	// Проверка полей
-	if requestBody.Name == "" || len(requestBody.Users) == 0 {
-		responseBody := ErrorResponse{
-			ErrorCode:   EmptyFields,
-			Description: fmt.Sprintf("Не задано название чата или не указаны участники"),
-		}
+	return role, true
+}
 
-		body, err = json.Marshal(responseBody)
-		if err != nil {
-			log.Warn().Err(err).Msg("Не удалось замаршалить ответ")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(body)
-		return
+// Проверка права участника на действие в чате, в случае отказа отвечает кодом 403
+func (s *Service) checkPermission(ctx context.Context, w http.ResponseWriter, chatID uint64, userID uint64, permission Permission) (string, bool) {
+	role, ok := s.memberRole(ctx, w, chatID, userID)
+	if !ok {
+		return "", false
 	}
 
-	// Проверяем существование чата
-	isExist, err := s.connector.checkChartName(requestBody.Name)
+	if !roleCan(role, permission) {
+		writeError(w, http.StatusForbidden, PermissionDenied, fmt.Sprintf("Роль %s не позволяет выполнить действие в чате c id %d", role, chatID))
+		return "", false
+	}
+
+	return role, true
+}
+
+// Получение сообщения, которое пользователь может изменять. Свое сообщение участник изменяет,
+// если может писать в чат, чужое - только при moderation и праве модерации.
+// В случае ошибки ответ уже записан и возвращается false
+func (s *Service) editableMessage(ctx context.Context, w http.ResponseWriter, messageID uint64, userID uint64, moderation bool) (Message, bool) {
+	message, err := s.connector.getMessage(ctx, messageID)
 	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось проверить пользователя")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		writeStorageError(ctx, w, err, "Не удалось получить сообщение")
+		return Message{}, false
 	}
 
-	if isExist {
-		responseBody := ErrorResponse{
-			ErrorCode:   AlreadyExist,
-			Description: fmt.Sprintf("Чат уже %s существует", requestBody.Name),
-		}
+	if message.Kind != "" {
+		writeError(w, http.StatusForbidden, Forbidden, fmt.Sprintf("Системное сообщение c id %d нельзя изменять", messageID))
+		return Message{}, false
+	}
 
-		body, err = json.Marshal(responseBody)
-		if err != nil {
-			log.Warn().Err(err).Msg("Не удалось замаршалить ответ")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+	permission := PermPost
+	if message.Author != strconv.FormatUint(userID, 10) {
+		if !moderation {
+			writeError(w, http.StatusForbidden, PermissionDenied, fmt.Sprintf("Пользователь c id %d не является автором сообщения c id %d", userID, messageID))
+			return Message{}, false
 		}
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(body)
-		return
+		permission = PermModerate
 	}
 
-	// Проверяем существование пользователей
-	for _, userID := range requestBody.Users {
-		isExist, err := s.connector.checkUserID(userID)
-		if err != nil {
-			log.Warn().Err(err).Msg("Не удалось проверить пользователя")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	if _, ok := s.checkPermission(ctx, w, message.Chat, userID, permission); !ok {
+		return Message{}, false
+	}
 
-		if !isExist {
-			responseBody := ErrorResponse{
-				ErrorCode:   NotExist,
-				Description: fmt.Sprintf("Пользователь c id %d не существует", userID),
-			}
+	return message, true
+}
 
-			body, err = json.Marshal(responseBody)
-			if err != nil {
-				log.Warn().Err(err).Msg("Не удалось замаршалить ответ")
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(body)
-			return
-		}
+// Описание ошибки хранилища для ответа, с заглавной буквы
+func errorDescription(err error) string {
+	description := []rune(err.Error())
+	if len(description) > 0 {
+		description[0] = unicode.ToUpper(description[0])
 	}
 
-	// Создаем чат
-	chat, err := s.connector.createChart(requestBody.Name, requestBody.Users)
-	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось создать чат")
-		w.WriteHeader(http.StatusInternalServerError)
+	return string(description)
+}
+
+// Добавить нового пользователя
+func (s *Service) createUser(w http.ResponseWriter, r *http.Request) {
+	requestBody := struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}{}
+
+	if !readRequest(w, r, &requestBody) {
 		return
 	}
 
-	responseBody := struct {
-		ID uint64 `json:"id"`
-	}{
-		ID: chat.ID,
+	// Проверка полей
+	if requestBody.Username == "" || requestBody.Password == "" {
+		writeError(w, http.StatusBadRequest, EmptyFields, "Не задано имя пльзователя или пароль")
+		return
 	}
 
-	body, err = json.Marshal(responseBody)
+	passwordHash, err := hashPassword(requestBody.Password)
 	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось замаршалить ответ")
+		log.Warn().Err(err).Msg("Не удалось получить хеш пароля")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
-	w.Write(body)
-}
 
-// Отправить сообщение в чат от лица пользователя
-func (s *Service) sendMessage(w http.ResponseWriter, r *http.Request) {
-	requestBody := struct {
-		ChatID uint64 `json:"chat"`
-		UserID uint64 `json:"author"`
-		Text   string `json:"text"`
-	}{}
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
 
-	body, err := ioutil.ReadAll(r.Body)
+	// Создаем нового пользователя, занятое имя проверяется ограничением уникальности хранилища
+	user, err := s.connector.createUser(ctx, requestBody.Username, passwordHash)
 	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось прочитать тело")
-		w.WriteHeader(http.StatusBadRequest)
+		writeStorageError(ctx, w, err, "Не удалось создать пользователя")
 		return
 	}
-	defer r.Body.Close()
 
-	if err := json.Unmarshal(body, &requestBody); err != nil {
-		log.Warn().Err(err).Msg("Не удалось анмаршалить тело")
-		w.WriteHeader(http.StatusBadRequest)
+	s.writeToken(w, http.StatusCreated, user.ID)
+}
+
+// Войти под существующим пользователем и получить токен доступа
+func (s *Service) login(w http.ResponseWriter, r *http.Request) {
+	requestBody := struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}{}
+
+	if !readRequest(w, r, &requestBody) {
 		return
 	}
 
-	// Проверка полей
-	if requestBody.Text == "" {
-		responseBody := ErrorResponse{
-			ErrorCode:   EmptyFields,
-			Description: fmt.Sprintf("Не задан текст сообщения"),
-		}
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
 
-		body, err = json.Marshal(responseBody)
-		if err != nil {
-			log.Warn().Err(err).Msg("Не удалось замаршалить ответ")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(body)
+	user, passwordHash, err := s.connector.getCredentials(ctx, requestBody.Username)
+	if err != nil && !errors.Is(err, ErrNotExist) {
+		writeStorageError(ctx, w, err, "Не удалось получить пользователя")
 		return
 	}
 
-	// Проверяем существование чата
-	isExist, err := s.connector.checkChartID(requestBody.ChatID)
+	// Отсутствующий пользователь и неверный пароль не различаются ни ответом, ни временем проверки:
+	// пароль отсутствующего пользователя сравнивается с заменяющим хешем
 	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось проверить пользователя")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		passwordHash = ""
 	}
-
-	if !isExist {
-		responseBody := ErrorResponse{
-			ErrorCode:   NotExist,
-			Description: fmt.Sprintf("Чат c id %d не существует", requestBody.ChatID),
-		}
-
-		body, err = json.Marshal(responseBody)
-		if err != nil {
-			log.Warn().Err(err).Msg("Не удалось замаршалить ответ")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(body)
+	if !checkPassword(passwordHash, requestBody.Password) {
+		writeError(w, http.StatusUnauthorized, Unauthorized, "Неверное имя пользователя или пароль")
 		return
 	}
 
-	// Проверяем существование пользователей
-	isExist, err = s.connector.checkUserID(requestBody.UserID)
+	s.writeToken(w, http.StatusOK, user.ID)
+}
+
+// Ответ с идентификатором пользователя и новым токеном доступа
+func (s *Service) writeToken(w http.ResponseWriter, status int, userID uint64) {
+	token, expiresAt, err := s.tokens.Issue(userID)
 	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось проверить пользователя")
+		log.Warn().Err(err).Msg("Не удалось выпустить токен")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if !isExist {
-		responseBody := ErrorResponse{
-			ErrorCode:   NotExist,
-			Description: fmt.Sprintf("Пользователь c id %d не существует", requestBody.UserID),
-		}
+	responseBody := struct {
+		ID        uint64 `json:"id"`
+		Token     string `json:"token"`
+		ExpiresAt string `json:"expires_at"`
+	}{
+		ID:        userID,
+		Token:     token,
+		ExpiresAt: expiresAt.Format(timeLayout),
+	}
 
-		body, err = json.Marshal(responseBody)
-		if err != nil {
-			log.Warn().Err(err).Msg("Не удалось замаршалить ответ")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(body)
+	writeResponse(w, status, responseBody)
+}
+
+// Создать новый чат между пользователями
+func (s *Service) createChat(w http.ResponseWriter, r *http.Request) {
+	requestBody := struct {
+		Name  string   `json:"name"`
+		Users []uint64 `json:"users"`
+	}{}
+
+	if !readRequest(w, r, &requestBody) {
 		return
 	}
 
-	// Отправляем сообщение
-	msg, err := s.connector.sendMessage(requestBody.ChatID, requestBody.UserID, requestBody.Text)
+	// Проверка полей
+	if requestBody.Name == "" {
+		writeError(w, http.StatusBadRequest, EmptyFields, "Не задано название чата")
+		return
+	}
+
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
+
+	// Создаем чат вместе с участниками в одной транзакции.
+	// Занятое название и несуществующие участники возвращаются ошибками хранилища.
+	// Создатель чата всегда становится его участником с ролью владельца.
+	chat, err := s.connector.createChart(ctx, requestBody.Name, callerID(r.Context()), requestBody.Users)
 	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось отправить сообщение")
-		w.WriteHeader(http.StatusInternalServerError)
+		writeStorageError(ctx, w, err, "Не удалось создать чат")
 		return
 	}
+	s.publish(r.Context(), Event{Type: EventChatCreated, Chat: &chat})
 
 	responseBody := struct {
 		ID uint64 `json:"id"`
 	}{
-		ID: msg.ID,
+		ID: chat.ID,
 	}
 
-	body, err = json.Marshal(responseBody)
-	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось замаршалить ответ")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	w.WriteHeader(http.StatusCreated)
-	w.Write(body)
+	writeResponse(w, http.StatusCreated, responseBody)
 }
 
-// Получить список чатов конкретного пользователя
-func (s *Service) getChats(w http.ResponseWriter, r *http.Request) {
+// Отправить сообщение в чат от лица пользователя
+func (s *Service) sendMessage(w http.ResponseWriter, r *http.Request) {
 	requestBody := struct {
-		UserID uint64 `json:"user"`
+		ChatID  uint64 `json:"chat"`
+		Text    string `json:"text"`
+		ReplyTo uint64 `json:"reply_to"` // ответ на сообщение того же чата
 	}{}
+	userID := callerID(r.Context())
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось прочитать тело")
-		w.WriteHeader(http.StatusBadRequest)
+	if !readRequest(w, r, &requestBody) {
 		return
 	}
-	defer r.Body.Close()
 
-	if err := json.Unmarshal(body, &requestBody); err != nil {
-		log.Warn().Err(err).Msg("Не удалось анмаршалить тело")
-		w.WriteHeader(http.StatusBadRequest)
+	// Проверка полей
+	if requestBody.Text == "" {
+		writeError(w, http.StatusBadRequest, EmptyFields, "Не задан текст сообщения")
+		return
+	}
+	if !checkMessageLength(w, requestBody.Text) {
 		return
 	}
 
-	// Проверяем существование пользователей
-	isExist, err := s.connector.checkUserID(requestBody.UserID)
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
+
+	// Проверяем существование чата
+	isExist, err := s.connector.checkChartID(ctx, requestBody.ChatID)
 	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось проверить пользователя")
-		w.WriteHeader(http.StatusInternalServerError)
+		writeStorageError(ctx, w, err, "Не удалось проверить пользователя")
 		return
 	}
 
 	if !isExist {
-		responseBody := ErrorResponse{
-			ErrorCode:   NotExist,
-			Description: fmt.Sprintf("Пользователь c id %d не существует", requestBody.UserID),
-		}
+		writeError(w, http.StatusBadRequest, NotExist, fmt.Sprintf("Чат c id %d не существует", requestBody.ChatID))
+		return
+	}
 
-		body, err = json.Marshal(responseBody)
-		if err != nil {
-			log.Warn().Err(err).Msg("Не удалось замаршалить ответ")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(body)
+	// Писать в чат могут только его участники с правом отправки сообщений
+	if _, ok := s.checkPermission(ctx, w, requestBody.ChatID, userID, PermPost); !ok {
 		return
 	}
 
 	// Отправляем сообщение
-	chats, err := s.connector.getCharts(requestBody.UserID)
+	msg, err := s.connector.sendMessage(ctx, requestBody.ChatID, userID, requestBody.Text, requestBody.ReplyTo, nil)
 	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось создать чат")
-		w.WriteHeader(http.StatusInternalServerError)
+		writeStorageError(ctx, w, err, "Не удалось отправить сообщение")
 		return
 	}
+	s.publish(r.Context(), Event{Type: EventMessageCreated, Message: &msg})
 
 	responseBody := struct {
-		Chats []Chat `json:"chats"`
+		ID uint64 `json:"id"`
+	}{
+		ID: msg.ID,
+	}
+
+	writeResponse(w, http.StatusCreated, responseBody)
+}
+
+// Отправить сообщение с вложениями, загруженными multipart формой: поля chat, text, reply_to
+// и файлы в полях file. Содержимое вложений записывается в хранилище до записи сообщения
+func (s *Service) uploadMessage(w http.ResponseWriter, r *http.Request) {
+	userID := callerID(r.Context())
+
+	// Форма не может быть больше всех вложений вместе с полями сообщения
+	maxBody := s.config.AttachmentMaxSize*int64(s.config.AttachmentMaxCount) + multipartMemory
+	if r.ContentLength > maxBody {
+		writeError(w, http.StatusRequestEntityTooLarge, TooLarge, fmt.Sprintf("Размер запроса превышает %d байт", maxBody))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+
+	if err := r.ParseMultipartForm(multipartMemory); err != nil {
+		writeError(w, http.StatusBadRequest, InvalidParam, fmt.Sprintf("Не удалось прочитать multipart форму: %v", err))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	// Проверка полей
+	chatID, err := strconv.ParseUint(r.FormValue("chat"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, InvalidParam, "Не задан id чата")
+		return
+	}
+	var replyTo uint64
+	if value := r.FormValue("reply_to"); value != "" {
+		if replyTo, err = strconv.ParseUint(value, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, InvalidParam, "Недопустимый id сообщения reply_to")
+			return
+		}
+	}
+	text := r.FormValue("text")
+	if !checkMessageLength(w, text) {
+		return
+	}
+	files := r.MultipartForm.File["file"]
+
+	if len(files) == 0 {
+		writeError(w, http.StatusBadRequest, EmptyFields, "Не заданы вложения")
+		return
+	}
+	if len(files) > s.config.AttachmentMaxCount {
+		writeError(w, http.StatusRequestEntityTooLarge, TooLarge, fmt.Sprintf("Сообщение может содержать не больше %d вложений", s.config.AttachmentMaxCount))
+		return
+	}
+	for _, file := range files {
+		if file.Size > s.config.AttachmentMaxSize {
+			writeError(w, http.StatusRequestEntityTooLarge, TooLarge,
+				fmt.Sprintf("Размер вложения %s превышает %d байт", attachmentName(file.Filename), s.config.AttachmentMaxSize))
+			return
+		}
+	}
+
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
+
+	if !s.checkChat(ctx, w, chatID) {
+		return
+	}
+
+	// Писать в чат могут только его участники с правом отправки сообщений
+	if _, ok := s.checkPermission(ctx, w, chatID, userID, PermPost); !ok {
+		return
+	}
+
+	// Запись содержимого не ограничена StorageTimeout, большие файлы могут записываться дольше
+	attachments := make([]Attachment, 0, len(files))
+	removeStored := func() {
+		for _, attachment := range attachments {
+			if err := s.blobs.Delete(context.Background(), attachment.StorageKey); err != nil {
+				log.Warn().Err(err).Str("key", attachment.StorageKey).Msg("Не удалось удалить содержимое вложения")
+			}
+		}
+	}
+	for _, file := range files {
+		attachment, err := s.storeAttachment(r.Context(), file)
+		if err != nil {
+			removeStored()
+			writeStorageError(ctx, w, err, "Не удалось сохранить вложение")
+			return
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	msg, err := s.connector.sendMessage(ctx, chatID, userID, text, replyTo, attachments)
+	if err != nil {
+		removeStored()
+		writeStorageError(ctx, w, err, "Не удалось отправить сообщение")
+		return
+	}
+	s.publish(r.Context(), Event{Type: EventMessageCreated, Message: &msg})
+
+	responseBody := struct {
+		ID          uint64       `json:"id"`
+		Attachments []Attachment `json:"attachments"`
+	}{
+		ID:          msg.ID,
+		Attachments: msg.Attachments,
+	}
+
+	writeResponse(w, http.StatusCreated, responseBody)
+}
+
+// Запись содержимого файла формы в хранилище вложений с подсчетом размера и контрольной суммы
+func (s *Service) storeAttachment(ctx context.Context, file *multipart.FileHeader) (Attachment, error) {
+	f, err := file.Open()
+	if err != nil {
+		return Attachment{}, err
+	}
+	defer f.Close()
+
+	// Тип определяется по первым 512 байтам, как в http.DetectContentType
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return Attachment{}, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return Attachment{}, err
+	}
+
+	key, err := newBlobKey()
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	hash := sha256.New()
+	size, err := s.blobs.Put(ctx, key, io.TeeReader(f, hash))
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	return Attachment{
+		Name:       attachmentName(file.Filename),
+		MIMEType:   detectMIMEType(head[:n], file.Header.Get("Content-Type")),
+		Size:       size,
+		Checksum:   hex.EncodeToString(hash.Sum(nil)),
+		StorageKey: key,
+	}, nil
+}
+
+// Скачать содержимое вложения. Поддерживаются запросы диапазонов (Range) и условные запросы по ETag
+func (s *Service) downloadAttachment(w http.ResponseWriter, r *http.Request) {
+	userID := callerID(r.Context())
+
+	attachmentID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, InvalidParam, "Недопустимый id вложения")
+		return
+	}
+
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
+
+	// Вложения видят только участники чата. Отсутствующее вложение, вложение удаленного сообщения
+	// и вложение чужого чата не различаются, чтобы по ответу нельзя было узнать о существовании вложения
+	notExist := fmt.Errorf("вложение c id %d %w", attachmentID, ErrNotExist)
+	attachment, err := s.connector.getAttachment(ctx, attachmentID)
+	if err != nil {
+		if errors.Is(err, ErrNotExist) {
+			err = notExist
+		}
+		writeStorageError(ctx, w, err, "Не удалось получить вложение")
+		return
+	}
+
+	message, err := s.connector.getMessage(ctx, attachment.Message)
+	if errors.Is(err, ErrNotExist) || (err == nil && message.DeletedAt != "") {
+		err = notExist
+	}
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось получить сообщение")
+		return
+	}
+
+	isMember, err := s.connector.isMember(ctx, message.Chat, userID)
+	if err == nil && !isMember {
+		err = notExist
+	}
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось проверить участника чата")
+		return
+	}
+
+	blob, err := s.blobs.Open(r.Context(), attachment.StorageKey)
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось открыть содержимое вложения")
+		return
+	}
+	defer blob.Close()
+
+	disposition := "attachment"
+	if inlineMIMETypes[attachment.MIMEType] {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", attachment.MIMEType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", `"`+attachment.Checksum+`"`)
+
+	modified, _ := time.ParseInLocation(timeLayout, attachment.CreatedAt, time.Local)
+	http.ServeContent(w, r, attachment.Name, modified, blob)
+}
+
+// Получить список чатов пользователя
+func (s *Service) getChats(w http.ResponseWriter, r *http.Request) {
+	userID := callerID(r.Context())
+
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
+
+	// Получаем чаты
+	chats, err := s.connector.getCharts(ctx, userID)
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось получить чаты")
+		return
+	}
+
+	responseBody := struct {
+		Chats []Chat `json:"chats"`
+	}{
+		Chats: chats,
+	}
+
+	writeResponse(w, http.StatusOK, responseBody)
+}
+
+// Параметры страницы истории сообщений, общие для истории чата и ветки ответов
+type pageRequest struct {
+	Limit     int    `json:"limit"`     // размер страницы, по умолчанию defaultPageLimit
+	BeforeID  uint64 `json:"before_id"` // сообщения, отправленные раньше указанного
+	AfterID   uint64 `json:"after_id"`  // сообщения, отправленные позже указанного
+	Direction string `json:"direction"` // forward или backward, если не задан якорь
+	Cursor    string `json:"cursor"`    // next_cursor предыдущей страницы, заменяет остальные параметры
+}
+
+// Проверка параметров страницы, при ошибке отвечает кодом 400. Якорь before_id/after_id разрешается отдельно
+func parsePage(w http.ResponseWriter, request pageRequest) (MessagePage, bool) {
+	page := MessagePage{Limit: request.Limit}
+	if page.Limit == 0 {
+		page.Limit = defaultPageLimit
+	}
+	if page.Limit < 0 || page.Limit > maxPageLimit {
+		writeError(w, http.StatusBadRequest, InvalidParam, fmt.Sprintf("Размер страницы должен быть от 1 до %d", maxPageLimit))
+		return MessagePage{}, false
+	}
+	if request.BeforeID != 0 && request.AfterID != 0 {
+		writeError(w, http.StatusBadRequest, InvalidParam, "Нельзя одновременно задать before_id и after_id")
+		return MessagePage{}, false
+	}
+
+	switch request.Direction {
+	case "", "forward":
+		page.Direction = PageForward
+	case "backward":
+		page.Direction = PageBackward
+	default:
+		writeError(w, http.StatusBadRequest, InvalidParam, "Направление должно быть forward или backward")
+		return MessagePage{}, false
+	}
+
+	if request.Cursor != "" {
+		cursor, direction, err := decodePageCursor(request.Cursor)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, InvalidParam, errorDescription(err))
+			return MessagePage{}, false
+		}
+		page.Cursor, page.Direction = &cursor, direction
+	}
+
+	return page, true
+}
+
+// Позиция якорного сообщения before_id/after_id, если страница не задана курсором.
+// Якорь должен быть в чате chatID, а для ветки ответов - еще и в ветке threadRoot
+func (s *Service) resolveAnchor(ctx context.Context, w http.ResponseWriter, request pageRequest, page *MessagePage,
+	chatID uint64, threadRoot uint64) bool {
+	if page.Cursor != nil || (request.BeforeID == 0 && request.AfterID == 0) {
+		return true
+	}
+
+	anchorID, direction := request.AfterID, PageForward
+	if request.BeforeID != 0 {
+		anchorID, direction = request.BeforeID, PageBackward
+	}
+
+	anchor, err := s.connector.getMessage(ctx, anchorID)
+	if err == nil && anchor.Chat != chatID {
+		err = fmt.Errorf("сообщение c id %d в чате %d %w", anchorID, chatID, ErrNotExist)
+	}
+	if err == nil && threadRoot != 0 && anchor.ThreadRoot != threadRoot {
+		err = fmt.Errorf("сообщение c id %d в ветке %d %w", anchorID, threadRoot, ErrNotExist)
+	}
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось получить сообщение")
+		return false
+	}
+
+	page.Cursor = &MessageCursor{CreatedAt: anchor.CreatedAt, ID: anchor.ID}
+	page.Direction = direction
+	return true
+}
+
+// Курсор следующей страницы, которая продолжается от последнего выданного сообщения в направлении выборки
+func nextPageCursor(messages []Message, page MessagePage, hasMore bool) string {
+	if !hasMore {
+		return ""
+	}
+
+	last := messages[len(messages)-1]
+	if page.Direction == PageBackward {
+		last = messages[0]
+	}
+	return encodePageCursor(MessageCursor{CreatedAt: last.CreatedAt, ID: last.ID}, page.Direction)
+}
+
+// В небольших чатах сообщения дополняются списком прочитавших участников
+func (s *Service) fillChatReadBy(ctx context.Context, w http.ResponseWriter, chatID uint64, messages []Message) bool {
+	if len(messages) == 0 {
+		return true
+	}
+
+	cursors, err := s.connector.getReadCursors(ctx, chatID)
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось получить отметки о прочтении")
+		return false
+	}
+	if len(cursors) <= s.config.ReadByLimit {
+		fillReadBy(messages, cursors)
+	}
+
+	return true
+}
+
+// Сообщения дополняются реакциями участников с отметкой реакций пользователя userID.
+// Реакции на удаленные сообщения не выдаются
+func (s *Service) fillReactions(ctx context.Context, w http.ResponseWriter, userID uint64, messages []Message) bool {
+	ids := make([]uint64, 0, len(messages))
+	for _, message := range messages {
+		if message.DeletedAt == "" {
+			ids = append(ids, message.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return true
+	}
+
+	reactions, err := s.connector.getReactions(ctx, ids, userID)
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось получить реакции")
+		return false
+	}
+	for i := range messages {
+		if messages[i].DeletedAt == "" {
+			messages[i].Reactions = reactions[messages[i].ID]
+		}
+	}
+
+	return true
+}
+
+// Сообщения дополняются метаданными вложений. Вложения удаленных сообщений не выдаются
+func (s *Service) fillAttachments(ctx context.Context, w http.ResponseWriter, messages []Message) bool {
+	ids := make([]uint64, 0, len(messages))
+	for _, message := range messages {
+		if message.DeletedAt == "" {
+			ids = append(ids, message.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return true
+	}
+
+	attachments, err := s.connector.getAttachments(ctx, ids)
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось получить вложения")
+		return false
+	}
+	for i := range messages {
+		if messages[i].DeletedAt == "" {
+			messages[i].Attachments = attachments[messages[i].ID]
+		}
+	}
+
+	return true
+}
+
+// Получить страницу истории сообщений чата
+func (s *Service) getMessages(w http.ResponseWriter, r *http.Request) {
+	requestBody := struct {
+		ChatID uint64 `json:"chat"`
+		pageRequest
+	}{}
+	userID := callerID(r.Context())
+
+	if !readRequest(w, r, &requestBody) {
+		return
+	}
+
+	// Проверка полей
+	page, ok := parsePage(w, requestBody.pageRequest)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
+
+	// Проверяем существование чата
+	isExist, err := s.connector.checkChartID(ctx, requestBody.ChatID)
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось проверить пользователя")
+		return
+	}
+	if !isExist {
+		writeError(w, http.StatusBadRequest, NotExist, fmt.Sprintf("Чат c id %d не существует", requestBody.ChatID))
+		return
+	}
+
+	// Историю чата видят только его участники
+	if !s.checkMember(ctx, w, requestBody.ChatID, userID) {
+		return
+	}
+
+	if !s.resolveAnchor(ctx, w, requestBody.pageRequest, &page, requestBody.ChatID, 0) {
+		return
+	}
+
+	// Получаем сообщения
+	messages, hasMore, err := s.connector.getMessages(ctx, requestBody.ChatID, page)
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось получить сообщения")
+		return
+	}
+
+	if !s.fillChatReadBy(ctx, w, requestBody.ChatID, messages) || !s.fillReactions(ctx, w, userID, messages) ||
+		!s.fillAttachments(ctx, w, messages) {
+		return
+	}
+
+	responseBody := struct {
+		Messages   []Message `json:"messages"`
+		NextCursor string    `json:"next_cursor,omitempty"`
+	}{
+		Messages:   messages,
+		NextCursor: nextPageCursor(messages, page, hasMore),
+	}
+
+	writeResponse(w, http.StatusOK, responseBody)
+}
+
+// Получить первое сообщение ветки и страницу ответов в ней по любому сообщению ветки
+func (s *Service) getThread(w http.ResponseWriter, r *http.Request) {
+	requestBody := struct {
+		MessageID uint64 `json:"message"`
+		pageRequest
+	}{}
+	userID := callerID(r.Context())
+
+	if !readRequest(w, r, &requestBody) {
+		return
+	}
+
+	// Проверка полей
+	page, ok := parsePage(w, requestBody.pageRequest)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
+
+	// Ответ ведет к первому сообщению своей ветки
+	root, err := s.connector.getMessage(ctx, requestBody.MessageID)
+	if err == nil && root.ThreadRoot != 0 {
+		root, err = s.connector.getMessage(ctx, root.ThreadRoot)
+	}
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось получить сообщение")
+		return
+	}
+
+	// Ветку видят только участники чата
+	if !s.checkMember(ctx, w, root.Chat, userID) {
+		return
+	}
+
+	if !s.resolveAnchor(ctx, w, requestBody.pageRequest, &page, root.Chat, root.ID) {
+		return
+	}
+
+	// Получаем ответы
+	messages, hasMore, err := s.connector.getThread(ctx, root.ID, page)
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось получить ответы")
+		return
+	}
+
+	thread := append([]Message{root}, messages...)
+	if !s.fillChatReadBy(ctx, w, root.Chat, thread) || !s.fillReactions(ctx, w, userID, thread) || !s.fillAttachments(ctx, w, thread) {
+		return
+	}
+
+	responseBody := struct {
+		Root       Message   `json:"root"`
+		Messages   []Message `json:"messages"`
+		NextCursor string    `json:"next_cursor,omitempty"`
+	}{
+		Root:       thread[0],
+		Messages:   thread[1:],
+		NextCursor: nextPageCursor(messages, page, hasMore),
+	}
+
+	writeResponse(w, http.StatusOK, responseBody)
+}
+
+// Добавить пользователей в чат от лица участника с правом управления участниками
+func (s *Service) addMembers(w http.ResponseWriter, r *http.Request) {
+	requestBody := struct {
+		ChatID uint64   `json:"chat"`
+		Users  []uint64 `json:"users"`
+	}{}
+	userID := callerID(r.Context())
+
+	if !readRequest(w, r, &requestBody) {
+		return
+	}
+
+	// Проверка полей
+	users := uniqueIDs(requestBody.Users)
+	if len(users) == 0 {
+		writeError(w, http.StatusBadRequest, EmptyFields, "Не заданы добавляемые пользователи")
+		return
+	}
+
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
+
+	if !s.checkChat(ctx, w, requestBody.ChatID) {
+		return
+	}
+	if _, ok := s.checkPermission(ctx, w, requestBody.ChatID, userID, PermManageMembers); !ok {
+		return
+	}
+
+	messages, err := s.connector.addMembers(ctx, requestBody.ChatID, userID, users)
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось добавить участников")
+		return
+	}
+
+	s.publish(r.Context(), Event{Type: EventMembersAdded, Members: &Membership{Chat: requestBody.ChatID, Users: users}})
+	for i := range messages {
+		s.publish(r.Context(), Event{Type: EventMessageCreated, Message: &messages[i]})
+	}
+
+	responseBody := struct {
+		Messages []Message `json:"messages"`
+	}{
+		Messages: messages,
+	}
+
+	writeResponse(w, http.StatusOK, responseBody)
+}
+
+// Исключить участника из чата от лица участника со старшей ролью и правом управления участниками
+func (s *Service) removeMember(w http.ResponseWriter, r *http.Request) {
+	requestBody := struct {
+		ChatID uint64 `json:"chat"`
+		UserID uint64 `json:"user"`
+	}{}
+
+	if !readRequest(w, r, &requestBody) {
+		return
+	}
+
+	s.changeMembership(w, r, requestBody.ChatID, requestBody.UserID)
+}
+
+// Покинуть чат от лица пользователя из токена
+func (s *Service) leaveChat(w http.ResponseWriter, r *http.Request) {
+	requestBody := struct {
+		ChatID uint64 `json:"chat"`
+	}{}
+
+	if !readRequest(w, r, &requestBody) {
+		return
+	}
+
+	s.changeMembership(w, r, requestBody.ChatID, callerID(r.Context()))
+}
+
+// Исключение участника из чата, участник может исключить и сам себя.
+// Владелец не может покинуть чат
+func (s *Service) changeMembership(w http.ResponseWriter, r *http.Request, chatID uint64, memberID uint64) {
+	userID := callerID(r.Context())
+
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
+
+	if !s.checkChat(ctx, w, chatID) {
+		return
+	}
+
+	if memberID == userID {
+		role, ok := s.memberRole(ctx, w, chatID, userID)
+		if !ok {
+			return
+		}
+		if role == RoleOwner {
+			writeError(w, http.StatusForbidden, PermissionDenied, fmt.Sprintf("Владелец не может покинуть чат c id %d", chatID))
+			return
+		}
+	} else {
+		role, ok := s.checkPermission(ctx, w, chatID, userID, PermManageMembers)
+		if !ok {
+			return
+		}
+
+		memberRole, err := s.connector.getRole(ctx, chatID, memberID)
+		if err != nil {
+			writeStorageError(ctx, w, err, "Не удалось проверить участника чата")
+			return
+		}
+		if memberRole == "" {
+			writeError(w, http.StatusBadRequest, NotExist, fmt.Sprintf("Пользователь c id %d в чате c id %d не существует", memberID, chatID))
+			return
+		}
+		if !roleOutranks(role, memberRole) {
+			writeError(w, http.StatusForbidden, PermissionDenied, fmt.Sprintf("Роль %s не позволяет исключить участника с ролью %s", role, memberRole))
+			return
+		}
+	}
+
+	message, err := s.connector.removeMember(ctx, chatID, userID, memberID)
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось исключить участника")
+		return
+	}
+
+	s.publish(r.Context(), Event{Type: EventMessageCreated, Message: &message})
+	s.publish(r.Context(), Event{Type: EventMembersRemoved, Members: &Membership{Chat: chatID, Users: []uint64{memberID}}})
+
+	responseBody := struct {
+		Message Message `json:"message"`
 	}{
-		Chats: chats,
+		Message: message,
+	}
+
+	writeResponse(w, http.StatusOK, responseBody)
+}
+
+// Назначить роль участнику чата от лица владельца
+func (s *Service) setRole(w http.ResponseWriter, r *http.Request) {
+	requestBody := struct {
+		ChatID uint64 `json:"chat"`
+		UserID uint64 `json:"user"`
+		Role   string `json:"role"`
+	}{}
+	userID := callerID(r.Context())
+
+	if !readRequest(w, r, &requestBody) {
+		return
+	}
+
+	// Проверка полей
+	if requestBody.Role == "" {
+		writeError(w, http.StatusBadRequest, EmptyFields, "Не задана роль")
+		return
+	}
+	if !assignableRole(requestBody.Role) {
+		writeError(w, http.StatusBadRequest, InvalidParam, fmt.Sprintf("Роль %s не может быть назначена", requestBody.Role))
+		return
+	}
+	if requestBody.UserID == userID {
+		writeError(w, http.StatusForbidden, PermissionDenied, "Нельзя изменить собственную роль")
+		return
+	}
+
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
+
+	if !s.checkChat(ctx, w, requestBody.ChatID) {
+		return
+	}
+	if _, ok := s.checkPermission(ctx, w, requestBody.ChatID, userID, PermManageRoles); !ok {
+		return
+	}
+
+	if err := s.connector.setRole(ctx, requestBody.ChatID, requestBody.UserID, requestBody.Role); err != nil {
+		writeStorageError(ctx, w, err, "Не удалось назначить роль")
+		return
+	}
+
+	responseBody := struct {
+		ChatID uint64 `json:"chat"`
+		UserID uint64 `json:"user"`
+		Role   string `json:"role"`
+	}{
+		ChatID: requestBody.ChatID,
+		UserID: requestBody.UserID,
+		Role:   requestBody.Role,
+	}
+
+	writeResponse(w, http.StatusOK, responseBody)
+}
+
+// Изменить текст сообщения от лица автора
+func (s *Service) editMessage(w http.ResponseWriter, r *http.Request) {
+	requestBody := struct {
+		MessageID uint64 `json:"message"`
+		Text      string `json:"text"`
+	}{}
+	userID := callerID(r.Context())
+
+	if !readRequest(w, r, &requestBody) {
+		return
+	}
+
+	// Проверка полей
+	if requestBody.Text == "" {
+		writeError(w, http.StatusBadRequest, EmptyFields, "Не задан текст сообщения")
+		return
+	}
+	if !checkMessageLength(w, requestBody.Text) {
+		return
+	}
+
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
+
+	if _, ok := s.editableMessage(ctx, w, requestBody.MessageID, userID, false); !ok {
+		return
 	}
 
-	body, err = json.Marshal(responseBody)
+	message, err := s.connector.editMessage(ctx, requestBody.MessageID, requestBody.Text)
 	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось замаршалить ответ")
-		w.WriteHeader(http.StatusInternalServerError)
+		writeStorageError(ctx, w, err, "Не удалось изменить сообщение")
 		return
 	}
+	s.publish(r.Context(), Event{Type: EventMessageEdited, Message: &message})
 
-	w.WriteHeader(http.StatusOK)
-	w.Write(body)
+	writeResponse(w, http.StatusOK, message)
 }
 
-// Получить список сообщений в конкретном чате
-func (s *Service) getMessages(w http.ResponseWriter, r *http.Request) {
+// Удалить сообщение от лица автора или модератора чата. В истории чата остается сообщение без текста с временем удаления
+func (s *Service) deleteMessage(w http.ResponseWriter, r *http.Request) {
 	requestBody := struct {
-		ChatID uint64 `json:"chat"`
+		MessageID uint64 `json:"message"`
 	}{}
+	userID := callerID(r.Context())
 
-	body, err := ioutil.ReadAll(r.Body)
+	if !readRequest(w, r, &requestBody) {
+		return
+	}
+
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
+
+	if _, ok := s.editableMessage(ctx, w, requestBody.MessageID, userID, true); !ok {
+		return
+	}
+
+	message, err := s.connector.deleteMessage(ctx, requestBody.MessageID)
 	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось прочитать тело")
-		w.WriteHeader(http.StatusBadRequest)
+		writeStorageError(ctx, w, err, "Не удалось удалить сообщение")
 		return
 	}
-	defer r.Body.Close()
+	s.publish(r.Context(), Event{Type: EventMessageDeleted, Message: &message})
 
-	if err := json.Unmarshal(body, &requestBody); err != nil {
-		log.Warn().Err(err).Msg("Не удалось анмаршалить тело")
-		w.WriteHeader(http.StatusBadRequest)
+	writeResponse(w, http.StatusOK, message)
+}
+
+// Получить предыдущие версии текста сообщения от лица автора или модератора чата
+func (s *Service) getRevisions(w http.ResponseWriter, r *http.Request) {
+	requestBody := struct {
+		MessageID uint64 `json:"message"`
+	}{}
+	userID := callerID(r.Context())
+
+	if !readRequest(w, r, &requestBody) {
+		return
+	}
+
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
+
+	if _, ok := s.editableMessage(ctx, w, requestBody.MessageID, userID, true); !ok {
+		return
+	}
+
+	revisions, err := s.connector.getRevisions(ctx, requestBody.MessageID)
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось получить историю сообщения")
+		return
+	}
+
+	responseBody := struct {
+		Revisions []MessageRevision `json:"revisions"`
+	}{
+		Revisions: revisions,
+	}
+
+	writeResponse(w, http.StatusOK, responseBody)
+}
+
+// Отметить сообщения чата прочитанными пользователем из токена до указанного сообщения включительно.
+// Если сообщение не указано, чат отмечается прочитанным полностью
+func (s *Service) markRead(w http.ResponseWriter, r *http.Request) {
+	requestBody := struct {
+		ChatID    uint64 `json:"chat"`
+		MessageID uint64 `json:"message"`
+	}{}
+	userID := callerID(r.Context())
+
+	if !readRequest(w, r, &requestBody) {
 		return
 	}
 
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
+
 	// Проверяем существование чата
-	isExist, err := s.connector.checkChartID(requestBody.ChatID)
+	isExist, err := s.connector.checkChartID(ctx, requestBody.ChatID)
 	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось проверить пользователя")
-		w.WriteHeader(http.StatusInternalServerError)
+		writeStorageError(ctx, w, err, "Не удалось проверить чат")
 		return
 	}
 	if !isExist {
-		responseBody := ErrorResponse{
-			ErrorCode:   NotExist,
-			Description: fmt.Sprintf("Чат c id %d не существует", requestBody.ChatID),
-		}
+		writeError(w, http.StatusBadRequest, NotExist, fmt.Sprintf("Чат c id %d не существует", requestBody.ChatID))
+		return
+	}
+
+	if !s.checkMember(ctx, w, requestBody.ChatID, userID) {
+		return
+	}
 
-		body, err = json.Marshal(responseBody)
+	// Определяем сообщение, до которого прочитан чат
+	messageID := requestBody.MessageID
+	if messageID == 0 {
+		last, _, err := s.connector.getMessages(ctx, requestBody.ChatID, MessagePage{Limit: 1, Direction: PageBackward})
 		if err != nil {
-			log.Warn().Err(err).Msg("Не удалось замаршалить ответ")
-			w.WriteHeader(http.StatusInternalServerError)
+			writeStorageError(ctx, w, err, "Не удалось получить сообщения")
 			return
 		}
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(body)
+		if len(last) > 0 {
+			messageID = last[0].ID
+		}
+	} else {
+		message, err := s.connector.getMessage(ctx, messageID)
+		if err == nil && message.Chat != requestBody.ChatID {
+			err = fmt.Errorf("сообщение c id %d в чате %d %w", messageID, requestBody.ChatID, ErrNotExist)
+		}
+		if err != nil {
+			writeStorageError(ctx, w, err, "Не удалось получить сообщение")
+			return
+		}
+	}
+
+	lastReadID, err := s.connector.markRead(ctx, requestBody.ChatID, userID, messageID)
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось отметить сообщения прочитанными")
 		return
 	}
 
-	// Получаем сообщения
-	messages, err := s.connector.getMessages(requestBody.ChatID)
+	receipt := ReadReceipt{Chat: requestBody.ChatID, User: userID, LastReadID: lastReadID}
+	s.publish(r.Context(), Event{Type: EventMessagesRead, Read: &receipt})
+
+	writeResponse(w, http.StatusOK, receipt)
+}
+
+// Заполнение списков прочитавших по курсорам прочтения участников. Автор сообщения в список не входит
+func fillReadBy(messages []Message, cursors map[uint64]uint64) {
+	members := make([]uint64, 0, len(cursors))
+	for userID := range cursors {
+		members = append(members, userID)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i] < members[j] })
+
+	for i := range messages {
+		for _, userID := range members {
+			if cursors[userID] >= messages[i].ID && messages[i].Author != strconv.FormatUint(userID, 10) {
+				messages[i].ReadBy = append(messages[i].ReadBy, userID)
+			}
+		}
+	}
+}
+
+// Найти сообщения по словам в чатах пользователя из токена. Найденные сообщения выдаются
+// от поздних к ранним, страницы продолжаются курсором
+func (s *Service) searchMessages(w http.ResponseWriter, r *http.Request) {
+	requestBody := struct {
+		Query    string `json:"query"`
+		ChatID   uint64 `json:"chat"`   // искать только в чате
+		AuthorID uint64 `json:"author"` // искать только сообщения автора
+		From     string `json:"from"`   // отправленные не раньше даты или времени
+		To       string `json:"to"`     // отправленные не позже даты или времени
+		Limit    int    `json:"limit"`
+		Cursor   string `json:"cursor"`
+	}{}
+	userID := callerID(r.Context())
+
+	if !readRequest(w, r, &requestBody) {
+		return
+	}
+
+	// Проверка полей
+	if strings.TrimSpace(requestBody.Query) == "" {
+		writeError(w, http.StatusBadRequest, EmptyFields, "Не задан поисковый запрос")
+		return
+	}
+
+	query := SearchQuery{Terms: searchTerms(requestBody.Query), Chat: requestBody.ChatID, Author: requestBody.AuthorID}
+	if len(query.Terms) == 0 {
+		writeError(w, http.StatusBadRequest, InvalidParam, fmt.Sprintf("Запрос должен содержать слово не короче %d символов", minSearchTermLength))
+		return
+	}
+	if len(query.Terms) > maxSearchTerms {
+		writeError(w, http.StatusBadRequest, InvalidParam, fmt.Sprintf("Запрос может содержать не больше %d слов", maxSearchTerms))
+		return
+	}
+
+	var err error
+	if query.From, err = searchTime(requestBody.From, false); err != nil {
+		writeError(w, http.StatusBadRequest, InvalidParam, "Дата from должна быть в формате 2006-01-02 или 2006-01-02 15:04:05")
+		return
+	}
+	if query.Before, err = searchTime(requestBody.To, true); err != nil {
+		writeError(w, http.StatusBadRequest, InvalidParam, "Дата to должна быть в формате 2006-01-02 или 2006-01-02 15:04:05")
+		return
+	}
+
+	page, ok := parsePage(w, pageRequest{Limit: requestBody.Limit, Cursor: requestBody.Cursor})
+	if !ok {
+		return
+	}
+	page.Direction = PageBackward
+
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
+
+	// Поиск в чате доступен только его участникам, без чата поиск идет по всем чатам пользователя
+	if query.Chat != 0 && (!s.checkChat(ctx, w, query.Chat) || !s.checkMember(ctx, w, query.Chat, userID)) {
+		return
+	}
+
+	messages, hasMore, err := s.connector.searchMessages(ctx, userID, query, page)
 	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось создать чат")
-		w.WriteHeader(http.StatusInternalServerError)
+		writeStorageError(ctx, w, err, "Не удалось найти сообщения")
 		return
 	}
 
 	responseBody := struct {
-		Messages []Message `json:"messages"`
+		Results    []SearchHit `json:"results"`
+		NextCursor string      `json:"next_cursor,omitempty"`
 	}{
-		Messages: messages,
+		Results:    make([]SearchHit, 0, len(messages)),
+		NextCursor: nextPageCursor(messages, page, hasMore),
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		responseBody.Results = append(responseBody.Results, SearchHit{
+			Message: messages[i],
+			Snippet: searchSnippet(messages[i].Text, query.Terms),
+		})
+	}
+
+	writeResponse(w, http.StatusOK, responseBody)
+}
+
+// Граница поиска по времени отправки в формате timeLayout. Верхняя граница включает указанные день или секунду,
+// поэтому возвращается следующий за ними момент
+func searchTime(value string, upper bool) (string, error) {
+	if value == "" {
+		return "", nil
 	}
 
-	body, err = json.Marshal(responseBody)
+	t, err := time.ParseInLocation(timeLayout, value, time.Local)
+	next := func(t time.Time) time.Time { return t.Add(time.Second) }
 	if err != nil {
-		log.Warn().Err(err).Msg("Не удалось замаршалить ответ")
-		w.WriteHeader(http.StatusInternalServerError)
+		t, err = time.ParseInLocation("2006-01-02", value, time.Local)
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if upper {
+		t = next(t)
+	}
+	return t.Format(timeLayout), nil
+}
+
+// Поставить реакцию на сообщение от лица участника с правом отправки сообщений
+func (s *Service) addReaction(w http.ResponseWriter, r *http.Request) {
+	s.changeReaction(w, r, true)
+}
+
+// Снять свою реакцию с сообщения. Снять реакцию может любой участник чата
+func (s *Service) removeReaction(w http.ResponseWriter, r *http.Request) {
+	s.changeReaction(w, r, false)
+}
+
+// Добавление или снятие реакции, в ответ выдаются реакции на сообщение
+func (s *Service) changeReaction(w http.ResponseWriter, r *http.Request, add bool) {
+	requestBody := struct {
+		MessageID uint64 `json:"message"`
+		Reaction  string `json:"reaction"`
+	}{}
+	userID := callerID(r.Context())
+
+	if !readRequest(w, r, &requestBody) {
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write(body)
+	// Проверка полей
+	if requestBody.Reaction == "" {
+		writeError(w, http.StatusBadRequest, EmptyFields, "Не задана реакция")
+		return
+	}
+	if !validReaction(requestBody.Reaction) {
+		writeError(w, http.StatusBadRequest, InvalidParam,
+			fmt.Sprintf("Реакция должна быть эмодзи или его коротким именем вида :thumbsup: длиной до %d байт", maxReactionLength))
+		return
+	}
+
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
+
+	message, err := s.connector.getMessage(ctx, requestBody.MessageID)
+	if err == nil && message.DeletedAt != "" {
+		err = fmt.Errorf("сообщение c id %d %w", requestBody.MessageID, ErrNotExist)
+	}
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось получить сообщение")
+		return
+	}
+
+	if message.Kind != "" {
+		writeError(w, http.StatusForbidden, Forbidden, fmt.Sprintf("На системное сообщение c id %d нельзя реагировать", requestBody.MessageID))
+		return
+	}
+
+	eventType := EventReactionRemoved
+	if add {
+		eventType = EventReactionAdded
+		if _, ok := s.checkPermission(ctx, w, message.Chat, userID, PermPost); !ok {
+			return
+		}
+		err = s.connector.addReaction(ctx, message.ID, userID, requestBody.Reaction)
+	} else {
+		if !s.checkMember(ctx, w, message.Chat, userID) {
+			return
+		}
+		err = s.connector.removeReaction(ctx, message.ID, userID, requestBody.Reaction)
+	}
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось изменить реакцию")
+		return
+	}
+
+	change := ReactionChange{Chat: message.Chat, Message: message.ID, User: userID, Reaction: requestBody.Reaction}
+	s.publish(r.Context(), Event{Type: eventType, Reaction: &change})
+
+	reactions, err := s.connector.getReactions(ctx, []uint64{message.ID}, userID)
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось получить реакции")
+		return
+	}
+
+	responseBody := struct {
+		MessageID uint64     `json:"message"`
+		Reactions []Reaction `json:"reactions"`
+	}{
+		MessageID: message.ID,
+		Reactions: reactions[message.ID],
+	}
+	if responseBody.Reactions == nil {
+		responseBody.Reactions = []Reaction{}
+	}
+
+	writeResponse(w, http.StatusOK, responseBody)
+}
+
+// Подписаться по WebSocket на события чатов пользователя из токена
+func (s *Service) subscribe(w http.ResponseWriter, r *http.Request) {
+	userID := callerID(r.Context())
+
+	ctx, cancel := s.storageContext(r)
+	chats, err := s.connector.getCharts(ctx, userID)
+	cancel()
+	if err != nil {
+		writeStorageError(ctx, w, err, "Не удалось получить чаты")
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warn().Err(err).Msg("Не удалось установить WebSocket подключение")
+		return
+	}
+
+	client := &wsClient{
+		hub:    s.hub,
+		conn:   conn,
+		userID: userID,
+		send:   make(chan []byte, s.config.WSSendBuffer),
+		chats:  make(map[uint64]struct{}),
+	}
+
+	chatIDs := make([]uint64, 0, len(chats))
+	for _, chat := range chats {
+		chatIDs = append(chatIDs, chat.ID)
+	}
+
+	if !s.hub.register(client, chatIDs) {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+		conn.Close()
+		return
+	}
+
+	go client.writePump(s.config.WSPingInterval)
+	go client.readPump(2 * s.config.WSPingInterval)
+}
+
+// Проверка жизнеспособности: процесс отвечает на запросы. Хранилище не проверяется,
+// чтобы недоступность БД не приводила к перезапуску сервиса
+func (s *Service) healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, "ok")
+}
+
+// Проверка готовности: сервис не останавливается и хранилище доступно
+func (s *Service) readyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		writeHealth(w, http.StatusServiceUnavailable, "stopping")
+		return
+	}
+
+	ctx, cancel := s.storageContext(r)
+	defer cancel()
+	if err := s.connector.ping(ctx); err != nil {
+		log.Warn().Err(err).Msg("Хранилище недоступно")
+		writeHealth(w, http.StatusServiceUnavailable, "storage unavailable")
+		return
+	}
+
+	writeHealth(w, http.StatusOK, "ok")
+}
+
+// Ответ проверки состояния сервиса
+func writeHealth(w http.ResponseWriter, status int, state string) {
+	responseBody := struct {
+		Status string `json:"status"`
+	}{
+		Status: state,
+	}
+
+	writeResponse(w, status, responseBody)
 }
@@ -0,0 +1,824 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Сервис на хранилище в памяти без ограничения частоты запросов и кэша
+func newTestService(t *testing.T) *Service {
+	t.Helper()
+
+	return newTestServiceWith(t, NewConnectorMemory())
+}
+
+// Сервис на заданном хранилище без ограничения частоты запросов и кэша
+func newTestServiceWith(t *testing.T, connector Connector) *Service {
+	t.Helper()
+	t.Setenv("BLOB_PATH", t.TempDir())
+
+	config, err := InitConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AuthSecret = "test-secret"
+	config.RateLimits = "off"
+	config.RateLimitStore = "local"
+	config.CacheStore = "off"
+	config.EventBus = "local"
+	config.BlobStoreType = "local"
+
+	service, err := NewService(config, connector)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return service
+}
+
+// Запрос к сервису с JSON телом от лица владельца токена. Тело ответа разбирается в response, если он задан
+func doRequest(t *testing.T, s *Service, path string, token string, body interface{}, response interface{}) int {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, r)
+
+	if response != nil && w.Body.Len() > 0 {
+		if err := json.Unmarshal(w.Body.Bytes(), response); err != nil {
+			t.Fatalf("%s: не удалось разобрать ответ %q: %v", path, w.Body.String(), err)
+		}
+	}
+
+	return w.Code
+}
+
+// Проверка кода ответа с ошибкой и кода ошибки
+func expectError(t *testing.T, status int, response ErrorResponse, wantStatus int, wantCode ErrorCodeType) {
+	t.Helper()
+
+	if status != wantStatus || response.ErrorCode != wantCode {
+		t.Fatalf("ответ %d %+v, ожидался %d с кодом %d", status, response, wantStatus, wantCode)
+	}
+}
+
+// Создание пользователя, возвращает его id и токен доступа
+func addUser(t *testing.T, s *Service, username string) (uint64, string) {
+	t.Helper()
+
+	response := struct {
+		ID    uint64 `json:"id"`
+		Token string `json:"token"`
+	}{}
+	status := doRequest(t, s, "/users/add", "", map[string]string{"username": username, "password": "secret"}, &response)
+	if status != http.StatusCreated || response.ID == 0 || response.Token == "" {
+		t.Fatalf("не удалось создать пользователя %s: %d %+v", username, status, response)
+	}
+
+	return response.ID, response.Token
+}
+
+// Создание чата от лица владельца токена, возвращает id чата
+func addChat(t *testing.T, s *Service, token string, name string, users ...uint64) uint64 {
+	t.Helper()
+
+	response := struct {
+		ID uint64 `json:"id"`
+	}{}
+	status := doRequest(t, s, "/chats/add", token, map[string]interface{}{"name": name, "users": users}, &response)
+	if status != http.StatusCreated || response.ID == 0 {
+		t.Fatalf("не удалось создать чат %s: %d", name, status)
+	}
+
+	return response.ID
+}
+
+// Отправка сообщения от лица владельца токена, возвращает id сообщения
+func addMessage(t *testing.T, s *Service, token string, chatID uint64, text string) uint64 {
+	t.Helper()
+
+	response := struct {
+		ID uint64 `json:"id"`
+	}{}
+	status := doRequest(t, s, "/messages/add", token, map[string]interface{}{"chat": chatID, "text": text}, &response)
+	if status != http.StatusCreated || response.ID == 0 {
+		t.Fatalf("не удалось отправить сообщение в чат %d: %d", chatID, status)
+	}
+
+	return response.ID
+}
+
+// Отправка сообщения с вложениями-файлами с указанным содержимым от лица владельца токена
+func uploadMessage(t *testing.T, s *Service, token string, chatID uint64, text string, files ...string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("chat", strconv.FormatUint(chatID, 10))
+	form.WriteField("text", text)
+	for i, content := range files {
+		file, err := form.CreateFormFile("file", fmt.Sprintf("file%d.txt", i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte(content))
+	}
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/messages/upload", body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestCreateUser(t *testing.T) {
+	s := newTestService(t)
+
+	firstID, _ := addUser(t, s, "alice")
+	secondID, _ := addUser(t, s, "bob")
+	if firstID == secondID {
+		t.Fatalf("пользователи получили одинаковый id %d", firstID)
+	}
+
+	// Занятое имя - ошибка клиента, а не хранилища
+	response := ErrorResponse{}
+	status := doRequest(t, s, "/users/add", "", map[string]string{"username": "alice", "password": "other"}, &response)
+	expectError(t, status, response, http.StatusBadRequest, AlreadyExist)
+
+	response = ErrorResponse{}
+	status = doRequest(t, s, "/users/add", "", map[string]string{"username": "carol"}, &response)
+	expectError(t, status, response, http.StatusBadRequest, EmptyFields)
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestService(t)
+	userID, _ := addUser(t, s, "alice")
+
+	response := struct {
+		ID    uint64 `json:"id"`
+		Token string `json:"token"`
+	}{}
+	status := doRequest(t, s, "/users/login", "", map[string]string{"username": "alice", "password": "secret"}, &response)
+	if status != http.StatusOK || response.ID != userID || response.Token == "" {
+		t.Fatalf("вход: %d %+v", status, response)
+	}
+
+	// Неверный пароль и отсутствующий пользователь не различаются
+	for _, username := range []string{"alice", "nobody"} {
+		errorResponse := ErrorResponse{}
+		status = doRequest(t, s, "/users/login", "", map[string]string{"username": username, "password": "wrong"}, &errorResponse)
+		expectError(t, status, errorResponse, http.StatusUnauthorized, Unauthorized)
+	}
+}
+
+func TestCreateChat(t *testing.T) {
+	s := newTestService(t)
+	_, aliceToken := addUser(t, s, "alice")
+	bobID, _ := addUser(t, s, "bob")
+
+	addChat(t, s, aliceToken, "general", bobID)
+
+	response := ErrorResponse{}
+	status := doRequest(t, s, "/chats/add", aliceToken, map[string]interface{}{"name": "general", "users": []uint64{}}, &response)
+	expectError(t, status, response, http.StatusBadRequest, AlreadyExist)
+
+	response = ErrorResponse{}
+	status = doRequest(t, s, "/chats/add", aliceToken, map[string]interface{}{"name": "other", "users": []uint64{bobID + 100}}, &response)
+	expectError(t, status, response, http.StatusBadRequest, NotExist)
+
+	response = ErrorResponse{}
+	status = doRequest(t, s, "/chats/add", aliceToken, map[string]interface{}{"users": []uint64{bobID}}, &response)
+	expectError(t, status, response, http.StatusBadRequest, EmptyFields)
+
+	response = ErrorResponse{}
+	status = doRequest(t, s, "/chats/add", "", map[string]interface{}{"name": "anonymous"}, &response)
+	expectError(t, status, response, http.StatusUnauthorized, Unauthorized)
+
+	// Чат с занятым названием не создан, поэтому у создателя остается один чат
+	chats := struct {
+		Chats []Chat `json:"chats"`
+	}{}
+	if status := doRequest(t, s, "/chats/get", aliceToken, nil, &chats); status != http.StatusOK || len(chats.Chats) != 1 {
+		t.Fatalf("чаты: %d %+v", status, chats)
+	}
+	if users := chats.Chats[0].Users; len(users) != 2 {
+		t.Fatalf("участники чата %v, ожидались создатель и bob", users)
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	s := newTestService(t)
+	_, aliceToken := addUser(t, s, "alice")
+	_, bobToken := addUser(t, s, "bob")
+	chatID := addChat(t, s, aliceToken, "general")
+
+	addMessage(t, s, aliceToken, chatID, "hello")
+
+	response := ErrorResponse{}
+	status := doRequest(t, s, "/messages/add", aliceToken, map[string]interface{}{"chat": chatID + 100, "text": "hello"}, &response)
+	expectError(t, status, response, http.StatusBadRequest, NotExist)
+
+	response = ErrorResponse{}
+	status = doRequest(t, s, "/messages/add", aliceToken, map[string]interface{}{"chat": chatID}, &response)
+	expectError(t, status, response, http.StatusBadRequest, EmptyFields)
+
+	response = ErrorResponse{}
+	status = doRequest(t, s, "/messages/add", aliceToken, map[string]interface{}{"chat": chatID, "text": "hi", "reply_to": 100}, &response)
+	expectError(t, status, response, http.StatusBadRequest, NotExist)
+
+	// Писать и читать чат могут только участники
+	response = ErrorResponse{}
+	status = doRequest(t, s, "/messages/add", bobToken, map[string]interface{}{"chat": chatID, "text": "hello"}, &response)
+	expectError(t, status, response, http.StatusForbidden, Forbidden)
+
+	response = ErrorResponse{}
+	status = doRequest(t, s, "/messages/get", bobToken, map[string]interface{}{"chat": chatID}, &response)
+	expectError(t, status, response, http.StatusForbidden, Forbidden)
+}
+
+func TestMessagesOrder(t *testing.T) {
+	s := newTestService(t)
+	_, aliceToken := addUser(t, s, "alice")
+	chatID := addChat(t, s, aliceToken, "general")
+
+	var ids []uint64
+	for _, text := range []string{"one", "two", "three", "four", "five"} {
+		ids = append(ids, addMessage(t, s, aliceToken, chatID, text))
+	}
+
+	page := struct {
+		Messages   []Message `json:"messages"`
+		NextCursor string    `json:"next_cursor"`
+	}{}
+	getPage := func(request map[string]interface{}) []uint64 {
+		t.Helper()
+
+		page.Messages, page.NextCursor = nil, ""
+		request["chat"] = chatID
+		if status := doRequest(t, s, "/messages/get", aliceToken, request, &page); status != http.StatusOK {
+			t.Fatalf("история чата: %d", status)
+		}
+
+		var result []uint64
+		for _, message := range page.Messages {
+			result = append(result, message.ID)
+		}
+		return result
+	}
+	expectIDs := func(got []uint64, want []uint64) {
+		t.Helper()
+
+		if len(got) != len(want) {
+			t.Fatalf("сообщения %v, ожидались %v", got, want)
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("сообщения %v, ожидались %v", got, want)
+			}
+		}
+	}
+
+	// Страница всегда упорядочена от раннего сообщения к позднему
+	expectIDs(getPage(map[string]interface{}{}), ids)
+	expectIDs(getPage(map[string]interface{}{"limit": 2}), ids[:2])
+	expectIDs(getPage(map[string]interface{}{"cursor": page.NextCursor, "limit": 2}), ids[2:4])
+	expectIDs(getPage(map[string]interface{}{"cursor": page.NextCursor, "limit": 2}), ids[4:])
+	if page.NextCursor != "" {
+		t.Fatalf("после последней страницы задан курсор %q", page.NextCursor)
+	}
+
+	expectIDs(getPage(map[string]interface{}{"direction": "backward", "limit": 2}), ids[3:])
+	expectIDs(getPage(map[string]interface{}{"cursor": page.NextCursor, "limit": 2}), ids[1:3])
+	expectIDs(getPage(map[string]interface{}{"before_id": ids[2]}), ids[:2])
+	expectIDs(getPage(map[string]interface{}{"after_id": ids[2]}), ids[3:])
+}
+
+func TestChatsOrder(t *testing.T) {
+	s := newTestService(t)
+	_, aliceToken := addUser(t, s, "alice")
+	firstID := addChat(t, s, aliceToken, "first")
+	secondID := addChat(t, s, aliceToken, "second")
+	thirdID := addChat(t, s, aliceToken, "third")
+
+	// Чаты с сообщениями идут по последнему сообщению, остальные - по времени создания
+	addMessage(t, s, aliceToken, secondID, "hello")
+	lastID := addMessage(t, s, aliceToken, firstID, "hello")
+
+	chats := struct {
+		Chats []Chat `json:"chats"`
+	}{}
+	if status := doRequest(t, s, "/chats/get", aliceToken, nil, &chats); status != http.StatusOK {
+		t.Fatalf("чаты: %d", status)
+	}
+
+	want := []uint64{firstID, secondID, thirdID}
+	if len(chats.Chats) != len(want) {
+		t.Fatalf("получено %d чатов, ожидалось %d", len(chats.Chats), len(want))
+	}
+	for i, chat := range chats.Chats {
+		if chat.ID != want[i] {
+			t.Fatalf("чат %d на позиции %d, ожидался %d", chat.ID, i, want[i])
+		}
+	}
+	if last := chats.Chats[0].LastMessage; last == nil || last.ID != lastID {
+		t.Fatalf("последнее сообщение первого чата %+v, ожидалось %d", last, lastID)
+	}
+	if chats.Chats[2].LastMessage != nil {
+		t.Fatalf("у чата без сообщений задано последнее сообщение")
+	}
+}
+
+func TestSendMessageLength(t *testing.T) {
+	s := newTestService(t)
+	_, token := addUser(t, s, "alice")
+	chatID := addChat(t, s, token, "general")
+
+	// Длина считается в символах, а не в байтах
+	addMessage(t, s, token, chatID, strings.Repeat("я", maxMessageLength))
+
+	response := ErrorResponse{}
+	status := doRequest(t, s, "/messages/add", token, map[string]interface{}{"chat": chatID, "text": strings.Repeat("я", maxMessageLength+1)}, &response)
+	expectError(t, status, response, http.StatusBadRequest, InvalidParam)
+
+	// Сообщение с вложениями ограничено так же
+	w := uploadMessage(t, s, token, chatID, strings.Repeat("я", maxMessageLength+1), "hello")
+
+	response = ErrorResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("ответ %q: %v", w.Body.String(), err)
+	}
+	expectError(t, w.Code, response, http.StatusBadRequest, InvalidParam)
+	if !strings.Contains(response.Description, strconv.Itoa(maxMessageLength)) {
+		t.Fatalf("сообщение с вложениями отклонено не по длине текста: %q", response.Description)
+	}
+}
+
+func TestEditMessageLength(t *testing.T) {
+	s := newTestService(t)
+	_, token := addUser(t, s, "alice")
+	chatID := addChat(t, s, token, "general")
+	messageID := addMessage(t, s, token, chatID, "hello")
+
+	response := ErrorResponse{}
+	status := doRequest(t, s, "/messages/edit", token, map[string]interface{}{"message": messageID, "text": strings.Repeat("я", maxMessageLength+1)}, &response)
+	expectError(t, status, response, http.StatusBadRequest, InvalidParam)
+
+	// Отклоненное изменение не попадает в историю
+	revisions := struct {
+		Revisions []MessageRevision `json:"revisions"`
+	}{}
+	if status := doRequest(t, s, "/messages/revisions", token, map[string]interface{}{"message": messageID}, &revisions); status != http.StatusOK || len(revisions.Revisions) != 0 {
+		t.Fatalf("история изменений: %d %+v", status, revisions)
+	}
+
+	if status := doRequest(t, s, "/messages/edit", token, map[string]interface{}{"message": messageID, "text": strings.Repeat("я", maxMessageLength)}, nil); status != http.StatusOK {
+		t.Fatalf("изменение текстом наибольшей длины: %d", status)
+	}
+}
+
+func TestDownloadAttachment(t *testing.T) {
+	s := newTestService(t)
+	_, aliceToken := addUser(t, s, "alice")
+	_, bobToken := addUser(t, s, "bob")
+	chatID := addChat(t, s, aliceToken, "general")
+
+	w := uploadMessage(t, s, aliceToken, chatID, "files", "hello")
+	message := Message{}
+	if err := json.Unmarshal(w.Body.Bytes(), &message); w.Code != http.StatusCreated || err != nil || len(message.Attachments) != 1 {
+		t.Fatalf("отправка вложения: %d %q", w.Code, w.Body.String())
+	}
+	attachmentID := message.Attachments[0].ID
+
+	download := func(token string, id uint64) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/attachments/%d", id), nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := download(aliceToken, attachmentID); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("скачивание участником: %d %q", w.Code, w.Body.String())
+	}
+
+	// Не участник не может отличить чужое вложение от отсутствующего
+	foreign := download(bobToken, attachmentID)
+	missing := download(bobToken, attachmentID+100)
+	response := ErrorResponse{}
+	json.Unmarshal(foreign.Body.Bytes(), &response)
+	expectError(t, foreign.Code, response, http.StatusBadRequest, NotExist)
+	if missing.Code != foreign.Code || strings.Replace(missing.Body.String(), strconv.FormatUint(attachmentID+100, 10), strconv.FormatUint(attachmentID, 10), 1) != foreign.Body.String() {
+		t.Fatalf("ответы различаются: %d %q и %d %q", foreign.Code, foreign.Body.String(), missing.Code, missing.Body.String())
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	s := newTestService(t)
+	ownerID, ownerToken := addUser(t, s, "owner")
+	adminID, adminToken := addUser(t, s, "admin")
+	memberID, memberToken := addUser(t, s, "member")
+	readonlyID, readonlyToken := addUser(t, s, "readonly")
+	outsiderID, outsiderToken := addUser(t, s, "outsider")
+	chatID := addChat(t, s, ownerToken, "chat", adminID, memberID, readonlyID)
+	for userID, role := range map[uint64]string{adminID: RoleAdmin, readonlyID: RoleReadOnly} {
+		if status := doRequest(t, s, "/chats/members/role", ownerToken, map[string]interface{}{"chat": chatID, "user": userID, "role": role}, nil); status != http.StatusOK {
+			t.Fatalf("назначение роли %s: %d", role, status)
+		}
+	}
+	adminMessage := addMessage(t, s, adminToken, chatID, "from admin")
+	memberMessage := addMessage(t, s, memberToken, chatID, "from member")
+
+	post := map[string]interface{}{"chat": chatID, "text": "hello"}
+	member := func(userID uint64) map[string]interface{} {
+		return map[string]interface{}{"chat": chatID, "user": userID}
+	}
+	role := func(userID uint64, role string) map[string]interface{} {
+		return map[string]interface{}{"chat": chatID, "user": userID, "role": role}
+	}
+	message := func(messageID uint64) map[string]interface{} {
+		return map[string]interface{}{"message": messageID}
+	}
+
+	// Случаи выполняются по порядку, действия, меняющие роли и состав чата, - в конце
+	cases := []struct {
+		name   string
+		token  string
+		path   string
+		body   map[string]interface{}
+		status int
+		code   ErrorCodeType
+	}{
+		{"владелец пишет", ownerToken, "/messages/add", post, http.StatusCreated, 0},
+		{"администратор пишет", adminToken, "/messages/add", post, http.StatusCreated, 0},
+		{"участник пишет", memberToken, "/messages/add", post, http.StatusCreated, 0},
+		{"читатель не пишет", readonlyToken, "/messages/add", post, http.StatusForbidden, PermissionDenied},
+		{"посторонний не пишет", outsiderToken, "/messages/add", post, http.StatusForbidden, Forbidden},
+		{"участник не добавляет участников", memberToken, "/chats/members/add", map[string]interface{}{"chat": chatID, "users": []uint64{outsiderID}}, http.StatusForbidden, PermissionDenied},
+		{"участник не исключает других", memberToken, "/chats/members/remove", member(readonlyID), http.StatusForbidden, PermissionDenied},
+		{"участник не назначает роли", memberToken, "/chats/members/role", role(readonlyID, RoleMember), http.StatusForbidden, PermissionDenied},
+		{"администратор не назначает роли", adminToken, "/chats/members/role", role(memberID, RoleReadOnly), http.StatusForbidden, PermissionDenied},
+		{"администратор не понижает владельца", adminToken, "/chats/members/role", role(ownerID, RoleMember), http.StatusForbidden, PermissionDenied},
+		{"администратор не исключает владельца", adminToken, "/chats/members/remove", member(ownerID), http.StatusForbidden, PermissionDenied},
+		{"владелец не меняет свою роль", ownerToken, "/chats/members/role", role(ownerID, RoleAdmin), http.StatusForbidden, PermissionDenied},
+		{"роль владельца не назначается", ownerToken, "/chats/members/role", role(adminID, RoleOwner), http.StatusBadRequest, InvalidParam},
+		{"владелец не покидает чат", ownerToken, "/chats/leave", map[string]interface{}{"chat": chatID}, http.StatusForbidden, PermissionDenied},
+		{"участник не удаляет чужие сообщения", memberToken, "/messages/delete", message(adminMessage), http.StatusForbidden, PermissionDenied},
+		{"администратор удаляет чужие сообщения", adminToken, "/messages/delete", message(memberMessage), http.StatusOK, 0},
+		{"владелец назначает роль", ownerToken, "/chats/members/role", role(readonlyID, RoleMember), http.StatusOK, 0},
+		{"бывший читатель пишет", readonlyToken, "/messages/add", post, http.StatusCreated, 0},
+		{"администратор исключает участника", adminToken, "/chats/members/remove", member(memberID), http.StatusOK, 0},
+		{"владелец исключает администратора", ownerToken, "/chats/members/remove", member(adminID), http.StatusOK, 0},
+	}
+	for _, c := range cases {
+		response := ErrorResponse{}
+		status := doRequest(t, s, c.path, c.token, c.body, &response)
+		if status != c.status || status >= http.StatusBadRequest && response.ErrorCode != c.code {
+			t.Fatalf("%s: ответ %d %+v, ожидался %d с кодом %d", c.name, status, response, c.status, c.code)
+		}
+	}
+}
+
+// Сообщения чата от лица владельца токена от раннего к позднему
+func getMessages(t *testing.T, s *Service, token string, chatID uint64) []Message {
+	t.Helper()
+
+	response := struct {
+		Messages []Message `json:"messages"`
+	}{}
+	if status := doRequest(t, s, "/messages/get", token, map[string]interface{}{"chat": chatID}, &response); status != http.StatusOK {
+		t.Fatalf("история чата %d: %d", chatID, status)
+	}
+
+	return response.Messages
+}
+
+// Проверка системного сообщения об изменении состава чата
+func expectSystemMessage(t *testing.T, message Message, kind string, authorID uint64, targetID uint64) {
+	t.Helper()
+
+	if message.Kind != kind || message.Author != strconv.FormatUint(authorID, 10) || message.Target != targetID {
+		t.Fatalf("сообщение %+v, ожидалось %s от %d о %d", message, kind, authorID, targetID)
+	}
+}
+
+func TestMembershipMessages(t *testing.T) {
+	s := newTestService(t)
+	aliceID, aliceToken := addUser(t, s, "alice")
+	bobID, bobToken := addUser(t, s, "bob")
+	carolID, _ := addUser(t, s, "carol")
+	chatID := addChat(t, s, aliceToken, "chat")
+
+	// На каждого добавленного участника приходится одно системное сообщение
+	added := struct {
+		Messages []Message `json:"messages"`
+	}{}
+	if status := doRequest(t, s, "/chats/members/add", aliceToken, map[string]interface{}{"chat": chatID, "users": []uint64{bobID, carolID, bobID}}, &added); status != http.StatusOK || len(added.Messages) != 2 {
+		t.Fatalf("добавление участников: %d %+v", status, added)
+	}
+	expectSystemMessage(t, added.Messages[0], MessageMemberAdded, aliceID, bobID)
+	expectSystemMessage(t, added.Messages[1], MessageMemberAdded, aliceID, carolID)
+
+	response := ErrorResponse{}
+	status := doRequest(t, s, "/chats/members/add", aliceToken, map[string]interface{}{"chat": chatID, "users": []uint64{carolID}}, &response)
+	expectError(t, status, response, http.StatusBadRequest, AlreadyExist)
+
+	removed := struct {
+		Message Message `json:"message"`
+	}{}
+	if status := doRequest(t, s, "/chats/members/remove", aliceToken, map[string]interface{}{"chat": chatID, "user": carolID}, &removed); status != http.StatusOK {
+		t.Fatalf("исключение участника: %d", status)
+	}
+	expectSystemMessage(t, removed.Message, MessageMemberRemoved, aliceID, carolID)
+
+	response = ErrorResponse{}
+	status = doRequest(t, s, "/chats/members/remove", aliceToken, map[string]interface{}{"chat": chatID, "user": carolID}, &response)
+	expectError(t, status, response, http.StatusBadRequest, NotExist)
+
+	left := struct {
+		Message Message `json:"message"`
+	}{}
+	if status := doRequest(t, s, "/chats/leave", bobToken, map[string]interface{}{"chat": chatID}, &left); status != http.StatusOK {
+		t.Fatalf("выход из чата: %d", status)
+	}
+	expectSystemMessage(t, left.Message, MessageMemberLeft, bobID, bobID)
+
+	// Системные сообщения остаются в истории чата, покинувший чат ее больше не читает
+	messages := getMessages(t, s, aliceToken, chatID)
+	if len(messages) != 4 {
+		t.Fatalf("в истории %d сообщений, ожидалось 4", len(messages))
+	}
+	for i, want := range append(added.Messages, removed.Message, left.Message) {
+		if messages[i].ID != want.ID || messages[i].Kind != want.Kind || messages[i].Target != want.Target {
+			t.Fatalf("сообщение %+v на позиции %d, ожидалось %+v", messages[i], i, want)
+		}
+	}
+
+	response = ErrorResponse{}
+	status = doRequest(t, s, "/messages/get", bobToken, map[string]interface{}{"chat": chatID}, &response)
+	expectError(t, status, response, http.StatusForbidden, Forbidden)
+}
+
+// Изменение реакции на сообщение от лица владельца токена, возвращает реакции на сообщение
+func changeReaction(t *testing.T, s *Service, path string, token string, messageID uint64, reaction string) []Reaction {
+	t.Helper()
+
+	response := struct {
+		Reactions []Reaction `json:"reactions"`
+	}{}
+	if status := doRequest(t, s, path, token, map[string]interface{}{"message": messageID, "reaction": reaction}, &response); status != http.StatusOK {
+		t.Fatalf("%s %s: %d", path, reaction, status)
+	}
+
+	return response.Reactions
+}
+
+// Проверка числа участников и отметки запросившего для реакции, без реакции count равен нулю
+func expectReaction(t *testing.T, reactions []Reaction, reaction string, count uint64, me bool) {
+	t.Helper()
+
+	got := Reaction{Reaction: reaction}
+	for _, r := range reactions {
+		if r.Reaction == reaction {
+			got = r
+		}
+	}
+	if got.Count != count || got.Me != me {
+		t.Fatalf("реакции %+v, ожидалось %s: %d, me %v", reactions, reaction, count, me)
+	}
+}
+
+func TestReactions(t *testing.T) {
+	s := newTestService(t)
+	_, aliceToken := addUser(t, s, "alice")
+	bobID, bobToken := addUser(t, s, "bob")
+	carolID, carolToken := addUser(t, s, "carol")
+	chatID := addChat(t, s, aliceToken, "chat", bobID, carolID)
+	messageID := addMessage(t, s, aliceToken, chatID, "hello")
+
+	// Участник ставит каждую реакцию на сообщение один раз
+	expectReaction(t, changeReaction(t, s, "/messages/reactions/add", aliceToken, messageID, "👍"), "👍", 1, true)
+	response := ErrorResponse{}
+	status := doRequest(t, s, "/messages/reactions/add", aliceToken, map[string]interface{}{"message": messageID, "reaction": "👍"}, &response)
+	expectError(t, status, response, http.StatusBadRequest, AlreadyExist)
+
+	reactions := changeReaction(t, s, "/messages/reactions/add", bobToken, messageID, "👍")
+	expectReaction(t, reactions, "👍", 2, true)
+	reactions = changeReaction(t, s, "/messages/reactions/add", bobToken, messageID, ":tada:")
+	expectReaction(t, reactions, "👍", 2, true)
+	expectReaction(t, reactions, ":tada:", 1, true)
+
+	// В истории отметка me относится к запросившему
+	messages := getMessages(t, s, aliceToken, chatID)
+	expectReaction(t, messages[0].Reactions, "👍", 2, true)
+	expectReaction(t, messages[0].Reactions, ":tada:", 1, false)
+
+	// Снимается только своя реакция
+	response = ErrorResponse{}
+	status = doRequest(t, s, "/messages/reactions/remove", carolToken, map[string]interface{}{"message": messageID, "reaction": "👍"}, &response)
+	expectError(t, status, response, http.StatusBadRequest, NotExist)
+	reactions = changeReaction(t, s, "/messages/reactions/remove", bobToken, messageID, "👍")
+	expectReaction(t, reactions, "👍", 1, false)
+	expectReaction(t, reactions, ":tada:", 1, true)
+
+	response = ErrorResponse{}
+	status = doRequest(t, s, "/messages/reactions/add", bobToken, map[string]interface{}{"message": messageID, "reaction": "not emoji"}, &response)
+	expectError(t, status, response, http.StatusBadRequest, InvalidParam)
+
+	// Читатель не ставит реакции
+	if status := doRequest(t, s, "/chats/members/role", aliceToken, map[string]interface{}{"chat": chatID, "user": carolID, "role": RoleReadOnly}, nil); status != http.StatusOK {
+		t.Fatalf("назначение роли: %d", status)
+	}
+	response = ErrorResponse{}
+	status = doRequest(t, s, "/messages/reactions/add", carolToken, map[string]interface{}{"message": messageID, "reaction": "👍"}, &response)
+	expectError(t, status, response, http.StatusForbidden, PermissionDenied)
+}
+
+// Чат из списка чатов владельца токена
+func getChat(t *testing.T, s *Service, token string, chatID uint64) Chat {
+	t.Helper()
+
+	response := struct {
+		Chats []Chat `json:"chats"`
+	}{}
+	if status := doRequest(t, s, "/chats/get", token, nil, &response); status != http.StatusOK {
+		t.Fatalf("чаты: %d", status)
+	}
+	for _, chat := range response.Chats {
+		if chat.ID == chatID {
+			return chat
+		}
+	}
+	t.Fatalf("чат %d не найден в списке чатов", chatID)
+
+	return Chat{}
+}
+
+// Отметка чата прочитанным до сообщения от лица владельца токена, возвращает курсор прочтения
+func markRead(t *testing.T, s *Service, token string, chatID uint64, messageID uint64) uint64 {
+	t.Helper()
+
+	receipt := ReadReceipt{}
+	if status := doRequest(t, s, "/chats/read", token, map[string]interface{}{"chat": chatID, "message": messageID}, &receipt); status != http.StatusOK {
+		t.Fatalf("отметка прочтения: %d", status)
+	}
+	if receipt.Chat != chatID {
+		t.Fatalf("отметка прочтения чата %d, ожидался %d", receipt.Chat, chatID)
+	}
+
+	return receipt.LastReadID
+}
+
+func TestReadReceipts(t *testing.T) {
+	s := newTestService(t)
+	_, aliceToken := addUser(t, s, "alice")
+	bobID, bobToken := addUser(t, s, "bob")
+	chatID := addChat(t, s, aliceToken, "chat", bobID)
+	otherID := addChat(t, s, aliceToken, "other", bobID)
+	var ids []uint64
+	for _, text := range []string{"one", "two", "three"} {
+		ids = append(ids, addMessage(t, s, aliceToken, chatID, text))
+	}
+	otherMessage := addMessage(t, s, aliceToken, otherID, "other")
+
+	// Собственные сообщения не считаются непрочитанными
+	if unread := getChat(t, s, aliceToken, chatID).UnreadCount; unread != 0 {
+		t.Fatalf("непрочитанных у автора %d", unread)
+	}
+	if unread := getChat(t, s, bobToken, chatID).UnreadCount; unread != 3 {
+		t.Fatalf("непрочитанных %d, ожидалось 3", unread)
+	}
+
+	// Курсор прочтения не сдвигается назад
+	if lastRead := markRead(t, s, bobToken, chatID, ids[1]); lastRead != ids[1] {
+		t.Fatalf("курсор прочтения %d, ожидался %d", lastRead, ids[1])
+	}
+	if lastRead := markRead(t, s, bobToken, chatID, ids[0]); lastRead != ids[1] {
+		t.Fatalf("курсор прочтения после раннего сообщения %d, ожидался %d", lastRead, ids[1])
+	}
+	if unread := getChat(t, s, bobToken, chatID).UnreadCount; unread != 1 {
+		t.Fatalf("непрочитанных %d, ожидалось 1", unread)
+	}
+
+	messages := getMessages(t, s, aliceToken, chatID)
+	for i, message := range messages {
+		if read := len(message.ReadBy) == 1 && message.ReadBy[0] == bobID; read != (i < 2) {
+			t.Fatalf("сообщение %d прочитали %v", message.ID, message.ReadBy)
+		}
+	}
+
+	response := ErrorResponse{}
+	status := doRequest(t, s, "/chats/read", bobToken, map[string]interface{}{"chat": chatID, "message": otherMessage}, &response)
+	expectError(t, status, response, http.StatusBadRequest, NotExist)
+
+	// Без сообщения чат отмечается прочитанным до последнего сообщения
+	if lastRead := markRead(t, s, bobToken, chatID, 0); lastRead != ids[2] {
+		t.Fatalf("курсор прочтения %d, ожидался %d", lastRead, ids[2])
+	}
+	if unread := getChat(t, s, bobToken, chatID).UnreadCount; unread != 0 {
+		t.Fatalf("непрочитанных %d после прочтения чата", unread)
+	}
+	if unread := getChat(t, s, bobToken, otherID).UnreadCount; unread != 1 {
+		t.Fatalf("непрочитанных в другом чате %d, ожидалось 1", unread)
+	}
+}
+
+// Хранилище в памяти, проверка доступности которого завершается ошибкой
+type unavailableConnector struct {
+	*ConnectorMemory
+}
+
+func (uc unavailableConnector) ping(ctx context.Context) error {
+	return errors.New("хранилище недоступно")
+}
+
+// Код ответа проверки состояния и состояние из тела ответа
+func checkHealth(t *testing.T, s *Service, path string) (int, string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	response := struct {
+		Status string `json:"status"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s: не удалось разобрать ответ %q: %v", path, w.Body.String(), err)
+	}
+
+	return w.Code, response.Status
+}
+
+func TestReadiness(t *testing.T) {
+	s := newTestService(t)
+
+	// До запуска сервис не готов принимать запросы, но жив
+	if status, state := checkHealth(t, s, "/readyz"); status != http.StatusServiceUnavailable || state != "stopping" {
+		t.Fatalf("готовность до запуска: %d %s", status, state)
+	}
+	atomic.StoreInt32(&s.ready, 1)
+	if status, state := checkHealth(t, s, "/readyz"); status != http.StatusOK || state != "ok" {
+		t.Fatalf("готовность: %d %s", status, state)
+	}
+
+	unavailable := newTestServiceWith(t, unavailableConnector{NewConnectorMemory()})
+	atomic.StoreInt32(&unavailable.ready, 1)
+	if status, state := checkHealth(t, unavailable, "/readyz"); status != http.StatusServiceUnavailable || state != "storage unavailable" {
+		t.Fatalf("готовность без хранилища: %d %s", status, state)
+	}
+	if status, state := checkHealth(t, unavailable, "/healthz"); status != http.StatusOK || state != "ok" {
+		t.Fatalf("жизнеспособность без хранилища: %d %s", status, state)
+	}
+}
+
+func TestStopClearsReadiness(t *testing.T) {
+	s := newTestService(t)
+	s.config.ShutdownDelay = time.Second
+	atomic.StoreInt32(&s.ready, 1)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+
+	// Во время паузы перед остановкой проверка готовности отвечает отказом, а запросы обрабатываются
+	deadline := time.Now().Add(s.config.ShutdownDelay)
+	for {
+		status, state := checkHealth(t, s, "/readyz")
+		if status == http.StatusServiceUnavailable && state == "stopping" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("готовность во время остановки: %d %s", status, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case <-stopped:
+		t.Fatal("сервис остановлен без паузы")
+	default:
+	}
+	addUser(t, s, "alice")
+
+	<-stopped
+}
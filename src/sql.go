@@ -0,0 +1,796 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Общие функции коннекторов к SQL БД
+
+// Плейсхолдеры для n параметров запроса, нумерация для PostgreSQL начинается с start
+func sqlPlaceholders(dialect string, start, n int) string {
+	placeholders := make([]string, n)
+	for i := range placeholders {
+		if dialect == dialectPostgres {
+			placeholders[i] = fmt.Sprintf("$%d", start+i)
+		} else {
+			placeholders[i] = "?"
+		}
+	}
+
+	return strings.Join(placeholders, ",")
+}
+
+// Проверка существования всех пользователей одним запросом, возвращает ErrNotExist для первого отсутствующего
+func sqlCheckUsers(ctx context.Context, tx *sql.Tx, dialect string, users []uint64) error {
+	_, err := sqlUsernames(ctx, tx, dialect, users)
+	return err
+}
+
+// Имена пользователей по id одним запросом, возвращает ErrNotExist для первого отсутствующего
+func sqlUsernames(ctx context.Context, tx *sql.Tx, dialect string, users []uint64) (map[uint64]string, error) {
+	found := make(map[uint64]string, len(users))
+	if len(users) == 0 {
+		return found, nil
+	}
+
+	args := make([]interface{}, len(users))
+	for i, userID := range users {
+		args[i] = userID
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, username FROM E1_Users WHERE id IN ("+sqlPlaceholders(dialect, 1, len(users))+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID uint64
+		var username string
+		if err := rows.Scan(&userID, &username); err != nil {
+			return nil, err
+		}
+		found[userID] = username
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, userID := range users {
+		if _, ok := found[userID]; !ok {
+			return nil, fmt.Errorf("пользователь c id %d %w", userID, ErrNotExist)
+		}
+	}
+
+	return found, nil
+}
+
+// Признак нарушения ограничения уникальности в любой из поддерживаемых БД
+func isUniqueViolation(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1062 // ER_DUP_ENTRY
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505" // unique_violation
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+
+	return false
+}
+
+// Признак ссылки на несуществующую запись в любой из поддерживаемых БД
+func isForeignKeyViolation(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1452 // ER_NO_REFERENCED_ROW_2
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23503" // foreign_key_violation
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey
+	}
+
+	return false
+}
+
+// Выражение времени в формате timeLayout для выборки
+func sqlTime(dialect string, column string) string {
+	if dialect == dialectPostgres {
+		return "to_char(" + column + ", '" + timeFormatPostgres + "')"
+	}
+
+	return column
+}
+
+// Столбцы сообщения в порядке полей sqlScanMessage
+func sqlMessageColumns(dialect string) string {
+	return "id, id_chat, id_user, text, " + sqlTime(dialect, "created_at") + ", " +
+		sqlTime(dialect, "edited_at") + ", " + sqlTime(dialect, "deleted_at") + ", kind, id_target, id_reply_to, id_thread_root, reply_count"
+}
+
+// Строка выборки, *sql.Row или *sql.Rows
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Чтение сообщения, выбранного столбцами sqlMessageColumns
+func sqlScanMessage(row sqlScanner, message *Message) error {
+	var text, editedAt, deletedAt, kind sql.NullString
+	var target, replyTo, threadRoot sql.NullInt64
+	err := row.Scan(&message.ID, &message.Chat, &message.Author, &text, &message.CreatedAt, &editedAt, &deletedAt, &kind, &target,
+		&replyTo, &threadRoot, &message.ReplyCount)
+	if err != nil {
+		return err
+	}
+	message.Text, message.EditedAt, message.DeletedAt = text.String, editedAt.String, deletedAt.String
+	message.Kind, message.Target = kind.String, uint64(target.Int64)
+	message.ReplyTo, message.ThreadRoot = uint64(replyTo.Int64), uint64(threadRoot.Int64)
+
+	return nil
+}
+
+// Чаты пользователя с последним сообщением, отсортированные по времени последнего сообщения
+// (для чатов без сообщений - по времени создания) от позднего к раннему.
+// Непрочитанными считаются неудаленные сообщения других участников после курсора прочтения пользователя.
+// Последние сообщения и участники всех чатов с ролями загружаются отдельными запросами
+func sqlGetCharts(ctx context.Context, db *sql.DB, dialect string, user uint64) ([]Chat, error) {
+	querry := `SELECT
+E2_Chat.id,
+E2_Chat.name,
+` + sqlTime(dialect, "E2_Chat.created_at") + `,
+E4M.id,
+(SELECT COUNT(*) FROM E4_Messages
+    WHERE id_chat = E2_Chat.id AND id > E3C.last_read_id AND id_user <> E3C.id_user AND deleted_at IS NULL)
+FROM E2_Chat
+JOIN E3_Chatroom E3C on E2_Chat.id = E3C.id_chat
+LEFT JOIN E4_Messages E4M on E4M.id = (
+    SELECT id FROM E4_Messages WHERE id_chat = E2_Chat.id ORDER BY created_at DESC, id DESC LIMIT 1
+)
+WHERE E3C.id_user = ` + sqlPlaceholders(dialect, 1, 1) + `
+ORDER BY COALESCE(E4M.created_at, E2_Chat.created_at) DESC, COALESCE(E4M.id, 0) DESC, E2_Chat.id DESC`
+
+	rows, err := db.QueryContext(ctx, querry, user)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Chat{}
+	index := make(map[uint64]int)
+	var lastIDs []interface{}
+	for rows.Next() {
+		chat := Chat{}
+		var messageID sql.NullInt64
+		if err := rows.Scan(&chat.ID, &chat.Name, &chat.CreatedAt, &messageID, &chat.UnreadCount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if messageID.Valid {
+			lastIDs = append(lastIDs, messageID.Int64)
+		}
+
+		index[chat.ID] = len(result)
+		result = append(result, chat)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Последние сообщения всех чатов одним запросом
+	if len(lastIDs) > 0 {
+		rows, err = db.QueryContext(ctx, "SELECT "+sqlMessageColumns(dialect)+" FROM E4_Messages WHERE id IN ("+
+			sqlPlaceholders(dialect, 1, len(lastIDs))+")", lastIDs...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			message := Message{}
+			if err := sqlScanMessage(rows, &message); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if i, ok := index[message.Chat]; ok {
+				result[i].LastMessage = &message
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Участники всех чатов пользователя одним запросом
+	rows, err = db.QueryContext(ctx, `SELECT id_chat, id_user, role FROM E3_Chatroom
+WHERE id_chat IN (SELECT id_chat FROM E3_Chatroom WHERE id_user = `+sqlPlaceholders(dialect, 1, 1)+`)
+ORDER BY id_chat, id_user`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var chatID, userID uint64
+		var role string
+		if err := rows.Scan(&chatID, &userID, &role); err != nil {
+			return nil, err
+		}
+		if i, ok := index[chatID]; ok {
+			result[i].Users = append(result[i].Users, userID)
+			if result[i].Roles == nil {
+				result[i].Roles = make(map[uint64]string)
+			}
+			result[i].Roles[userID] = role
+		}
+	}
+
+	return result, rows.Err()
+}
+
+// Сдвиг курсора прочтения участника вперед, возвращает итоговый курсор или ErrNotExist, если пользователь не в чате
+func sqlMarkRead(ctx context.Context, db *sql.DB, dialect string, chatID uint64, userID uint64, messageID uint64) (uint64, error) {
+	_, err := db.ExecContext(ctx, "UPDATE E3_Chatroom SET last_read_id = "+sqlPlaceholders(dialect, 1, 1)+
+		" WHERE id_chat = "+sqlPlaceholders(dialect, 2, 1)+" AND id_user = "+sqlPlaceholders(dialect, 3, 1)+
+		" AND last_read_id < "+sqlPlaceholders(dialect, 4, 1), messageID, chatID, userID, messageID)
+	if err != nil {
+		return 0, err
+	}
+
+	var lastReadID uint64
+	err = db.QueryRowContext(ctx, "SELECT last_read_id FROM E3_Chatroom WHERE id_chat = "+sqlPlaceholders(dialect, 1, 1)+
+		" AND id_user = "+sqlPlaceholders(dialect, 2, 1), chatID, userID).Scan(&lastReadID)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("пользователь c id %d в чате %d %w", userID, chatID, ErrNotExist)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return lastReadID, nil
+}
+
+// Курсоры прочтения всех участников чата
+func sqlGetReadCursors(ctx context.Context, db *sql.DB, dialect string, chatID uint64) (map[uint64]uint64, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id_user, last_read_id FROM E3_Chatroom WHERE id_chat = "+sqlPlaceholders(dialect, 1, 1), chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[uint64]uint64)
+	for rows.Next() {
+		var userID, lastReadID uint64
+		if err := rows.Scan(&userID, &lastReadID); err != nil {
+			return nil, err
+		}
+		result[userID] = lastReadID
+	}
+
+	return result, rows.Err()
+}
+
+// Предыдущие версии текста сообщения от ранней к поздней
+func sqlGetRevisions(ctx context.Context, db *sql.DB, dialect string, messageID uint64) ([]MessageRevision, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, id_message, text, "+sqlTime(dialect, "created_at")+
+		" FROM E5_MessageRevisions WHERE id_message = "+sqlPlaceholders(dialect, 1, 1)+" ORDER BY id", messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []MessageRevision{}
+	for rows.Next() {
+		revision := MessageRevision{}
+		if err := rows.Scan(&revision.ID, &revision.Message, &revision.Text, &revision.CreatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, revision)
+	}
+
+	return result, rows.Err()
+}
+
+// Добавление участников в чат с системным сообщением о каждом. ErrAlreadyExist, если пользователь уже в чате
+func sqlAddMembers(ctx context.Context, db *sql.DB, dialect string, chatID uint64, actorID uint64, users []uint64) ([]Message, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	usernames, err := sqlUsernames(ctx, tx, dialect, append([]uint64{actorID}, users...))
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []Message
+	for _, userID := range users {
+		_, err := tx.ExecContext(ctx, "INSERT INTO E3_Chatroom (id_user, id_chat) VALUES ("+sqlPlaceholders(dialect, 1, 2)+")", userID, chatID)
+		if err != nil {
+			if isUniqueViolation(err) {
+				return nil, fmt.Errorf("пользователь c id %d в чате c id %d %w", userID, chatID, ErrAlreadyExist)
+			}
+			return nil, err
+		}
+
+		message, err := sqlInsertSystemMessage(ctx, tx, dialect, chatID, actorID, MessageMemberAdded, userID,
+			systemMessageText(MessageMemberAdded, usernames[actorID], usernames[userID]))
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// Исключение участника из чата с системным сообщением. Если участник исключает сам себя, он покидает чат.
+// ErrNotExist, если пользователь не состоит в чате
+func sqlRemoveMember(ctx context.Context, db *sql.DB, dialect string, chatID uint64, actorID uint64, userID uint64) (Message, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Message{}, err
+	}
+	defer tx.Rollback()
+
+	usernames, err := sqlUsernames(ctx, tx, dialect, uniqueIDs([]uint64{actorID, userID}))
+	if err != nil {
+		return Message{}, err
+	}
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM E3_Chatroom WHERE id_chat = "+sqlPlaceholders(dialect, 1, 1)+
+		" AND id_user = "+sqlPlaceholders(dialect, 2, 1), chatID, userID)
+	if err != nil {
+		return Message{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return Message{}, err
+	} else if n == 0 {
+		return Message{}, fmt.Errorf("пользователь c id %d в чате c id %d %w", userID, chatID, ErrNotExist)
+	}
+
+	kind := MessageMemberRemoved
+	if actorID == userID {
+		kind = MessageMemberLeft
+	}
+	message, err := sqlInsertSystemMessage(ctx, tx, dialect, chatID, actorID, kind, userID,
+		systemMessageText(kind, usernames[actorID], usernames[userID]))
+	if err != nil {
+		return Message{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Message{}, err
+	}
+
+	return message, nil
+}
+
+// Отправка сообщения вместе с вложениями. Ответ попадает в ветку сообщения replyTo, которое должно быть в том же чате,
+// у корня ветки увеличивается счетчик ответов. ErrNotExist, если сообщения replyTo нет в чате
+func sqlSendMessage(ctx context.Context, db *sql.DB, dialect string, chatID uint64, authorID uint64, text string, replyTo uint64,
+	attachments []Attachment) (Message, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Message{}, err
+	}
+	defer tx.Rollback()
+
+	message := Message{
+		Chat:    chatID,
+		Author:  strconv.FormatUint(authorID, 10),
+		Text:    text,
+		ReplyTo: replyTo,
+	}
+
+	if replyTo != 0 {
+		var parentChat uint64
+		var parentRoot sql.NullInt64
+		err := tx.QueryRowContext(ctx, "SELECT id_chat, id_thread_root FROM E4_Messages WHERE id = "+sqlPlaceholders(dialect, 1, 1), replyTo).
+			Scan(&parentChat, &parentRoot)
+		if err == sql.ErrNoRows || (err == nil && parentChat != chatID) {
+			return Message{}, fmt.Errorf("сообщение c id %d в чате c id %d %w", replyTo, chatID, ErrNotExist)
+		}
+		if err != nil {
+			return Message{}, err
+		}
+
+		// Ответ на ответ остается в ветке исходного сообщения
+		message.ThreadRoot = replyTo
+		if parentRoot.Valid {
+			message.ThreadRoot = uint64(parentRoot.Int64)
+		}
+	}
+
+	message, err = sqlInsertMessage(ctx, tx, dialect, message)
+	if isForeignKeyViolation(err) {
+		return Message{}, fmt.Errorf("чат c id %d или пользователь c id %d %w", chatID, authorID, ErrNotExist)
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	if message.ThreadRoot != 0 {
+		_, err := tx.ExecContext(ctx, "UPDATE E4_Messages SET reply_count = reply_count + 1 WHERE id = "+sqlPlaceholders(dialect, 1, 1),
+			message.ThreadRoot)
+		if err != nil {
+			return Message{}, err
+		}
+	}
+
+	for _, attachment := range attachments {
+		attachment.Message, attachment.CreatedAt = message.ID, message.CreatedAt
+		if attachment.ID, err = sqlInsertAttachment(ctx, tx, dialect, attachment); err != nil {
+			return Message{}, err
+		}
+		message.Attachments = append(message.Attachments, attachment)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Message{}, err
+	}
+
+	return message, nil
+}
+
+// Запись системного сообщения
+func sqlInsertSystemMessage(ctx context.Context, tx *sql.Tx, dialect string, chatID uint64, actorID uint64,
+	kind string, target uint64, text string) (Message, error) {
+	return sqlInsertMessage(ctx, tx, dialect, Message{
+		Chat:   chatID,
+		Author: strconv.FormatUint(actorID, 10),
+		Text:   text,
+		Kind:   kind,
+		Target: target,
+	})
+}
+
+// Запись сообщения, возвращает сообщение с id и временем создания.
+// Время создания в PostgreSQL задается БД, в остальных БД - сервисом
+func sqlInsertMessage(ctx context.Context, tx *sql.Tx, dialect string, message Message) (Message, error) {
+	authorID, err := strconv.ParseUint(message.Author, 10, 64)
+	if err != nil {
+		return Message{}, err
+	}
+
+	// Незаданные поля сохраняются как NULL
+	kind := sql.NullString{String: message.Kind, Valid: message.Kind != ""}
+	nullID := func(id uint64) sql.NullInt64 {
+		return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+	}
+	args := []interface{}{message.Chat, authorID, message.Text, kind, nullID(message.Target), nullID(message.ReplyTo), nullID(message.ThreadRoot)}
+
+	if dialect == dialectPostgres {
+		err := tx.QueryRowContext(ctx, `INSERT INTO E4_Messages (id_chat, id_user, text, kind, id_target, id_reply_to, id_thread_root, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, LOCALTIMESTAMP(0)) RETURNING id, `+sqlTime(dialect, "created_at"), args...).
+			Scan(&message.ID, &message.CreatedAt)
+		if err != nil {
+			return Message{}, err
+		}
+
+		return message, nil
+	}
+
+	message.CreatedAt = time.Now().Format(timeLayout)
+	res, err := tx.ExecContext(ctx, `INSERT INTO E4_Messages (id_chat, id_user, text, kind, id_target, id_reply_to, id_thread_root, created_at)
+VALUES (?,?,?,?,?,?,?,?)`, append(args, message.CreatedAt)...)
+	if err != nil {
+		return Message{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Message{}, err
+	}
+	message.ID = uint64(id)
+
+	return message, nil
+}
+
+// Страница сообщений, отобранных по значению столбца id_chat или id_thread_root, по ключу (created_at, id)
+func sqlGetMessages(ctx context.Context, db *sql.DB, dialect string, column string, value uint64, page MessagePage) ([]Message, bool, error) {
+	where, args, order := sqlPageClause(dialect, page, 2)
+	args = append([]interface{}{value}, args...)
+	args = append(args, page.Limit+1)
+
+	rows, err := db.QueryContext(ctx, "SELECT "+sqlMessageColumns(dialect)+" FROM E4_Messages WHERE "+column+" = "+sqlPlaceholders(dialect, 1, 1)+
+		where+order+" LIMIT "+sqlPlaceholders(dialect, len(args), 1), args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	result := []Message{}
+	for rows.Next() {
+		message := Message{}
+		if err := sqlScanMessage(rows, &message); err != nil {
+			return nil, false, err
+		}
+		result = append(result, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	result, hasMore := finishPage(result, page)
+	return result, hasMore, nil
+}
+
+// Роль участника чата, пустая строка если пользователь не состоит в чате
+func sqlGetRole(ctx context.Context, db *sql.DB, dialect string, chatID uint64, userID uint64) (string, error) {
+	var role string
+	err := db.QueryRowContext(ctx, "SELECT role FROM E3_Chatroom WHERE id_chat = "+sqlPlaceholders(dialect, 1, 1)+
+		" AND id_user = "+sqlPlaceholders(dialect, 2, 1), chatID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return role, nil
+}
+
+// Назначение роли участнику чата
+func sqlSetRole(ctx context.Context, db *sql.DB, dialect string, chatID uint64, userID uint64, role string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// MySQL не учитывает в RowsAffected строки, значение в которых не изменилось, поэтому участие проверяется отдельно
+	var current string
+	err = tx.QueryRowContext(ctx, "SELECT role FROM E3_Chatroom WHERE id_chat = "+sqlPlaceholders(dialect, 1, 1)+
+		" AND id_user = "+sqlPlaceholders(dialect, 2, 1), chatID, userID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("пользователь c id %d в чате c id %d %w", userID, chatID, ErrNotExist)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE E3_Chatroom SET role = "+sqlPlaceholders(dialect, 1, 1)+
+		" WHERE id_chat = "+sqlPlaceholders(dialect, 2, 1)+" AND id_user = "+sqlPlaceholders(dialect, 3, 1), role, chatID, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Реакция участника на сообщение, повторная реакция нарушает уникальный ключ
+func sqlAddReaction(ctx context.Context, db *sql.DB, dialect string, messageID uint64, userID uint64, reaction string) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO E6_Reactions (id_message, id_user, reaction, created_at) VALUES ("+
+		sqlPlaceholders(dialect, 1, 4)+")", messageID, userID, reaction, time.Now().Format(timeLayout))
+	if isUniqueViolation(err) {
+		return fmt.Errorf("реакция %s пользователя c id %d на сообщение c id %d %w", reaction, userID, messageID, ErrAlreadyExist)
+	}
+	if isForeignKeyViolation(err) {
+		return fmt.Errorf("сообщение c id %d или пользователь c id %d %w", messageID, userID, ErrNotExist)
+	}
+
+	return err
+}
+
+func sqlRemoveReaction(ctx context.Context, db *sql.DB, dialect string, messageID uint64, userID uint64, reaction string) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM E6_Reactions WHERE id_message = "+sqlPlaceholders(dialect, 1, 1)+
+		" AND id_user = "+sqlPlaceholders(dialect, 2, 1)+" AND reaction = "+sqlPlaceholders(dialect, 3, 1), messageID, userID, reaction)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("реакция %s пользователя c id %d на сообщение c id %d %w", reaction, userID, messageID, ErrNotExist)
+	}
+
+	return nil
+}
+
+// Реакции на сообщения, сгруппированные по значению, в порядке первой из оставшихся реакций
+func sqlGetReactions(ctx context.Context, db *sql.DB, dialect string, messageIDs []uint64, userID uint64) (map[uint64][]Reaction, error) {
+	result := make(map[uint64][]Reaction)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	args := []interface{}{userID}
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT id_message, reaction, COUNT(*), SUM(CASE WHEN id_user = `+sqlPlaceholders(dialect, 1, 1)+` THEN 1 ELSE 0 END)
+FROM E6_Reactions
+WHERE id_message IN (`+sqlPlaceholders(dialect, 2, len(messageIDs))+`)
+GROUP BY id_message, reaction
+ORDER BY MIN(id)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID, mine uint64
+		reaction := Reaction{}
+		if err := rows.Scan(&messageID, &reaction.Reaction, &reaction.Count, &mine); err != nil {
+			return nil, err
+		}
+		reaction.Me = mine > 0
+
+		result[messageID] = append(result[messageID], reaction)
+	}
+
+	return result, rows.Err()
+}
+
+// Запись метаданных вложения, возвращает id вложения
+func sqlInsertAttachment(ctx context.Context, tx *sql.Tx, dialect string, attachment Attachment) (uint64, error) {
+	querry := "INSERT INTO E7_Attachments (id_message, name, mime_type, size, checksum, storage_key, created_at) VALUES (" +
+		sqlPlaceholders(dialect, 1, 7) + ")"
+	args := []interface{}{attachment.Message, attachment.Name, attachment.MIMEType, attachment.Size, attachment.Checksum,
+		attachment.StorageKey, attachment.CreatedAt}
+
+	if dialect == dialectPostgres {
+		var id uint64
+		err := tx.QueryRowContext(ctx, querry+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+
+	res, err := tx.ExecContext(ctx, querry, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	return uint64(id), err
+}
+
+// Столбцы вложения в порядке sqlScanAttachment
+func sqlAttachmentColumns(dialect string) string {
+	return "id, id_message, name, mime_type, size, checksum, storage_key, " + sqlTime(dialect, "created_at")
+}
+
+func sqlScanAttachment(row sqlScanner, attachment *Attachment) error {
+	return row.Scan(&attachment.ID, &attachment.Message, &attachment.Name, &attachment.MIMEType, &attachment.Size,
+		&attachment.Checksum, &attachment.StorageKey, &attachment.CreatedAt)
+}
+
+func sqlGetAttachment(ctx context.Context, db *sql.DB, dialect string, attachmentID uint64) (Attachment, error) {
+	attachment := Attachment{}
+	err := sqlScanAttachment(db.QueryRowContext(ctx, "SELECT "+sqlAttachmentColumns(dialect)+" FROM E7_Attachments WHERE id = "+
+		sqlPlaceholders(dialect, 1, 1), attachmentID), &attachment)
+	if err == sql.ErrNoRows {
+		return Attachment{}, fmt.Errorf("вложение c id %d %w", attachmentID, ErrNotExist)
+	}
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	return attachment, nil
+}
+
+// Вложения сообщений одним запросом
+func sqlGetAttachments(ctx context.Context, db *sql.DB, dialect string, messageIDs []uint64) (map[uint64][]Attachment, error) {
+	result := make(map[uint64][]Attachment)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	args := make([]interface{}, 0, len(messageIDs))
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT "+sqlAttachmentColumns(dialect)+" FROM E7_Attachments WHERE id_message IN ("+
+		sqlPlaceholders(dialect, 1, len(messageIDs))+") ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		attachment := Attachment{}
+		if err := sqlScanAttachment(rows, &attachment); err != nil {
+			return nil, err
+		}
+		result[attachment.Message] = append(result[attachment.Message], attachment)
+	}
+
+	return result, rows.Err()
+}
+
+// Условие полнотекстового поиска по словам запроса с учетом префиксов:
+// в MySQL - FULLTEXT индекс в логическом режиме, в PostgreSQL - tsvector с GIN индексом,
+// в SQLite - таблица FTS4 E4_Messages_fts, в которой слова с * ищутся по префиксу
+func sqlMatchClause(dialect string, terms []string, start int) (string, interface{}) {
+	p := sqlPlaceholders(dialect, start, 1)
+	switch dialect {
+	case dialectMySQL:
+		return "MATCH (text) AGAINST (" + p + " IN BOOLEAN MODE)", "+" + strings.Join(terms, "* +") + "*"
+	case dialectPostgres:
+		return "to_tsvector('simple', text) @@ to_tsquery('simple', " + p + ")", strings.Join(terms, ":* & ") + ":*"
+	default:
+		return "id IN (SELECT docid FROM E4_Messages_fts WHERE E4_Messages_fts MATCH " + p + ")", strings.Join(terms, "* ") + "*"
+	}
+}
+
+// Поиск сообщений в чатах пользователя, системные и удаленные сообщения не ищутся
+func sqlSearchMessages(ctx context.Context, db *sql.DB, dialect string, userID uint64, query SearchQuery, page MessagePage) ([]Message, bool, error) {
+	match, matchArg := sqlMatchClause(dialect, query.Terms, 2)
+	where := " WHERE id_chat IN (SELECT id_chat FROM E3_Chatroom WHERE id_user = " + sqlPlaceholders(dialect, 1, 1) + ")" +
+		" AND deleted_at IS NULL AND kind IS NULL AND " + match
+	args := []interface{}{userID, matchArg}
+
+	filter := func(condition string, value interface{}) {
+		args = append(args, value)
+		where += " AND " + condition + " " + sqlPlaceholders(dialect, len(args), 1)
+	}
+	if query.Chat != 0 {
+		filter("id_chat =", query.Chat)
+	}
+	if query.Author != 0 {
+		filter("id_user =", query.Author)
+	}
+	if query.From != "" {
+		filter("created_at >=", query.From)
+	}
+	if query.Before != "" {
+		filter("created_at <", query.Before)
+	}
+
+	pageWhere, pageArgs, order := sqlPageClause(dialect, page, len(args)+1)
+	args = append(args, pageArgs...)
+	args = append(args, page.Limit+1)
+
+	rows, err := db.QueryContext(ctx, "SELECT "+sqlMessageColumns(dialect)+" FROM E4_Messages"+where+pageWhere+order+
+		" LIMIT "+sqlPlaceholders(dialect, len(args), 1), args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	result := []Message{}
+	for rows.Next() {
+		message := Message{}
+		if err := sqlScanMessage(rows, &message); err != nil {
+			return nil, false, err
+		}
+		result = append(result, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	result, hasMore := finishPage(result, page)
+	return result, hasMore, nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type ConfigSQLite struct {
+	Path string `default:"chat.db"` // путь к файлу БД
+}
+
+func initConfigSQLite() (*ConfigSQLite, error) {
+	config := &ConfigSQLite{}
+	err := envconfig.Process("SQLite", config)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Коннектор к встроенной БД SQLite, схема создается миграциями при запуске сервиса
+type ConnectorSQLite struct {
+	config *ConfigSQLite
+	db     *sql.DB
+}
+
+func (cs *ConnectorSQLite) connect() error {
+	sourceAddr := fmt.Sprintf("file:%s?_foreign_keys=1&_busy_timeout=5000", cs.config.Path)
+	db, err := openTracedDB("sqlite3", sourceAddr, dialectSQLite)
+	if err != nil {
+		return err
+	}
+	// SQLite не поддерживает параллельную запись, поэтому используем одно соединение
+	db.SetMaxOpenConns(1)
+
+	cs.db = db
+	return nil
+}
+
+func (cs *ConnectorSQLite) sqlDB() (*sql.DB, error) {
+	return cs.db, nil
+}
+
+func (cs *ConnectorSQLite) sqlDialect() string {
+	return dialectSQLite
+}
+
+func (cs *ConnectorSQLite) ping(ctx context.Context) error {
+	return cs.db.PingContext(ctx)
+}
+
+func (cs *ConnectorSQLite) createUser(ctx context.Context, username string, passwordHash string) (User, error) {
+	user := User{
+		Username:  username,
+		CreatedAt: time.Now().Format(timeLayout),
+	}
+
+	res, err := cs.db.ExecContext(ctx, "INSERT INTO E1_Users (username, created_at, password_hash) VALUES (?,?,?)",
+		user.Username, user.CreatedAt, passwordHash)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return User{}, fmt.Errorf("пользователь %s %w", username, ErrAlreadyExist)
+		}
+		return User{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	user.ID = uint64(id)
+
+	return user, nil
+}
+
+func (cs *ConnectorSQLite) getCredentials(ctx context.Context, username string) (User, string, error) {
+	user := User{}
+	var passwordHash sql.NullString
+	err := cs.db.QueryRowContext(ctx, "SELECT id, username, created_at, password_hash FROM E1_Users WHERE username = ?", username).
+		Scan(&user.ID, &user.Username, &user.CreatedAt, &passwordHash)
+	if err == sql.ErrNoRows {
+		return User{}, "", fmt.Errorf("пользователь %s %w", username, ErrNotExist)
+	}
+	if err != nil {
+		return User{}, "", err
+	}
+
+	return user, passwordHash.String, nil
+}
+
+func (cs *ConnectorSQLite) checkUsername(ctx context.Context, username string) (bool, error) {
+	return cs.exists(ctx, "SELECT 1 FROM E1_Users WHERE username = ?", username)
+}
+
+func (cs *ConnectorSQLite) checkUserID(ctx context.Context, user uint64) (bool, error) {
+	return cs.exists(ctx, "SELECT 1 FROM E1_Users WHERE id = ?", user)
+}
+
+func (cs *ConnectorSQLite) createChart(ctx context.Context, name string, ownerID uint64, users []uint64) (Chat, error) {
+	chat := Chat{
+		Name:      name,
+		Users:     uniqueIDs(append([]uint64{ownerID}, users...)),
+		Roles:     make(map[uint64]string),
+		CreatedAt: time.Now().Format(timeLayout),
+	}
+
+	tx, err := cs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Chat{}, err
+	}
+	defer tx.Rollback()
+
+	if err := sqlCheckUsers(ctx, tx, dialectSQLite, chat.Users); err != nil {
+		return Chat{}, err
+	}
+
+	res, err := tx.ExecContext(ctx, "INSERT INTO E2_Chat (name, created_at) VALUES (?,?)", chat.Name, chat.CreatedAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return Chat{}, fmt.Errorf("чат %s %w", name, ErrAlreadyExist)
+		}
+		return Chat{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Chat{}, err
+	}
+	chat.ID = uint64(id)
+
+	for _, userID := range chat.Users {
+		chat.Roles[userID] = chatRole(ownerID, userID)
+		_, err := tx.ExecContext(ctx, "INSERT INTO E3_Chatroom (id_user, id_chat, role) VALUES (?,?,?)", userID, chat.ID, chat.Roles[userID])
+		if err != nil {
+			return Chat{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Chat{}, err
+	}
+
+	return chat, nil
+}
+
+func (cs *ConnectorSQLite) checkChartName(ctx context.Context, name string) (bool, error) {
+	return cs.exists(ctx, "SELECT 1 FROM E2_Chat WHERE name = ?", name)
+}
+
+func (cs *ConnectorSQLite) checkChartID(ctx context.Context, chat uint64) (bool, error) {
+	return cs.exists(ctx, "SELECT 1 FROM E2_Chat WHERE id = ?", chat)
+}
+
+func (cs *ConnectorSQLite) isMember(ctx context.Context, chat uint64, user uint64) (bool, error) {
+	return cs.exists(ctx, "SELECT 1 FROM E3_Chatroom WHERE id_chat = ? AND id_user = ?", chat, user)
+}
+
+// Чаты пользователя отсортированы по времени последнего сообщения (от позднего к раннему),
+// чаты без сообщений сортируются по времени создания
+func (cs *ConnectorSQLite) getCharts(ctx context.Context, user uint64) ([]Chat, error) {
+	return sqlGetCharts(ctx, cs.db, dialectSQLite, user)
+}
+
+func (cs *ConnectorSQLite) sendMessage(ctx context.Context, chatID uint64, authorID uint64, text string, replyTo uint64,
+	attachments []Attachment) (Message, error) {
+	return sqlSendMessage(ctx, cs.db, dialectSQLite, chatID, authorID, text, replyTo, attachments)
+}
+
+func (cs *ConnectorSQLite) getMessage(ctx context.Context, messageID uint64) (Message, error) {
+	message := Message{}
+	err := sqlScanMessage(cs.db.QueryRowContext(ctx, "SELECT "+sqlMessageColumns(dialectSQLite)+" FROM E4_Messages WHERE id = ?", messageID), &message)
+	if err == sql.ErrNoRows {
+		return Message{}, fmt.Errorf("сообщение c id %d %w", messageID, ErrNotExist)
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	return message, nil
+}
+
+func (cs *ConnectorSQLite) getMessages(ctx context.Context, chatID uint64, page MessagePage) ([]Message, bool, error) {
+	return sqlGetMessages(ctx, cs.db, dialectSQLite, "id_chat", chatID, page)
+}
+
+func (cs *ConnectorSQLite) getThread(ctx context.Context, rootID uint64, page MessagePage) ([]Message, bool, error) {
+	return sqlGetMessages(ctx, cs.db, dialectSQLite, "id_thread_root", rootID, page)
+}
+
+func (cs *ConnectorSQLite) searchMessages(ctx context.Context, userID uint64, query SearchQuery, page MessagePage) ([]Message, bool, error) {
+	return sqlSearchMessages(ctx, cs.db, dialectSQLite, userID, query, page)
+}
+
+func (cs *ConnectorSQLite) markRead(ctx context.Context, chatID uint64, userID uint64, messageID uint64) (uint64, error) {
+	return sqlMarkRead(ctx, cs.db, dialectSQLite, chatID, userID, messageID)
+}
+
+func (cs *ConnectorSQLite) getReadCursors(ctx context.Context, chatID uint64) (map[uint64]uint64, error) {
+	return sqlGetReadCursors(ctx, cs.db, dialectSQLite, chatID)
+}
+
+func (cs *ConnectorSQLite) editMessage(ctx context.Context, messageID uint64, text string) (Message, error) {
+	return cs.reviseMessage(ctx, messageID, text, false)
+}
+
+func (cs *ConnectorSQLite) deleteMessage(ctx context.Context, messageID uint64) (Message, error) {
+	return cs.reviseMessage(ctx, messageID, "", true)
+}
+
+// Сохранение текущего текста сообщения в историю и замена текста. При удалении текст очищается
+func (cs *ConnectorSQLite) reviseMessage(ctx context.Context, messageID uint64, text string, deleted bool) (Message, error) {
+	now := time.Now().Format(timeLayout)
+	tx, err := cs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Message{}, err
+	}
+	defer tx.Rollback()
+
+	var current sql.NullString
+	err = tx.QueryRowContext(ctx, "SELECT text FROM E4_Messages WHERE id = ? AND deleted_at IS NULL", messageID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return Message{}, fmt.Errorf("сообщение c id %d %w", messageID, ErrNotExist)
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO E5_MessageRevisions (id_message, text, created_at) VALUES (?,?,?)", messageID, current.String, now)
+	if err != nil {
+		return Message{}, err
+	}
+
+	query := "UPDATE E4_Messages SET text = ?, edited_at = ? WHERE id = ?"
+	if deleted {
+		query = "UPDATE E4_Messages SET text = ?, deleted_at = ? WHERE id = ?"
+	}
+	if _, err := tx.ExecContext(ctx, query, text, now, messageID); err != nil {
+		return Message{}, err
+	}
+
+	message := Message{}
+	err = sqlScanMessage(tx.QueryRowContext(ctx, "SELECT "+sqlMessageColumns(dialectSQLite)+" FROM E4_Messages WHERE id = ?", messageID), &message)
+	if err != nil {
+		return Message{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Message{}, err
+	}
+
+	return message, nil
+}
+
+func (cs *ConnectorSQLite) getRevisions(ctx context.Context, messageID uint64) ([]MessageRevision, error) {
+	return sqlGetRevisions(ctx, cs.db, dialectSQLite, messageID)
+}
+
+func (cs *ConnectorSQLite) addMembers(ctx context.Context, chatID uint64, actorID uint64, users []uint64) ([]Message, error) {
+	return sqlAddMembers(ctx, cs.db, dialectSQLite, chatID, actorID, users)
+}
+
+func (cs *ConnectorSQLite) removeMember(ctx context.Context, chatID uint64, actorID uint64, userID uint64) (Message, error) {
+	return sqlRemoveMember(ctx, cs.db, dialectSQLite, chatID, actorID, userID)
+}
+
+func (cs *ConnectorSQLite) getRole(ctx context.Context, chat uint64, user uint64) (string, error) {
+	return sqlGetRole(ctx, cs.db, dialectSQLite, chat, user)
+}
+
+func (cs *ConnectorSQLite) setRole(ctx context.Context, chat uint64, user uint64, role string) error {
+	return sqlSetRole(ctx, cs.db, dialectSQLite, chat, user, role)
+}
+
+func (cs *ConnectorSQLite) addReaction(ctx context.Context, messageID uint64, userID uint64, reaction string) error {
+	return sqlAddReaction(ctx, cs.db, dialectSQLite, messageID, userID, reaction)
+}
+
+func (cs *ConnectorSQLite) removeReaction(ctx context.Context, messageID uint64, userID uint64, reaction string) error {
+	return sqlRemoveReaction(ctx, cs.db, dialectSQLite, messageID, userID, reaction)
+}
+
+func (cs *ConnectorSQLite) getReactions(ctx context.Context, messageIDs []uint64, userID uint64) (map[uint64][]Reaction, error) {
+	return sqlGetReactions(ctx, cs.db, dialectSQLite, messageIDs, userID)
+}
+
+func (cs *ConnectorSQLite) getAttachment(ctx context.Context, attachmentID uint64) (Attachment, error) {
+	return sqlGetAttachment(ctx, cs.db, dialectSQLite, attachmentID)
+}
+
+func (cs *ConnectorSQLite) getAttachments(ctx context.Context, messageIDs []uint64) (map[uint64][]Attachment, error) {
+	return sqlGetAttachments(ctx, cs.db, dialectSQLite, messageIDs)
+}
+
+// Проверка существования хотя бы одной строки в выборке
+func (cs *ConnectorSQLite) exists(ctx context.Context, query string, args ...interface{}) (bool, error) {
+	rows, err := cs.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	return rows.Next(), rows.Err()
+}
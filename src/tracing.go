@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/XSAM/otelsql"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Имя сервиса в трассах и имя инструментирующей библиотеки
+const (
+	traceServiceName    = "chat"
+	defaultOTLPEndpoint = "http://localhost:4318"
+	tracerName          = "github.com/rogatzkij/backend-trainee-assignment"
+	connectorSpanPrefix = "connector."
+	storageSystemMemory = "memory"
+)
+
+var tracer = otel.Tracer(tracerName)
+
+// Настройка трассировки по конфигурации сервиса. Контекст трассировки принимается в формате
+// W3C Trace Context независимо от экспортера. Возвращает функцию, отправляющую накопленные спаны при остановке
+func initTracing(config *Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	switch strings.ToLower(config.TraceExporter) {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		options, err := otlpOptions(config.TraceEndpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+		if err != nil {
+			return nil, err
+		}
+	case "stdout":
+		var w io.Writer = os.Stdout
+		if config.TraceFile != "" {
+			f, err := os.OpenFile(config.TraceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+			if err != nil {
+				return nil, err
+			}
+			w = f
+		}
+
+		var err error
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("неизвестный экспортер трасс %s", config.TraceExporter)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.TraceSampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(traceServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Параметры OTLP/HTTP экспортера по адресу коллектора вида http://host:4318/v1/traces,
+// путь по умолчанию - /v1/traces
+func otlpOptions(endpoint string) ([]otlptracehttp.Option, error) {
+	if endpoint == "" {
+		endpoint = defaultOTLPEndpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("недопустимый адрес коллектора трасс %q", endpoint)
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	switch u.Scheme {
+	case "http":
+		options = append(options, otlptracehttp.WithInsecure())
+	case "https":
+	default:
+		return nil, fmt.Errorf("недопустимая схема адреса коллектора трасс %q", endpoint)
+	}
+	if u.Path != "" && u.Path != "/" {
+		options = append(options, otlptracehttp.WithURLPath(u.Path))
+	}
+
+	return options, nil
+}
+
+// Подключение к БД, запросы которого записываются спанами с текстом SQL в атрибуте db.statement
+func openTracedDB(driverName string, dataSourceName string, dialect string) (*sql.DB, error) {
+	return otelsql.Open(driverName, dataSourceName,
+		otelsql.WithAttributes(dbSystem(dialect)),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitRows:             true,
+		}),
+	)
+}
+
+// Атрибут db.system по диалекту SQL
+func dbSystem(dialect string) attribute.KeyValue {
+	switch dialect {
+	case dialectMySQL:
+		return semconv.DBSystemMySQL
+	case dialectPostgres:
+		return semconv.DBSystemPostgreSQL
+	case dialectSQLite:
+		return semconv.DBSystemSqlite
+	default:
+		return semconv.DBSystemKey.String(dialect)
+	}
+}
+
+// Миделвара трассировки: серверный спан на запрос с именем по шаблону маршрута.
+// Входящий контекст трассировки продолжается, если клиент передал заголовок traceparent
+func TraceMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		if serviceRoutes[route] {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest(traceServiceName, route, withoutQuery(r))...),
+		)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(recorder.status)...)
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(recorder.status, trace.SpanKindServer))
+	})
+}
+
+// Копия запроса без параметров в http.target: в параметре access_token передается токен подключения по WebSocket
+func withoutQuery(r *http.Request) *http.Request {
+	stripped := *r
+	stripped.RequestURI = r.URL.EscapedPath()
+
+	return &stripped
+}
+
+// TracingConnector - Коннектор, записывающий вызов каждого метода другого коннектора дочерним спаном.
+// Спаны запросов к БД вкладываются в спан метода
+type TracingConnector struct {
+	next   Connector
+	system attribute.KeyValue
+}
+
+func NewTracingConnector(next Connector) *TracingConnector {
+	system := semconv.DBSystemKey.String(storageSystemMemory)
+	if sqlConnector, ok := next.(SQLConnector); ok {
+		system = dbSystem(sqlConnector.sqlDialect())
+	}
+
+	return &TracingConnector{next: next, system: system}
+}
+
+// Начало спана метода коннектора. Возвращает контекст для вызова метода и функцию,
+// которая вызывается отложенно с указателем на возвращаемую ошибку и завершает спан
+func (tc *TracingConnector) start(ctx context.Context, method string) (context.Context, func(*error)) {
+	ctx, span := tracer.Start(ctx, connectorSpanPrefix+method,
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(tc.system),
+	)
+
+	return ctx, func(err *error) {
+		// Отсутствие и повтор сущности - ожидаемые ответы, они отмечаются событием без статуса ошибки
+		if *err != nil {
+			span.RecordError(*err)
+			if !errors.Is(*err, ErrNotExist) && !errors.Is(*err, ErrAlreadyExist) {
+				span.SetStatus(codes.Error, (*err).Error())
+			}
+		}
+		span.End()
+	}
+}
+
+func (tc *TracingConnector) ping(ctx context.Context) (err error) {
+	ctx, end := tc.start(ctx, "ping")
+	defer end(&err)
+	return tc.next.ping(ctx)
+}
+
+func (tc *TracingConnector) createUser(ctx context.Context, username string, passwordHash string) (user User, err error) {
+	ctx, end := tc.start(ctx, "createUser")
+	defer end(&err)
+	return tc.next.createUser(ctx, username, passwordHash)
+}
+
+func (tc *TracingConnector) getCredentials(ctx context.Context, username string) (user User, hash string, err error) {
+	ctx, end := tc.start(ctx, "getCredentials")
+	defer end(&err)
+	return tc.next.getCredentials(ctx, username)
+}
+
+func (tc *TracingConnector) checkUsername(ctx context.Context, username string) (ok bool, err error) {
+	ctx, end := tc.start(ctx, "checkUsername")
+	defer end(&err)
+	return tc.next.checkUsername(ctx, username)
+}
+
+func (tc *TracingConnector) checkUserID(ctx context.Context, user uint64) (ok bool, err error) {
+	ctx, end := tc.start(ctx, "checkUserID")
+	defer end(&err)
+	return tc.next.checkUserID(ctx, user)
+}
+
+func (tc *TracingConnector) createChart(ctx context.Context, name string, ownerID uint64, users []uint64) (chat Chat, err error) {
+	ctx, end := tc.start(ctx, "createChart")
+	defer end(&err)
+	return tc.next.createChart(ctx, name, ownerID, users)
+}
+
+func (tc *TracingConnector) checkChartName(ctx context.Context, name string) (ok bool, err error) {
+	ctx, end := tc.start(ctx, "checkChartName")
+	defer end(&err)
+	return tc.next.checkChartName(ctx, name)
+}
+
+func (tc *TracingConnector) checkChartID(ctx context.Context, chat uint64) (ok bool, err error) {
+	ctx, end := tc.start(ctx, "checkChartID")
+	defer end(&err)
+	return tc.next.checkChartID(ctx, chat)
+}
+
+func (tc *TracingConnector) isMember(ctx context.Context, chat uint64, user uint64) (ok bool, err error) {
+	ctx, end := tc.start(ctx, "isMember")
+	defer end(&err)
+	return tc.next.isMember(ctx, chat, user)
+}
+
+func (tc *TracingConnector) getRole(ctx context.Context, chat uint64, user uint64) (role string, err error) {
+	ctx, end := tc.start(ctx, "getRole")
+	defer end(&err)
+	return tc.next.getRole(ctx, chat, user)
+}
+
+func (tc *TracingConnector) setRole(ctx context.Context, chat uint64, user uint64, role string) (err error) {
+	ctx, end := tc.start(ctx, "setRole")
+	defer end(&err)
+	return tc.next.setRole(ctx, chat, user, role)
+}
+
+func (tc *TracingConnector) getCharts(ctx context.Context, user uint64) (chats []Chat, err error) {
+	ctx, end := tc.start(ctx, "getCharts")
+	defer end(&err)
+	return tc.next.getCharts(ctx, user)
+}
+
+func (tc *TracingConnector) sendMessage(ctx context.Context, chatID uint64, authorID uint64, text string, replyTo uint64, attachments []Attachment) (message Message, err error) {
+	ctx, end := tc.start(ctx, "sendMessage")
+	defer end(&err)
+	return tc.next.sendMessage(ctx, chatID, authorID, text, replyTo, attachments)
+}
+
+func (tc *TracingConnector) getMessage(ctx context.Context, messageID uint64) (message Message, err error) {
+	ctx, end := tc.start(ctx, "getMessage")
+	defer end(&err)
+	return tc.next.getMessage(ctx, messageID)
+}
+
+func (tc *TracingConnector) getMessages(ctx context.Context, chatID uint64, page MessagePage) (messages []Message, hasMore bool, err error) {
+	ctx, end := tc.start(ctx, "getMessages")
+	defer end(&err)
+	return tc.next.getMessages(ctx, chatID, page)
+}
+
+func (tc *TracingConnector) getThread(ctx context.Context, rootID uint64, page MessagePage) (messages []Message, hasMore bool, err error) {
+	ctx, end := tc.start(ctx, "getThread")
+	defer end(&err)
+	return tc.next.getThread(ctx, rootID, page)
+}
+
+func (tc *TracingConnector) searchMessages(ctx context.Context, userID uint64, query SearchQuery, page MessagePage) (messages []Message, hasMore bool, err error) {
+	ctx, end := tc.start(ctx, "searchMessages")
+	defer end(&err)
+	return tc.next.searchMessages(ctx, userID, query, page)
+}
+
+func (tc *TracingConnector) markRead(ctx context.Context, chatID uint64, userID uint64, messageID uint64) (cursor uint64, err error) {
+	ctx, end := tc.start(ctx, "markRead")
+	defer end(&err)
+	return tc.next.markRead(ctx, chatID, userID, messageID)
+}
+
+func (tc *TracingConnector) getReadCursors(ctx context.Context, chatID uint64) (cursors map[uint64]uint64, err error) {
+	ctx, end := tc.start(ctx, "getReadCursors")
+	defer end(&err)
+	return tc.next.getReadCursors(ctx, chatID)
+}
+
+func (tc *TracingConnector) editMessage(ctx context.Context, messageID uint64, text string) (message Message, err error) {
+	ctx, end := tc.start(ctx, "editMessage")
+	defer end(&err)
+	return tc.next.editMessage(ctx, messageID, text)
+}
+
+func (tc *TracingConnector) deleteMessage(ctx context.Context, messageID uint64) (message Message, err error) {
+	ctx, end := tc.start(ctx, "deleteMessage")
+	defer end(&err)
+	return tc.next.deleteMessage(ctx, messageID)
+}
+
+func (tc *TracingConnector) getRevisions(ctx context.Context, messageID uint64) (revisions []MessageRevision, err error) {
+	ctx, end := tc.start(ctx, "getRevisions")
+	defer end(&err)
+	return tc.next.getRevisions(ctx, messageID)
+}
+
+func (tc *TracingConnector) addMembers(ctx context.Context, chatID uint64, actorID uint64, users []uint64) (messages []Message, err error) {
+	ctx, end := tc.start(ctx, "addMembers")
+	defer end(&err)
+	return tc.next.addMembers(ctx, chatID, actorID, users)
+}
+
+func (tc *TracingConnector) removeMember(ctx context.Context, chatID uint64, actorID uint64, userID uint64) (message Message, err error) {
+	ctx, end := tc.start(ctx, "removeMember")
+	defer end(&err)
+	return tc.next.removeMember(ctx, chatID, actorID, userID)
+}
+
+func (tc *TracingConnector) addReaction(ctx context.Context, messageID uint64, userID uint64, reaction string) (err error) {
+	ctx, end := tc.start(ctx, "addReaction")
+	defer end(&err)
+	return tc.next.addReaction(ctx, messageID, userID, reaction)
+}
+
+func (tc *TracingConnector) removeReaction(ctx context.Context, messageID uint64, userID uint64, reaction string) (err error) {
+	ctx, end := tc.start(ctx, "removeReaction")
+	defer end(&err)
+	return tc.next.removeReaction(ctx, messageID, userID, reaction)
+}
+
+func (tc *TracingConnector) getReactions(ctx context.Context, messageIDs []uint64, userID uint64) (reactions map[uint64][]Reaction, err error) {
+	ctx, end := tc.start(ctx, "getReactions")
+	defer end(&err)
+	return tc.next.getReactions(ctx, messageIDs, userID)
+}
+
+func (tc *TracingConnector) getAttachment(ctx context.Context, attachmentID uint64) (attachment Attachment, err error) {
+	ctx, end := tc.start(ctx, "getAttachment")
+	defer end(&err)
+	return tc.next.getAttachment(ctx, attachmentID)
+}
+
+func (tc *TracingConnector) getAttachments(ctx context.Context, messageIDs []uint64) (attachments map[uint64][]Attachment, err error) {
+	ctx, end := tc.start(ctx, "getAttachments")
+	defer end(&err)
+	return tc.next.getAttachments(ctx, messageIDs)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+)
+
+func TestTraceMiddlewareOmitsQuery(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	defer provider.Shutdown(context.Background())
+
+	router := mux.NewRouter()
+	router.Use(TraceMiddleware)
+	router.HandleFunc("/subscribe", func(w http.ResponseWriter, r *http.Request) {})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/subscribe?access_token=secret", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("завершено спанов %d, ожидался 1", len(spans))
+	}
+	target := ""
+	for _, attr := range spans[0].Attributes() {
+		if strings.Contains(attr.Value.Emit(), "secret") {
+			t.Fatalf("токен в атрибуте %s: %s", attr.Key, attr.Value.Emit())
+		}
+		if attr.Key == semconv.HTTPTargetKey {
+			target = attr.Value.AsString()
+		}
+	}
+	if target != "/subscribe" {
+		t.Fatalf("http.target %q, ожидался /subscribe", target)
+	}
+}